@@ -0,0 +1,205 @@
+package claimcheck
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+	"go-worker/utils"
+)
+
+const (
+	// FileScheme - url scheme of objects kept in the local filesystem
+	FileScheme = "file"
+	// S3Scheme - url scheme of objects kept in s3
+	S3Scheme = "s3"
+	// DefaultThreshold - body size in bytes above which bodies are offloaded, leaving room
+	// below the 256 KB sqs limit for message attributes
+	DefaultThreshold = 240 * 1024
+	// MaxBodySize - largest body offloaded to a store
+	MaxBodySize = 64 * 1024 * 1024
+)
+
+var (
+	// ErrForeignPointer - pointer to an object outside the configured store
+	ErrForeignPointer = errors.New("claim check pointer is outside the claim check store")
+	// ErrNotFound - offloaded body which does not exist
+	ErrNotFound = errors.New("offloaded body does not exist")
+	// ErrMismatch - offloaded body whose size or digest differs from its pointer
+	ErrMismatch = errors.New("offloaded body does not match its pointer")
+	// s3Store - store shared by all s3 objects, created on first use
+	s3Store *S3Store
+	// s3StoreLock - guards s3Store
+	s3StoreLock sync.Mutex
+)
+
+// Store - object store holding offloaded message bodies, objects are addressed by url
+// and Get reports missing objects as ErrNotFound
+type Store interface {
+	Put(objectURL string, body []byte) error
+	Get(objectURL string) ([]byte, error)
+	Delete(objectURL string) error
+}
+
+// Pointer - holds the location of an offloaded body, sent in place of the body
+type Pointer struct {
+	URL  string `json:"url"`
+	Size int    `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+// pointerBody - json form of a message body carrying a pointer
+type pointerBody struct {
+	ClaimCheck *Pointer `json:"claim_check"`
+}
+
+// Checker - offloads message bodies over the threshold to the store at StoreURL
+type Checker struct {
+	StoreURL  string
+	Threshold int
+	store     Store
+}
+
+// NewChecker - returns a checker from config, or nil when no store is configured
+func NewChecker() (*Checker, error) {
+	cfg := config.GetConfig()
+	storeURL := cfg.GetString("claim_check.store_url")
+	if storeURL == "" {
+		return nil, nil
+	}
+	return NewStoreChecker(storeURL, utils.GetValue(cfg.GetInt("claim_check.threshold"), DefaultThreshold).(int))
+}
+
+// NewStoreChecker - returns a checker offloading bodies over threshold bytes to the store at storeURL
+func NewStoreChecker(storeURL string, threshold int) (*Checker, error) {
+	store, err := StoreFor(storeURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Checker{
+		StoreURL:  strings.TrimSuffix(storeURL, "/"),
+		Threshold: threshold,
+		store:     store,
+	}, nil
+}
+
+// Offload - stores a body over the threshold and returns a pointer body in its place,
+// smaller bodies are returned unchanged
+func (c *Checker) Offload(body string) (string, error) {
+	if len(body) <= c.Threshold {
+		return body, nil
+	}
+	if len(body) > MaxBodySize {
+		return "", errors.Errorf("message body of %d bytes is over the %d byte claim check limit", len(body), MaxBodySize)
+	}
+	pointer := &Pointer{
+		URL:  c.StoreURL + "/" + utils.GetTransactionID(),
+		Size: len(body),
+		MD5:  md5Hex([]byte(body)),
+	}
+	if err := c.store.Put(pointer.URL, []byte(body)); err != nil {
+		return "", errors.Wrap(err, "unable to offload message body")
+	}
+	pointerJSON, err := json.Marshal(pointerBody{ClaimCheck: pointer})
+	if err != nil {
+		return "", err
+	}
+	return string(pointerJSON), nil
+}
+
+// ParsePointer - parses a message body as a pointer, reporting false for bodies which are not one
+func ParsePointer(body string) (*Pointer, bool) {
+	if !strings.Contains(body, `"claim_check"`) {
+		return nil, false
+	}
+	parsed := pointerBody{}
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil || parsed.ClaimCheck == nil || parsed.ClaimCheck.URL == "" {
+		return nil, false
+	}
+	return parsed.ClaimCheck, true
+}
+
+// Owns - returns true if an object url is inside the store of the checker,
+// urls with dot segments are refused so they cannot step out of it
+func (c *Checker) Owns(objectURL string) bool {
+	if c == nil || !strings.HasPrefix(objectURL, c.StoreURL+"/") {
+		return false
+	}
+	u, err := url.Parse(objectURL)
+	return err == nil && path.Clean(u.Path) == u.Path
+}
+
+// Resolve - returns the offloaded body a pointer body refers to along with the pointer,
+// other bodies are returned unchanged with a nil pointer
+// pointers outside the store, missing objects and corrupted bodies fail with
+// ErrForeignPointer, ErrNotFound and ErrMismatch, other errors are transient
+func (c *Checker) Resolve(body string) (string, *Pointer, error) {
+	pointer, ok := ParsePointer(body)
+	if !ok {
+		return body, nil, nil
+	}
+	if !c.Owns(pointer.URL) {
+		return "", pointer, errors.Wrap(ErrForeignPointer, pointer.URL)
+	}
+	data, err := c.store.Get(pointer.URL)
+	if err != nil {
+		return "", pointer, errors.Wrapf(err, "unable to fetch offloaded body %s", pointer.URL)
+	}
+	if len(data) != pointer.Size || (pointer.MD5 != "" && md5Hex(data) != pointer.MD5) {
+		return "", pointer, errors.Wrap(ErrMismatch, pointer.URL)
+	}
+	return string(data), pointer, nil
+}
+
+// Delete - deletes an offloaded body by its url, urls outside the store are refused
+func (c *Checker) Delete(objectURL string) error {
+	if !c.Owns(objectURL) {
+		return errors.Wrap(ErrForeignPointer, objectURL)
+	}
+	return c.store.Delete(objectURL)
+}
+
+// IsPermanent - returns true if resolving a pointer failed in a way redelivery cannot fix
+func IsPermanent(err error) bool {
+	switch errors.Cause(err) {
+	case ErrForeignPointer, ErrNotFound, ErrMismatch:
+		return true
+	}
+	return false
+}
+
+// StoreFor - returns the store serving an object or store url by its scheme
+func StoreFor(objectURL string) (Store, error) {
+	u, err := url.Parse(objectURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid claim check url")
+	}
+	switch u.Scheme {
+	case FileScheme:
+		return FileStore{}, nil
+	case S3Scheme:
+		s3StoreLock.Lock()
+		defer s3StoreLock.Unlock()
+		if s3Store == nil {
+			if s3Store, err = NewS3Store(); err != nil {
+				return nil, err
+			}
+		}
+		return s3Store, nil
+	default:
+		return nil, errors.Errorf("unsupported claim check store %q", u.Scheme)
+	}
+}
+
+// md5Hex - returns the hex encoded md5 digest of data
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
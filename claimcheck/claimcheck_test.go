@@ -0,0 +1,134 @@
+package claimcheck
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockS3 - holds s3 mocking info
+type mockS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+// TestPositiveOffload - tests large bodies are stored and resolved through a pointer
+func TestPositiveOffload(t *testing.T) {
+	check := assert.New(t)
+	checker := getFileChecker(t)
+
+	body, err := checker.Offload("small")
+	check.NoError(err)
+	check.Equal("small", body)
+	resolved, pointer, err := checker.Resolve(body)
+	check.NoError(err)
+	check.Nil(pointer)
+	check.Equal("small", resolved)
+
+	large := strings.Repeat("x", 100)
+	body, err = checker.Offload(large)
+	check.NoError(err)
+	check.Contains(body, "claim_check")
+	resolved, pointer, err = checker.Resolve(body)
+	check.NoError(err)
+	check.Equal(large, resolved)
+	check.Equal(100, pointer.Size)
+
+	// deleted bodies are gone and deleting them again is not an error
+	check.NoError(checker.Delete(pointer.URL))
+	check.NoError(checker.Delete(pointer.URL))
+	_, _, err = checker.Resolve(body)
+	check.Equal(ErrNotFound, errors.Cause(err))
+	check.True(IsPermanent(err))
+}
+
+// TestNegativeResolve - tests corrupted bodies and pointers outside the store are rejected
+func TestNegativeResolve(t *testing.T) {
+	check := assert.New(t)
+	checker := getFileChecker(t)
+
+	body, err := checker.Offload(strings.Repeat("x", 100))
+	check.NoError(err)
+	pointer, ok := ParsePointer(body)
+	check.True(ok)
+	check.NoError(os.WriteFile(strings.TrimPrefix(pointer.URL, "file://"), []byte(strings.Repeat("y", 100)), 0o644))
+	_, _, err = checker.Resolve(body)
+	check.Equal(ErrMismatch, errors.Cause(err))
+
+	for _, objectURL := range []string{
+		"ftp://host/object",
+		"file:///etc/passwd",
+		checker.StoreURL + "/../object",
+		checker.StoreURL + "-other/object",
+	} {
+		_, _, err = checker.Resolve(`{"claim_check": {"url": "` + objectURL + `", "size": 1}}`)
+		check.Equal(ErrForeignPointer, errors.Cause(err), objectURL)
+		check.Equal(ErrForeignPointer, errors.Cause(checker.Delete(objectURL)), objectURL)
+	}
+	var unconfigured *Checker
+	_, _, err = unconfigured.Resolve(body)
+	check.True(IsPermanent(err))
+
+	// store outages are left for redelivery
+	check.False(IsPermanent(errors.New("connection refused")))
+
+	_, ok = ParsePointer(`{"user_id": 1, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb"}`)
+	check.False(ok)
+}
+
+// TestPositiveS3Store - tests objects are put, fetched and deleted by their s3 urls
+func TestPositiveS3Store(t *testing.T) {
+	check := assert.New(t)
+	store := &S3Store{Client: &mockS3{objects: map[string][]byte{}}}
+
+	objectURL := "s3://billing-payloads/events/1"
+	check.NoError(store.Put(objectURL, []byte("body")))
+	body, err := store.Get(objectURL)
+	check.NoError(err)
+	check.Equal("body", string(body))
+	check.NoError(store.Delete(objectURL))
+	check.NoError(store.Delete(objectURL))
+	_, err = store.Get(objectURL)
+	check.Equal(ErrNotFound, err)
+	check.Error(store.Put("s3://billing-payloads", []byte("body")))
+}
+
+// getFileChecker - returns a checker offloading bodies over 10 bytes to a temporary directory
+func getFileChecker(t *testing.T) *Checker {
+	checker, err := NewStoreChecker("file://"+t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("unable to create checker: %s", err)
+	}
+	return checker
+}
+
+// PutObject - mock s3 put object call
+func (m *mockS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	body, _ := io.ReadAll(in.Body)
+	m.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+// GetObject - mock s3 get object call
+func (m *mockS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	body, ok := m.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "the specified key does not exist", nil)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+// DeleteObject - mock s3 delete object call, s3 does not fail for missing keys
+func (m *mockS3) DeleteObject(in *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(m.objects, aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
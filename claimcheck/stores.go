@@ -0,0 +1,149 @@
+package claimcheck
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+	"go-worker/utils"
+)
+
+// FileStore - store keeping objects as files, e.g. file:///var/lib/go-worker/payloads/<id>
+type FileStore struct{}
+
+// Put - writes an object through a temporary file so readers never see a partial body
+func (FileStore) Put(objectURL string, body []byte) error {
+	path, err := filePath(objectURL)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.Wrap(err, "unable to create claim check directory")
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, body, 0o644); err != nil {
+		return errors.Wrap(err, "unable to write claim check object")
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get - reads an object, missing objects are ErrNotFound
+func (FileStore) Get(objectURL string) ([]byte, error) {
+	path, err := filePath(objectURL)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Delete - removes an object, objects which are already gone are not an error
+func (FileStore) Delete(objectURL string) error {
+	path, err := filePath(objectURL)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// filePath - returns the path of a file object url
+func filePath(objectURL string) (string, error) {
+	u, err := url.Parse(objectURL)
+	if err != nil || u.Path == "" {
+		return "", errors.Errorf("invalid claim check file url %q", objectURL)
+	}
+	return u.Path, nil
+}
+
+// S3Store - store keeping objects in s3, e.g. s3://bucket/payloads/<id>
+type S3Store struct {
+	Client s3iface.S3API
+}
+
+// NewS3Store - returns a store for the configured region
+// claim_check.endpoint overrides the aws endpoint, e.g. to point at a local s3 server
+func NewS3Store() (*S3Store, error) {
+	cfg := config.GetConfig()
+	awsConfig := &aws.Config{
+		Region: aws.String(utils.GetValue(cfg.GetString("claim_check.region"), cfg.GetString("sqs.region")).(string)),
+	}
+	if endpoint := cfg.GetString("claim_check.endpoint"); endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{Client: s3.New(sess)}, nil
+}
+
+// Put - uploads an object
+func (s *S3Store) Put(objectURL string, body []byte) error {
+	bucket, key, err := s3Location(objectURL)
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+// Get - downloads an object, missing objects are ErrNotFound
+func (s *S3Store) Get(objectURL string) ([]byte, error) {
+	bucket, key, err := s3Location(objectURL)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.Client.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// Delete - deletes an object, objects which are already gone are not an error
+func (s *S3Store) Delete(objectURL string) error {
+	bucket, key, err := s3Location(objectURL)
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil
+	}
+	return err
+}
+
+// s3Location - returns the bucket and key of an s3 object url
+func s3Location(objectURL string) (string, string, error) {
+	u, err := url.Parse(objectURL)
+	if err != nil || u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+		return "", "", errors.Errorf("invalid claim check s3 url %q", objectURL)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
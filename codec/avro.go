@@ -0,0 +1,107 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"strconv"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	// avroMagicByte - first byte of schema registry framed avro bodies
+	avroMagicByte = 0
+	// avroHeaderSize - size of the magic byte and the big endian schema id
+	avroHeaderSize = 5
+)
+
+// AvroRegistry - holds avro codecs by schema id, loaded from a local schema registry file
+// bodies use the schema registry wire format, a zero magic byte and a 4 byte schema id before the avro data
+type AvroRegistry struct {
+	codecs map[uint32]*goavro.Codec
+}
+
+// LoadAvroRegistry - loads a schema registry file, a json object of avro schemas keyed by schema id
+func LoadAvroRegistry(registryFile string) (*AvroRegistry, error) {
+	data, err := os.ReadFile(registryFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read avro schema registry")
+	}
+	return NewAvroRegistry(data)
+}
+
+// NewAvroRegistry - returns a registry of the avro schemas in a json object keyed by schema id
+func NewAvroRegistry(data []byte) (*AvroRegistry, error) {
+	schemas := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return nil, errors.Wrap(err, "invalid avro schema registry")
+	}
+	registry := &AvroRegistry{codecs: make(map[uint32]*goavro.Codec, len(schemas))}
+	for id, schema := range schemas {
+		schemaID, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid avro schema id %q", id)
+		}
+		// standard json leaves unions unwrapped, as in the json encoding of billing events
+		codec, err := goavro.NewCodecForStandardJSONFull(string(schema))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid avro schema %s", id)
+		}
+		registry.codecs[uint32(schemaID)] = codec
+	}
+	return registry, nil
+}
+
+// Decode - decodes a framed avro billing event to json
+func (r *AvroRegistry) Decode(data []byte) ([]byte, error) {
+	if len(data) < avroHeaderSize || data[0] != avroMagicByte {
+		return nil, errors.New("avro body is missing the schema registry header")
+	}
+	schemaID := binary.BigEndian.Uint32(data[1:avroHeaderSize])
+	codec, ok := r.codecs[schemaID]
+	if !ok {
+		return nil, errors.Errorf("unknown avro schema id %d", schemaID)
+	}
+	native, _, err := codec.NativeFromBinary(data[avroHeaderSize:])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid avro body")
+	}
+	textual, err := codec.TextualFromNative(nil, native)
+	if err != nil {
+		return nil, err
+	}
+
+	// null optional fields are left out like in json bodies, and as avro has
+	// no raw json type the cdr is carried as a json string
+	event := map[string]json.RawMessage{}
+	if err = json.Unmarshal(textual, &event); err != nil {
+		return nil, err
+	}
+	for name, value := range event {
+		if string(value) == "null" {
+			delete(event, name)
+		}
+	}
+	var cdr string
+	if err = json.Unmarshal(event["cdr"], &cdr); err == nil {
+		if !json.Valid([]byte(cdr)) {
+			return nil, errors.New("avro field cdr is not json")
+		}
+		event["cdr"] = json.RawMessage(cdr)
+	}
+	return json.Marshal(event)
+}
+
+// Encode - encodes a native avro billing event with the schema id and its wire format header,
+// for producers publishing with ContentTypeAvro
+func (r *AvroRegistry) Encode(schemaID uint32, native map[string]interface{}) ([]byte, error) {
+	codec, ok := r.codecs[schemaID]
+	if !ok {
+		return nil, errors.Errorf("unknown avro schema id %d", schemaID)
+	}
+	header := make([]byte, avroHeaderSize)
+	binary.BigEndian.PutUint32(header[1:], schemaID)
+	return codec.BinaryFromNative(header, native)
+}
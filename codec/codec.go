@@ -0,0 +1,84 @@
+package codec
+
+import (
+	"encoding/base64"
+	"mime"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+)
+
+const (
+	// ContentTypeAttribute - message attribute naming the encoding of the message body
+	ContentTypeAttribute = "content_type"
+	// ContentTypeJSON - json encoded bodies, assumed when no content type is given
+	ContentTypeJSON = "application/json"
+	// ContentTypeProtobuf - base64 encoded protocol buffers bodies, see billing_event.proto
+	ContentTypeProtobuf = "application/x-protobuf"
+	// ContentTypeAvro - base64 encoded avro bodies framed with a schema registry header
+	ContentTypeAvro = "avro/binary"
+)
+
+// Transcoder - converts message bodies in any supported encoding to json,
+// so every encoding shares the same schema versions and billing event
+type Transcoder struct {
+	Avro *AvroRegistry
+}
+
+// NewTranscoder - returns a transcoder from config, avro bodies are only
+// supported when a schema registry file is configured
+func NewTranscoder() (*Transcoder, error) {
+	transcoder := &Transcoder{}
+	if registryFile := config.GetConfig().GetString("codec.avro_registry_file"); registryFile != "" {
+		registry, err := LoadAvroRegistry(registryFile)
+		if err != nil {
+			return nil, err
+		}
+		transcoder.Avro = registry
+	}
+	return transcoder, nil
+}
+
+// ToJSON - returns the json form of a body with the given content type
+func (t *Transcoder) ToJSON(contentType string, body []byte) ([]byte, error) {
+	mediaType := ContentTypeJSON
+	if strings.TrimSpace(contentType) != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, errors.Wrapf(err, "invalid content type %q", contentType)
+		}
+	}
+
+	switch mediaType {
+	case ContentTypeJSON:
+		return body, nil
+	case ContentTypeProtobuf, "application/protobuf":
+		data, err := decodeBase64(body)
+		if err != nil {
+			return nil, err
+		}
+		return UnmarshalProto(data)
+	case ContentTypeAvro, "application/avro":
+		if t == nil || t.Avro == nil {
+			return nil, errors.New("avro bodies need codec.avro_registry_file")
+		}
+		data, err := decodeBase64(body)
+		if err != nil {
+			return nil, err
+		}
+		return t.Avro.Decode(data)
+	default:
+		return nil, errors.Errorf("unsupported content type %q", mediaType)
+	}
+}
+
+// decodeBase64 - decodes a binary body, queues only carry text so binary encodings are base64 encoded
+func decodeBase64(body []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, errors.Wrap(err, "binary bodies must be base64 encoded")
+	}
+	return data, nil
+}
@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/models"
+)
+
+// billingJSON - json encoding of the billing event every codec decodes to
+const billingJSON = `{"schema_version":2,"user_id":1,"product_id":2,"call_id":"e21b0dda-6566-402a-8f8c-0657e5b87eeb",
+	"answer_time":"2021-07-01 00:30:00","hangup_time":"2021-07-01 01:00:00","direction":"outbound","cdr":{"sip_code":200}}`
+
+// TestPositiveToJSON - tests json, protobuf and avro bodies decode to the same event
+func TestPositiveToJSON(t *testing.T) {
+	check := assert.New(t)
+	transcoder := &Transcoder{Avro: getAvroRegistry(t)}
+	event := models.BillingEvent{}
+	check.NoError(json.Unmarshal([]byte(billingJSON), &event))
+
+	body, err := transcoder.ToJSON("", []byte(billingJSON))
+	check.NoError(err)
+	check.JSONEq(billingJSON, string(body))
+
+	protoBody := base64.StdEncoding.EncodeToString(MarshalProto(event))
+	body, err = transcoder.ToJSON("application/x-protobuf; proto=gobilling.BillingEvent", []byte(protoBody))
+	check.NoError(err)
+	check.JSONEq(billingJSON, string(body))
+
+	avroData, err := transcoder.Avro.Encode(1, map[string]interface{}{
+		"schema_version": map[string]interface{}{"int": int32(2)},
+		"user_id":        int64(1),
+		"product_id":     int64(2),
+		"call_id":        event.CallID,
+		"answer_time":    event.AnswerTime,
+		"hangup_time":    event.HangupTime,
+		"direction":      map[string]interface{}{"string": "outbound"},
+		"cdr":            map[string]interface{}{"string": `{"sip_code":200}`},
+	})
+	check.NoError(err)
+	body, err = transcoder.ToJSON(ContentTypeAvro, []byte(base64.StdEncoding.EncodeToString(avroData)))
+	check.NoError(err)
+	check.JSONEq(billingJSON, string(body))
+}
+
+// TestNegativeToJSON - tests unsupported content types and malformed binary bodies are rejected
+func TestNegativeToJSON(t *testing.T) {
+	check := assert.New(t)
+	transcoder := &Transcoder{}
+
+	_, err := transcoder.ToJSON("text/csv", []byte("1,2"))
+	check.Error(err)
+	_, err = transcoder.ToJSON(ContentTypeProtobuf, []byte("not base64!"))
+	check.Error(err)
+	_, err = transcoder.ToJSON(ContentTypeProtobuf, []byte(base64.StdEncoding.EncodeToString([]byte{0x22, 0x05, 'a'})))
+	check.Error(err)
+	_, err = transcoder.ToJSON(ContentTypeAvro, []byte(base64.StdEncoding.EncodeToString([]byte{0, 0, 0, 0, 1})))
+	check.Error(err)
+
+	transcoder.Avro = getAvroRegistry(t)
+	_, err = transcoder.ToJSON(ContentTypeAvro, []byte(base64.StdEncoding.EncodeToString([]byte{0, 0, 0, 0, 9, 2})))
+	check.Error(err)
+	_, err = transcoder.ToJSON(ContentTypeAvro, []byte(base64.StdEncoding.EncodeToString([]byte{1, 2, 3})))
+	check.Error(err)
+}
+
+// getAvroRegistry - returns the registry of the example schema registry file
+func getAvroRegistry(t *testing.T) *AvroRegistry {
+	data, err := os.ReadFile("../config/avro_registry.json")
+	if err != nil {
+		t.Fatalf("unable to read schema registry: %s", err)
+	}
+	registry, err := NewAvroRegistry(data)
+	if err != nil {
+		t.Fatalf("unable to load schema registry: %s", err)
+	}
+	return registry
+}
@@ -0,0 +1,104 @@
+package codec
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"go-worker/models"
+)
+
+// protoField - holds the json name and wire type of a billing event field in billing_event.proto
+type protoField struct {
+	name     string
+	wireType protowire.Type
+}
+
+// protoFields - billing event fields by field number
+var protoFields = map[protowire.Number]protoField{
+	1:  {"schema_version", protowire.VarintType},
+	2:  {"user_id", protowire.VarintType},
+	3:  {"product_id", protowire.VarintType},
+	4:  {"call_id", protowire.BytesType},
+	5:  {"answer_time", protowire.BytesType},
+	6:  {"hangup_time", protowire.BytesType},
+	7:  {"currency", protowire.BytesType},
+	8:  {"direction", protowire.BytesType},
+	9:  {"destination", protowire.BytesType},
+	10: {"cdr", protowire.BytesType},
+}
+
+// UnmarshalProto - decodes a protocol buffers billing event to json, unknown fields are skipped
+func UnmarshalProto(data []byte) ([]byte, error) {
+	event := map[string]interface{}{}
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, errors.Wrap(protowire.ParseError(n), "invalid protobuf tag")
+		}
+		data = data[n:]
+
+		field, known := protoFields[number]
+		if !known || field.wireType != wireType {
+			if n = protowire.ConsumeFieldValue(number, wireType, data); n < 0 {
+				return nil, errors.Wrapf(protowire.ParseError(n), "invalid protobuf field %d", number)
+			}
+			data = data[n:]
+			continue
+		}
+
+		switch wireType {
+		case protowire.VarintType:
+			var value uint64
+			if value, n = protowire.ConsumeVarint(data); n < 0 {
+				return nil, errors.Wrapf(protowire.ParseError(n), "invalid protobuf field %s", field.name)
+			}
+			event[field.name] = int64(value)
+		case protowire.BytesType:
+			var value []byte
+			if value, n = protowire.ConsumeBytes(data); n < 0 {
+				return nil, errors.Wrapf(protowire.ParseError(n), "invalid protobuf field %s", field.name)
+			}
+			if field.name == "cdr" {
+				if !json.Valid(value) {
+					return nil, errors.New("protobuf field cdr is not json")
+				}
+				event[field.name] = json.RawMessage(value)
+			} else {
+				event[field.name] = string(value)
+			}
+		}
+		data = data[n:]
+	}
+	return json.Marshal(event)
+}
+
+// MarshalProto - encodes a billing event as protocol buffers, for producers publishing
+// with ContentTypeProtobuf
+func MarshalProto(event models.BillingEvent) []byte {
+	var data []byte
+	appendVarint := func(number protowire.Number, value int64) {
+		if value != 0 {
+			data = protowire.AppendTag(data, number, protowire.VarintType)
+			data = protowire.AppendVarint(data, uint64(value))
+		}
+	}
+	appendBytes := func(number protowire.Number, value []byte) {
+		if len(value) > 0 {
+			data = protowire.AppendTag(data, number, protowire.BytesType)
+			data = protowire.AppendBytes(data, value)
+		}
+	}
+	appendVarint(1, int64(event.SchemaVersion))
+	appendVarint(2, int64(event.UserID))
+	appendVarint(3, int64(event.ProductID))
+	appendBytes(4, []byte(event.CallID))
+	appendBytes(5, []byte(event.AnswerTime))
+	appendBytes(6, []byte(event.HangupTime))
+	appendBytes(7, []byte(event.Currency))
+	appendBytes(8, []byte(event.Direction))
+	appendBytes(9, []byte(event.Destination))
+	appendBytes(10, event.CDR)
+	return data
+}
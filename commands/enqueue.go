@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"go-worker/claimcheck"
+	"go-worker/logger"
+	"go-worker/producer"
+	"go-worker/queue"
+)
+
+// stdinFile - file name which makes enqueue read from stdin
+const stdinFile = "-"
+
+// maxLineSize - maximum size of a single jsonl line, events over the sqs limit are offloaded
+// to the claim check store so lines may be as large as it accepts
+var maxLineSize = claimcheck.MaxBodySize
+
+// attributeFlags - collects repeated key=value message attribute flags
+type attributeFlags map[string]string
+
+// String - returns the string form of the attributes
+func (a attributeFlags) String() string {
+	var pairs []string
+	for key, value := range a {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set - parses a key=value attribute
+func (a attributeFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid attribute %q, expected key=value", value)
+	}
+	a[parts[0]] = parts[1]
+	return nil
+}
+
+// Enqueue - publishes billing events read from a jsonl file or stdin
+func Enqueue(args []string) error {
+	attributes := attributeFlags{}
+	flags := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	file := flags.String("f", stdinFile, "jsonl file with one billing event per line, - for stdin")
+	delay := flags.Int64("delay", 0, "delivery delay in seconds")
+	groupID := flags.String("group", "", "message group id for fifo queues, defaults to user_id")
+	flags.Var(attributes, "attr", "message attribute as key=value, can be repeated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	input := os.Stdin
+	if *file != stdinFile {
+		f, err := os.Open(*file)
+		if err != nil {
+			return errors.Wrap(err, "unable to open events file")
+		}
+		defer f.Close()
+		input = f
+	}
+
+	p, err := producer.NewProducer(logger.Log.WithField("prefix", "enqueue"))
+	if err != nil {
+		return err
+	}
+	template := producer.Message{
+		DelaySeconds: *delay,
+		Attributes:   attributes,
+		GroupID:      *groupID,
+	}
+	published, failed, err := streamEvents(input, p, template)
+	logger.Log.Infof("Enqueued %d billing events, %d failed", published, failed)
+	if closeErr := queue.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// streamEvents - reads events line by line and publishes them in batches
+func streamEvents(input io.Reader, p *producer.Producer, template producer.Message) (published, failed int, err error) {
+	var batch []producer.Message
+	lineNumber := 0
+
+	flush := func() {
+		failedMessages, _ := p.Publish(batch)
+		for _, failedMessage := range failedMessages {
+			logger.Log.WithField("call_id", failedMessage.Message.Event.CallID).Errorf("Unable to enqueue event: %s", failedMessage.Reason)
+		}
+		published += len(batch) - len(failedMessages)
+		failed += len(failedMessages)
+		batch = nil
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		message := template
+		if err = json.Unmarshal([]byte(line), &message.Event); err != nil {
+			logger.Log.WithError(err).Errorf("Unable to decode billing event on line %d", lineNumber)
+			failed++
+			continue
+		}
+		batch = append(batch, message)
+		if len(batch) == producer.MaxBatchSize {
+			flush()
+		}
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+
+	if err = scanner.Err(); err != nil {
+		return published, failed, errors.Wrapf(err, "unable to read events after line %d", lineNumber)
+	}
+	if failed > 0 {
+		return published, failed, errors.Errorf("%d billing events were not enqueued", failed)
+	}
+	return published, failed, nil
+}
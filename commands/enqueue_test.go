@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/claimcheck"
+	"go-worker/logger"
+	"go-worker/producer"
+)
+
+// mockSQS - accepts every published message
+type mockSQS struct {
+	sqsiface.SQSAPI
+	bodies []string
+}
+
+// TestPositiveStreamEvents - tests lines over the sqs limit are enqueued through the claim check store
+func TestPositiveStreamEvents(t *testing.T) {
+	check := assert.New(t)
+	mocksqs, p := getMockProducer(t)
+
+	cdr := strings.Repeat("x", 512*1024)
+	input := `{"user_id": 1, "product_id": 2, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", ` +
+		`"answer_time": "2021-07-01 00:30:00", "hangup_time": "2021-07-01 01:00:00", "cdr": "` + cdr + `"}` + "\n"
+	published, failed, err := streamEvents(strings.NewReader(input), p, producer.Message{})
+	check.NoError(err)
+	check.Equal(1, published)
+	check.Equal(0, failed)
+	body, pointer, err := p.ClaimCheck.Resolve(mocksqs.bodies[0])
+	check.NoError(err)
+	check.NotNil(pointer)
+	check.Contains(body, cdr)
+}
+
+// TestNegativeStreamEvents - tests lines over the line size limit fail the command
+func TestNegativeStreamEvents(t *testing.T) {
+	check := assert.New(t)
+	_, p := getMockProducer(t)
+	defer func(size int) { maxLineSize = size }(maxLineSize)
+	maxLineSize = 128 * 1024
+
+	_, _, err := streamEvents(strings.NewReader(`{"cdr": "`+strings.Repeat("x", 256*1024)+`"}`), p, producer.Message{})
+	check.Error(err)
+	check.Contains(err.Error(), "token too long")
+}
+
+// getMockProducer - returns mocked sqs and a producer offloading large bodies to a file store
+func getMockProducer(t *testing.T) (*mockSQS, *producer.Producer) {
+	checker, err := claimcheck.NewStoreChecker("file://"+t.TempDir(), claimcheck.DefaultThreshold)
+	if err != nil {
+		t.Fatalf("unable to create claim check store: %s", err)
+	}
+	logger.Init()
+	mocksqs := &mockSQS{}
+	return mocksqs, &producer.Producer{
+		SQSClient:  mocksqs,
+		SQSURL:     "https://queue.amazonaws.com/88888EXAMPLE/MyQueue",
+		BatchSize:  producer.MaxBatchSize,
+		ClaimCheck: checker,
+		Log:        logrus.New().WithField("test_producer", 1),
+	}
+}
+
+// SendMessageBatch - mock function for publishing messages
+func (m *mockSQS) SendMessageBatch(in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	output := &sqs.SendMessageBatchOutput{}
+	for _, entry := range in.Entries {
+		m.bodies = append(m.bodies, *entry.MessageBody)
+		output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{Id: entry.Id})
+	}
+	return output, nil
+}
@@ -0,0 +1,70 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	dataAdapters "go-worker/data_adapters"
+	"go-worker/logger"
+)
+
+// Migrate - applies, reverts or lists the embedded schema migrations, e.g. migrate up, migrate down -steps 2
+func Migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	steps := flags.Int("steps", 1, "number of migrations reverted by down")
+	baseline := flags.Int("baseline", 0, "with up, record migrations up to this version as applied without running them")
+	if len(args) == 0 {
+		return errors.New("missing migrate action, expected up, down or status")
+	}
+	action := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if err := dataAdapters.Init(); err != nil {
+		return err
+	}
+	defer dataAdapters.Close()
+
+	switch action {
+	case "up":
+		if *baseline > 0 {
+			marked, err := dataAdapters.MarkMigrated(*baseline)
+			logMigrations("Marked migration %d_%s as applied", marked)
+			if err != nil {
+				return err
+			}
+		}
+		migrated, err := dataAdapters.MigrateUp()
+		logMigrations("Applied migration %d_%s", migrated)
+		return err
+	case "down":
+		reverted, err := dataAdapters.MigrateDown(*steps)
+		logMigrations("Reverted migration %d_%s", reverted)
+		return err
+	case "status":
+		statuses, err := dataAdapters.MigrationStatuses()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied() {
+				state = "applied " + status.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(os.Stdout, "%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+	}
+	return errors.Errorf("unknown migrate action %s, expected up, down or status", action)
+}
+
+// logMigrations - logs each migration run by a migrate action
+func logMigrations(format string, migrations []dataAdapters.Migration) {
+	for _, migration := range migrations {
+		logger.Log.Infof(format, migration.Version, migration.Name)
+	}
+}
@@ -0,0 +1,23 @@
+package commands
+
+import (
+	"flag"
+
+	dataAdapters "go-worker/data_adapters"
+	"go-worker/logger"
+)
+
+// ApplyOrphans - applies the parked charges of calls whose call info row exists by now
+func ApplyOrphans(args []string) error {
+	flags := flag.NewFlagSet("apply-orphans", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := dataAdapters.Init(); err != nil {
+		return err
+	}
+	defer dataAdapters.Close()
+	applied, remaining, err := dataAdapters.ApplyOrphans()
+	logger.Log.Infof("Applied %d parked charges, %d still parked", applied, remaining)
+	return err
+}
@@ -49,3 +49,8 @@ func Init(env string) {
 func GetConfig() *viper.Viper {
 	return config
 }
+
+// SetConfig - replaces the config object, used by tests which do not read a config file
+func SetConfig(v *viper.Viper) {
+	config = v
+}
@@ -2,32 +2,264 @@ package dataadapters
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/mysql" // Blank import for gorm-mysql
+	_ "github.com/jinzhu/gorm/dialects/mysql"    // Blank import for gorm-mysql
+	_ "github.com/jinzhu/gorm/dialects/postgres" // Blank import for gorm-postgres
+	"github.com/pkg/errors"
 
 	"go-worker/config"
+	"go-worker/logger"
+	"go-worker/utils"
 )
 
-var mysqlDB *gorm.DB
+const (
+	// MySQLEngine - database engine of mysql and aurora-mysql
+	MySQLEngine = "mysql"
+	// PostgresEngine - database engine of postgresql
+	PostgresEngine = "postgres"
+	// defaultConnectRetries - attempts made to connect to the database on startup
+	defaultConnectRetries = 5
+	// defaultConnectBackoff - seconds waited after the first failed connection attempt, doubled after each one
+	defaultConnectBackoff = 1
+	// maxConnectBackoff - longest wait between connection attempts
+	maxConnectBackoff = 30 * time.Second
+	// defaultHealthInterval - time between database health pings
+	defaultHealthInterval = 30 * time.Second
+)
+
+var billingDB *gorm.DB
+
+// legacyKeys - mysql section keys of database settings, read by configs without a database section
+var legacyKeys = map[string]string{
+	"engine":   "db_type",
+	"host":     "db_host",
+	"port":     "db_port",
+	"username": "db_username",
+	"password": "db_password",
+	"name":     "db_name",
+}
 
-// Init  - initializes the database connection
-func Init() {
+// healthChecker - pings the database until it is closed, nil before Init
+var healthChecker *HealthChecker
 
+// Init  - initializes the database connection, retrying with backoff while the database is unreachable
+func Init() error {
+
+	c := config.GetConfig()
+
+	// create the connection to data-team's datastore
+	dsn, err := ConnectionString()
+	if err != nil {
+		return err
+	}
+	retries := utils.GetValue(c.GetInt(setting("connect_retries")), defaultConnectRetries).(int)
+	backoff := time.Duration(utils.GetValue(c.GetInt(setting("connect_backoff")), defaultConnectBackoff).(int)) * time.Second
+	billingDB, err = connect(func() (*gorm.DB, error) {
+		return gorm.Open(Engine(), dsn)
+	}, retries, backoff)
+	if err != nil {
+		return errors.Wrapf(err, "can't connect to %s database, check config", Engine())
+	}
+	configurePool(billingDB)
+
+	healthChecker = NewHealthChecker(billingDB, time.Duration(c.GetInt(setting("health_interval")))*time.Second)
+	healthChecker.Start()
+
+	outboxEnabled = c.GetBool("outbox.enabled")
+	if size := c.GetInt(setting("write_batch_size")); size > 0 {
+		writeBatcher = NewWriteBatcher(size, time.Millisecond*time.Duration(c.GetInt(setting("write_batch_interval"))))
+		writeBatcher.Start()
+	}
+	return nil
+}
+
+// Close - flushes the pending batched writes, stops the health pings and closes the database connection
+func Close() {
+	if writeBatcher != nil {
+		writeBatcher.Close()
+		writeBatcher = nil
+	}
+	if healthChecker != nil {
+		healthChecker.Close()
+		healthChecker = nil
+	}
+	if billingDB != nil {
+		if err := billingDB.Close(); err != nil {
+			logger.Log.WithError(err).Error("Unable to close database connection")
+		}
+	}
+}
+
+// SetDB - replaces the database connection, used by tests of other packages which do not connect to a database
+func SetDB(db *gorm.DB) {
+	billingDB = db
+}
+
+// connect - opens the database connection, retrying failed attempts with a backoff
+// that doubles after each one up to maxConnectBackoff
+func connect(open func() (*gorm.DB, error), retries int, backoff time.Duration) (*gorm.DB, error) {
 	var err error
+	for attempt := 1; ; attempt++ {
+		var db *gorm.DB
+		if db, err = open(); err == nil {
+			return db, nil
+		}
+		if attempt >= retries {
+			return nil, err
+		}
+		logger.Log.WithError(err).WithField("attempt", attempt).Warnf("Unable to connect to database, retrying in %s", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// configurePool - applies the configured connection pool limits
+func configurePool(db *gorm.DB) {
+	c := config.GetConfig()
+	poolSize := c.GetInt(setting("pool_size"))
+	db.DB().SetMaxOpenConns(poolSize)
+	// without a limit of their own idle connections are kept up to the pool size
+	if maxIdle := utils.GetValue(c.GetInt(setting("max_idle_conns")), poolSize).(int); maxIdle > 0 {
+		db.DB().SetMaxIdleConns(maxIdle)
+	}
+	db.DB().SetConnMaxLifetime(time.Minute * time.Duration(c.GetInt(setting("conn_life_time"))))
+	db.DB().SetConnMaxIdleTime(time.Minute * time.Duration(c.GetInt(setting("conn_idle_time"))))
+}
+
+// setting - returns the config key of a database setting, keys missing from the database
+// section are read from the mysql section of older configs
+func setting(key string) string {
+	if config.GetConfig().IsSet("database." + key) {
+		return "database." + key
+	}
+	if legacyKey, ok := legacyKeys[key]; ok {
+		return "mysql." + legacyKey
+	}
+	return "mysql." + key
+}
+
+// Engine - returns the configured database engine, mysql unless set
+func Engine() string {
+	return utils.GetValue(config.GetConfig().GetString(setting("engine")), MySQLEngine).(string)
+}
+
+// ConnectionString - returns the connection string of the configured database
+func ConnectionString() (string, error) {
+	switch Engine() {
+	case MySQLEngine:
+		return MySQLConnectionString(), nil
+	case PostgresEngine:
+		return PostgresConnectionString(), nil
+	}
+	return "", errors.Errorf("unsupported database engine %s", Engine())
+}
+
+// MySQLConnectionString - returns the connection string of the configured mysql database
+// connect_timeout bounds dialing, query_timeout bounds reading and writing each query
+func MySQLConnectionString() string {
 	c := config.GetConfig()
+	// matched rows are reported as affected, so updates writing an unchanged charge are not taken for missing rows
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&clientFoundRows=true",
+		c.GetString(setting("username")), c.GetString(setting("password")),
+		c.GetString(setting("host")), c.GetString(setting("port")),
+		c.GetString(setting("name")))
+	if timeout := c.GetInt(setting("connect_timeout")); timeout > 0 {
+		dsn += fmt.Sprintf("&timeout=%ds", timeout)
+	}
+	if timeout := c.GetInt(setting("query_timeout")); timeout > 0 {
+		dsn += fmt.Sprintf("&readTimeout=%ds&writeTimeout=%ds", timeout, timeout)
+	}
+	return dsn
+}
 
-	// create aurora-mysql connection for data-team's datastore
-	mysqlConnectionString := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-		c.GetString("mysql.db_username"), c.GetString("mysql.db_password"),
-		c.GetString("mysql.db_host"), c.GetString("mysql.db_port"),
-		c.GetString("mysql.db_name"))
+// PostgresConnectionString - returns the connection string of the configured postgresql database
+// connect_timeout bounds connecting, query_timeout becomes the session's statement_timeout
+func PostgresConnectionString() string {
+	c := config.GetConfig()
+	// passwords are quoted, so they may hold spaces
+	password := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(c.GetString(setting("password")))
+	dsn := fmt.Sprintf("host=%s port=%s user=%s password='%s' dbname=%s sslmode=%s",
+		c.GetString(setting("host")), c.GetString(setting("port")), c.GetString(setting("username")), password,
+		c.GetString(setting("name")), utils.GetValue(c.GetString(setting("sslmode")), "disable").(string))
+	if timeout := c.GetInt(setting("connect_timeout")); timeout > 0 {
+		dsn += fmt.Sprintf(" connect_timeout=%d", timeout)
+	}
+	if timeout := c.GetInt(setting("query_timeout")); timeout > 0 {
+		dsn += fmt.Sprintf(" statement_timeout=%d", timeout*1000)
+	}
+	return dsn
+}
 
-	mysqlDB, err = gorm.Open(c.GetString("mysql.db_type"), mysqlConnectionString)
-	if err != nil {
-		panic("Can't connect to mysql database, check config!" + err.Error())
+// HealthChecker - pings the database periodically, logging when it becomes unreachable and when it recovers
+type HealthChecker struct {
+	Interval  time.Duration
+	db        *gorm.DB
+	lock      sync.RWMutex
+	healthy   bool
+	closeChan chan bool
+	wg        sync.WaitGroup
+}
+
+// NewHealthChecker - returns a health checker pinging the database every interval, the default interval when it is not positive
+func NewHealthChecker(db *gorm.DB, interval time.Duration) *HealthChecker {
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	return &HealthChecker{Interval: interval, db: db, healthy: true}
+}
+
+// Start - pings the database until the checker is closed
+func (h *HealthChecker) Start() {
+	h.closeChan = make(chan bool)
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		interval := h.Interval
+		if interval <= 0 {
+			interval = defaultHealthInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.closeChan:
+				return
+			case <-ticker.C:
+				h.Ping()
+			}
+		}
+	}()
+}
+
+// Close - stops the pings
+func (h *HealthChecker) Close() {
+	close(h.closeChan)
+	h.wg.Wait()
+}
+
+// Ping - pings the database once and returns its error
+func (h *HealthChecker) Ping() error {
+	err := h.db.DB().Ping()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err != nil && h.healthy {
+		logger.Log.WithError(err).Error("Database health check failed")
+	} else if err == nil && !h.healthy {
+		logger.Log.Info("Database health check recovered")
 	}
-	mysqlConnLifeTime := c.GetInt("mysql.conn_life_time")
-	mysqlDB.DB().SetConnMaxLifetime(time.Minute * time.Duration(mysqlConnLifeTime))
+	h.healthy = err == nil
+	return err
+}
+
+// Healthy - returns false while the last ping failed
+func (h *HealthChecker) Healthy() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.healthy
 }
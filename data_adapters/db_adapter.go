@@ -1,18 +1,89 @@
 package dataadapters
 
 import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
 	"go-worker/logger"
 	"go-worker/models"
+	"go-worker/money"
 )
 
-// UpdateCallInfo - updates the billing cost for a call
+// ErrCallNotFound - no call info row exists for the call yet, e.g. when the billing event
+// arrives before the call is inserted
+var ErrCallNotFound = errors.New("call info not found")
+
+// UpdateCallInfo - updates the billing cost for a call, provisional charges are flagged as such
+// and only recorded for calls without a charge, so a call is rated once and never loses a billed charge
+// with the outbox enabled a call billed event is written to the outbox in the same transaction,
+// provisional charges are not billed yet and get no event
 func UpdateCallInfo(balanceResponse models.BalanceResponse) error {
 
-	query := "UPDATE call_info SET billing_cost = ? WHERE call_id = ?;"
-	err := mysqlDB.Exec(query, balanceResponse.ChargeAmount, balanceResponse.CallID).Error
-	if err != nil {
-		logger.Log.WithError(err).WithField("call_id: ", balanceResponse.CallID).Error("Unable to update billing info")
+	columns := "billing_cost = ?, billing_currency = ?"
+	args := []interface{}{balanceResponse.ChargeAmount.String(), chargeCurrency(balanceResponse)}
+	// converted charges are billed in the reporting currency and keep the original charge and rate
+	if conversion := balanceResponse.Conversion; conversion != nil {
+		columns += ", original_cost = ?, original_currency = ?, exchange_rate = ?"
+		args = []interface{}{conversion.Amount.String(), conversion.Currency, conversion.OriginalAmount.String(),
+			conversion.OriginalCurrency, conversion.Rate.String()}
+	}
+	query := "UPDATE call_info SET " + columns + ", billing_provisional = FALSE WHERE call_id = ?;"
+	args = append(args, balanceResponse.CallID)
+	// a provisional charge matches no row when the call is charged already or not inserted yet,
+	// either way its message stays queued for the balance api
+	if balanceResponse.Provisional {
+		query = "UPDATE call_info SET " + columns + ", billing_provisional = TRUE WHERE call_id = ? AND billing_cost IS NULL;"
+		err := billingDB.Exec(query, args...).Error
+		if err != nil {
+			logger.Log.WithError(err).WithField("call_id: ", balanceResponse.CallID).Error("Unable to update billing info")
+		}
+		return err
+	}
+	if !outboxEnabled {
+		err := updateRow(billingDB, query, args)
+		if err != nil && err != ErrCallNotFound {
+			logger.Log.WithError(err).WithField("call_id: ", balanceResponse.CallID).Error("Unable to update billing info")
+		}
+		return err
 	}
 
+	// the call billed event is only written when the update commits
+	tx := billingDB.Begin()
+	err := updateRow(tx, query, args)
+	if err == nil {
+		err = insertOutboxEvent(tx, balanceResponse, time.Now())
+	}
+	if err != nil {
+		tx.Rollback()
+		if err != ErrCallNotFound {
+			logger.Log.WithError(err).WithField("call_id: ", balanceResponse.CallID).Error("Unable to update billing info")
+		}
+		return err
+	}
+	if err = tx.Commit().Error; err != nil {
+		logger.Log.WithError(err).WithField("call_id: ", balanceResponse.CallID).Error("Unable to commit billing info")
+	}
 	return err
 }
+
+// chargeCurrency - returns the currency of an unconverted charge, the default currency when it names none
+func chargeCurrency(balanceResponse models.BalanceResponse) string {
+	if balanceResponse.Currency == "" {
+		return money.DefaultCurrency
+	}
+	return balanceResponse.Currency
+}
+
+// updateRow - runs an update of a single call info row, ErrCallNotFound is returned when no row matched
+func updateRow(db *gorm.DB, query string, args []interface{}) error {
+	result := db.Exec(query, args...)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrCallNotFound
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 
 	"go-worker/logger"
 	"go-worker/models"
+	"go-worker/money"
 )
 
 // TestPositiveUpdation - test a successful db update
@@ -22,12 +23,12 @@ func TestPositiveUpdation(t *testing.T) {
 	if err != nil {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
-	mysqlDB, err = gorm.Open("mysql", db)
+	billingDB, err = gorm.Open("mysql", db)
 	defer db.Close()
 
 	// mock update query
-	mock.ExpectExec("UPDATE call_info SET billing_cost = ?").
-		WithArgs("1.2", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+	mock.ExpectExec(`UPDATE call_info SET billing_cost = \?, billing_currency = \?, billing_provisional = FALSE WHERE call_id = \?`).
+		WithArgs("1.2", "USD", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	// call data adapter update function
@@ -54,12 +55,12 @@ func TestNegativeUpdation(t *testing.T) {
 	if err != nil {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
-	mysqlDB, err = gorm.Open("mysql", db)
+	billingDB, err = gorm.Open("mysql", db)
 	defer db.Close()
 
 	// mock update query
 	mock.ExpectExec("UPDATE call_info SET billing_cost = ?").
-		WithArgs("1.1", "d12b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WithArgs("1.1", "USD", "d12b0dda-6566-402a-8f8c-0657e5b87eeb").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	// call data adapter update function
@@ -68,10 +69,97 @@ func TestNegativeUpdation(t *testing.T) {
 	check.Contains(err.Error(), "ExecQuery")
 }
 
+// TestPositiveProvisionalUpdation - test a provisional charge is flagged and only written to calls without a charge
+func TestPositiveProvisionalUpdation(t *testing.T) {
+
+	// Init logger
+	logger.Init()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	// mock update query
+	mock.ExpectExec(`UPDATE call_info SET billing_cost = \?, billing_currency = \?, billing_provisional = TRUE WHERE call_id = \? AND billing_cost IS NULL`).
+		WithArgs("1.2", "EUR", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// call data adapter update function
+	balanceResponse := getBalanceResponse()
+	balanceResponse.Currency = "EUR"
+	balanceResponse.Provisional = true
+	if err = UpdateCallInfo(balanceResponse); err != nil {
+		t.Errorf("Error was not expected while updating cost: %s", err)
+	}
+
+	// check mock result
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPositiveUpdationConverted - test converted charges store the original charge and rate
+func TestPositiveUpdationConverted(t *testing.T) {
+
+	check := assert.New(t)
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	// mock update query
+	mock.ExpectExec("UPDATE call_info SET billing_cost = \\?, billing_currency = \\?, original_cost = \\?").
+		WithArgs("1.3200", "USD", "1.2", "EUR", "1.1", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// call data adapter update function
+	balanceResponse := getBalanceResponse()
+	balanceResponse.Currency = "EUR"
+	balanceResponse.Conversion = &models.Conversion{
+		OriginalAmount:   balanceResponse.ChargeAmount,
+		OriginalCurrency: "EUR",
+		Amount:           money.MustParse("1.3200"),
+		Currency:         "USD",
+		Rate:             money.MustParse("1.1"),
+	}
+	check.NoError(UpdateCallInfo(balanceResponse))
+	check.NoError(mock.ExpectationsWereMet())
+}
+
+// TestPositiveUpdationPostgres - test updates use postgresql placeholders
+func TestPositiveUpdationPostgres(t *testing.T) {
+
+	check := assert.New(t)
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("postgres", db)
+	defer db.Close()
+
+	// mock update query
+	mock.ExpectExec("UPDATE call_info SET billing_cost = \\$1, billing_currency = \\$2, billing_provisional = FALSE WHERE call_id = \\$3").
+		WithArgs("1.2", "USD", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	check.NoError(UpdateCallInfo(getBalanceResponse()))
+	check.NoError(mock.ExpectationsWereMet())
+}
+
 // getBalanceResponse - returns balance response information
 func getBalanceResponse() (balanceResponse models.BalanceResponse) {
 	balanceResponse = models.BalanceResponse{
-		ChargeAmount:       "1.2",
+		ChargeAmount:       money.MustParse("1.2"),
 		CallID:             "e21b0dda-6566-402a-8f8c-0657e5b87eeb",
 		TotalConsumedUnits: 2,
 	}
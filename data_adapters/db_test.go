@@ -0,0 +1,133 @@
+package dataadapters
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/config"
+	"go-worker/logger"
+)
+
+// TestPositiveConnect - test failed connection attempts are retried
+func TestPositiveConnect(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	attempts := 0
+	db, err := connect(func() (*gorm.DB, error) {
+		if attempts++; attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return &gorm.DB{}, nil
+	}, 5, time.Millisecond)
+	check.NoError(err)
+	check.NotNil(db)
+	check.Equal(3, attempts)
+}
+
+// TestNegativeConnect - test the last error is returned once the retries are used up
+func TestNegativeConnect(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	attempts := 0
+	_, err := connect(func() (*gorm.DB, error) {
+		attempts++
+		return nil, errors.New("connection refused")
+	}, 3, time.Millisecond)
+	check.EqualError(err, "connection refused")
+	check.Equal(3, attempts)
+}
+
+// TestPositiveHealthChecker - test failed pings mark the database unhealthy until one succeeds
+func TestPositiveHealthChecker(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	mock.ExpectPing()
+	gormDB, err := gorm.Open("mysql", db)
+	check.NoError(err)
+	defer db.Close()
+
+	checker := NewHealthChecker(gormDB, time.Minute)
+	mock.ExpectPing().WillReturnError(errors.New("connection reset"))
+	check.Error(checker.Ping())
+	check.False(checker.Healthy())
+	mock.ExpectPing()
+	check.NoError(checker.Ping())
+	check.True(checker.Healthy())
+	check.NoError(mock.ExpectationsWereMet())
+}
+
+// TestNegativeHealthCheckerInterval - test intervals which are not positive fall back to the default
+func TestNegativeHealthCheckerInterval(t *testing.T) {
+
+	check := assert.New(t)
+	checker := NewHealthChecker(nil, -time.Second)
+	check.Equal(defaultHealthInterval, checker.Interval)
+
+	// an interval cleared after construction does not stop the checker from starting
+	checker.Interval = 0
+	check.NotPanics(func() {
+		checker.Start()
+		checker.Close()
+	})
+}
+
+// TestPositiveConnectionString - test connection and query timeouts are part of the connection string
+// of configs with a mysql section
+func TestPositiveConnectionString(t *testing.T) {
+
+	check := assert.New(t)
+	v := viper.New()
+	v.Set("mysql.db_username", "root")
+	v.Set("mysql.db_host", "localhost")
+	v.Set("mysql.db_port", 3306)
+	v.Set("mysql.db_name", "dpv_test")
+	v.Set("mysql.connect_timeout", 2)
+	v.Set("mysql.query_timeout", 10)
+	config.SetConfig(v)
+
+	check.Equal("root:@tcp(localhost:3306)/dpv_test?parseTime=true&clientFoundRows=true&timeout=2s&readTimeout=10s&writeTimeout=10s",
+		MySQLConnectionString())
+}
+
+// TestPositivePostgresConnectionString - test the database section configures postgresql
+func TestPositivePostgresConnectionString(t *testing.T) {
+
+	check := assert.New(t)
+	v := viper.New()
+	v.Set("database.engine", "postgres")
+	v.Set("database.username", "billing")
+	v.Set("database.password", "it's secret")
+	v.Set("database.host", "localhost")
+	v.Set("database.port", 5432)
+	v.Set("database.name", "dpv_test")
+	v.Set("database.connect_timeout", 2)
+	v.Set("database.query_timeout", 10)
+	v.Set("mysql.db_host", "ignored")
+	config.SetConfig(v)
+
+	dsn, err := ConnectionString()
+	check.NoError(err)
+	check.Equal(`host=localhost port=5432 user=billing password='it\'s secret' dbname=dpv_test sslmode=disable `+
+		`connect_timeout=2 statement_timeout=10000`, dsn)
+
+	v.Set("database.engine", "oracle")
+	_, err = ConnectionString()
+	check.EqualError(err, "unsupported database engine oracle")
+}
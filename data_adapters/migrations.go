@@ -0,0 +1,286 @@
+package dataadapters
+
+import (
+	"embed"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"go-worker/logger"
+)
+
+// MigrationsTable - table recording the applied schema migrations
+const MigrationsTable = "schema_migrations"
+
+// migrationFiles - sql migrations of each engine, named <version>_<name>.up.sql and <version>_<name>.down.sql
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// migrationFilePattern - names of migration files
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration - holds a versioned schema change and the statements reverting it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus - holds a migration and when it was applied, AppliedAt is zero for pending migrations
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// Applied - returns true if the migration was applied
+func (s MigrationStatus) Applied() bool {
+	return !s.AppliedAt.IsZero()
+}
+
+// Migrations - returns the embedded migrations of an engine ordered by version
+func Migrations(engine string) ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir(path.Join("migrations", engine))
+	if err != nil {
+		return nil, errors.Errorf("no migrations for database engine %s", engine)
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, errors.Errorf("invalid migration file name %s", entry.Name())
+		}
+		data, err := migrationFiles.ReadFile(path.Join("migrations", engine, entry.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read migration %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, errors.Errorf("migration version %d is used by %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+	var migrations []Migration
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, errors.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// MigrationStatuses - returns the migrations of the database engine along with when each was applied,
+// without changing the database
+func MigrationStatuses() ([]MigrationStatus, error) {
+	migrations, err := Migrations(billingDB.Dialect().GetName())
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(billingDB)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		status := MigrationStatus{Migration: migration}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = time.Unix(0, appliedAt)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// MigrateUp - applies the pending migrations in order, each in its own transaction,
+// and returns the applied ones
+func MigrateUp() ([]Migration, error) {
+	if err := createMigrationsTable(billingDB); err != nil {
+		return nil, err
+	}
+	statuses, err := MigrationStatuses()
+	if err != nil {
+		return nil, err
+	}
+	var migrated []Migration
+	for _, status := range statuses {
+		if status.Applied() {
+			continue
+		}
+		err = migrate(status.Migration, status.Up, "INSERT INTO "+MigrationsTable+" (version, name, applied_at) VALUES (?, ?, ?);",
+			status.Version, status.Name, time.Now().UnixNano())
+		if err != nil {
+			return migrated, err
+		}
+		migrated = append(migrated, status.Migration)
+	}
+	return migrated, nil
+}
+
+// MigrateDown - reverts the latest applied migrations, at most steps of them, and returns the reverted ones
+func MigrateDown(steps int) ([]Migration, error) {
+	statuses, err := MigrationStatuses()
+	if err != nil {
+		return nil, err
+	}
+	var reverted []Migration
+	for i := len(statuses) - 1; i >= 0 && len(reverted) < steps; i-- {
+		if !statuses[i].Applied() {
+			continue
+		}
+		err = migrate(statuses[i].Migration, statuses[i].Down, "DELETE FROM "+MigrationsTable+" WHERE version = ?;",
+			statuses[i].Version)
+		if err != nil {
+			return reverted, err
+		}
+		reverted = append(reverted, statuses[i].Migration)
+	}
+	return reverted, nil
+}
+
+// MarkMigrated - records the migrations up to a version as applied without running them,
+// for databases whose schema was created before migrations were tracked
+func MarkMigrated(version int) ([]Migration, error) {
+	if err := createMigrationsTable(billingDB); err != nil {
+		return nil, err
+	}
+	statuses, err := MigrationStatuses()
+	if err != nil {
+		return nil, err
+	}
+	var marked []Migration
+	for _, status := range statuses {
+		if status.Applied() || status.Version > version {
+			continue
+		}
+		err = billingDB.Exec("INSERT INTO "+MigrationsTable+" (version, name, applied_at) VALUES (?, ?, ?);",
+			status.Version, status.Name, time.Now().UnixNano()).Error
+		if err != nil {
+			return marked, errors.Wrapf(err, "unable to mark migration %d_%s", status.Version, status.Name)
+		}
+		marked = append(marked, status.Migration)
+	}
+	return marked, nil
+}
+
+// CheckSchema - returns an error if migrations of the worker are not applied to the database,
+// the database is only read, so the check can run with a read only user
+func CheckSchema() error {
+	statuses, err := MigrationStatuses()
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for _, status := range statuses {
+		if !status.Applied() {
+			pending = append(pending, strconv.Itoa(status.Version)+"_"+status.Name)
+		}
+	}
+	if len(pending) > 0 {
+		return errors.Errorf("database schema is outdated, pending migrations %s, run migrate up", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// migrate - runs the statements of a migration and records it in one transaction
+// mysql commits schema changes implicitly, so a failed mysql migration may be partly applied
+func migrate(migration Migration, statements, record string, args ...interface{}) error {
+	logger.Log.WithField("version", migration.Version).Infof("Running migration %s", migration.Name)
+	tx := billingDB.Begin()
+	for _, statement := range splitStatements(statements) {
+		if err := tx.Exec(statement).Error; err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %d_%s failed", migration.Version, migration.Name)
+		}
+	}
+	if err := tx.Exec(record, args...).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "unable to record migration %d_%s", migration.Version, migration.Name)
+	}
+	return errors.Wrapf(tx.Commit().Error, "unable to commit migration %d_%s", migration.Version, migration.Name)
+}
+
+// createMigrationsTable - creates the migrations table if it does not exist
+func createMigrationsTable(db *gorm.DB) error {
+	err := db.Exec("CREATE TABLE IF NOT EXISTS " + MigrationsTable +
+		" (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at BIGINT NOT NULL);").Error
+	return errors.Wrap(err, "unable to create migrations table")
+}
+
+// hasMigrationsTable - returns true if the migrations table exists in the current database or schema
+func hasMigrationsTable(db *gorm.DB) (bool, error) {
+	current := "DATABASE()"
+	if db.Dialect().GetName() == PostgresEngine {
+		current = "CURRENT_SCHEMA()"
+	}
+	var count int
+	err := db.Raw("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = "+current+" AND table_name = ?;",
+		MigrationsTable).Row().Scan(&count)
+	return count > 0, errors.Wrap(err, "unable to look up migrations table")
+}
+
+// appliedMigrations - returns the applied versions and when they were applied,
+// a database without the migrations table has none applied
+func appliedMigrations(db *gorm.DB) (map[int]int64, error) {
+	exists, err := hasMigrationsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return map[int]int64{}, nil
+	}
+	rows, err := db.Raw("SELECT version, applied_at FROM " + MigrationsTable + ";").Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read migrations table")
+	}
+	defer rows.Close()
+	applied := map[int]int64{}
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, errors.Wrap(err, "unable to read migrations table")
+		}
+		applied[version] = appliedAt
+	}
+	return applied, errors.Wrap(rows.Err(), "unable to read migrations table")
+}
+
+// splitStatements - splits a migration into its statements, which end with a semicolon at the end of a line,
+// comment lines are dropped
+func splitStatements(migration string) []string {
+	var statements []string
+	var statement []string
+	for _, line := range strings.Split(migration, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		statement = append(statement, line)
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.Join(statement, "\n"))
+			statement = nil
+		}
+	}
+	if len(statement) > 0 {
+		statements = append(statements, strings.Join(statement, "\n"))
+	}
+	return statements
+}
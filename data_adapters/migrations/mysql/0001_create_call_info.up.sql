@@ -0,0 +1,5 @@
+-- calls are inserted by the call pipeline, the worker records their charge
+CREATE TABLE IF NOT EXISTS call_info (
+    call_id VARCHAR(64) NOT NULL PRIMARY KEY,
+    billing_cost DECIMAL(20, 8) NULL
+);
@@ -0,0 +1,5 @@
+ALTER TABLE call_info
+    DROP COLUMN billing_currency,
+    DROP COLUMN original_cost,
+    DROP COLUMN original_currency,
+    DROP COLUMN exchange_rate;
@@ -0,0 +1,6 @@
+-- converted charges keep the original charge and the rate used
+ALTER TABLE call_info
+    ADD COLUMN billing_currency CHAR(3) NULL,
+    ADD COLUMN original_cost DECIMAL(20, 8) NULL,
+    ADD COLUMN original_currency CHAR(3) NULL,
+    ADD COLUMN exchange_rate DECIMAL(20, 8) NULL;
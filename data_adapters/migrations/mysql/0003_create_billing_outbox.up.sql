@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS billing_outbox (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    event_type VARCHAR(64) NOT NULL,
+    call_id VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL,
+    next_attempt_at BIGINT NOT NULL,
+    enqueued_at BIGINT NOT NULL,
+    INDEX idx_billing_outbox_next_attempt_at (next_attempt_at)
+);
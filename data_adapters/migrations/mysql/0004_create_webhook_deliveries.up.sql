@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    delivery_id VARCHAR(36) NOT NULL,
+    url VARCHAR(512) NOT NULL,
+    call_id VARCHAR(64) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    attempt INT NOT NULL,
+    status_code INT NOT NULL,
+    error TEXT,
+    delivered BOOLEAN NOT NULL,
+    attempt_at BIGINT NOT NULL,
+    INDEX idx_webhook_deliveries_delivery_id (delivery_id),
+    INDEX idx_webhook_deliveries_call_id (call_id)
+);
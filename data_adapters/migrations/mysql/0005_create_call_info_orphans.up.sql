@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS call_info_orphans (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    call_id VARCHAR(64) NOT NULL,
+    balance_response TEXT NOT NULL,
+    parked_at BIGINT NOT NULL,
+    INDEX idx_call_info_orphans_call_id (call_id)
+);
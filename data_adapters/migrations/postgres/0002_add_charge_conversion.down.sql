@@ -0,0 +1,5 @@
+ALTER TABLE call_info
+    DROP COLUMN IF EXISTS billing_currency,
+    DROP COLUMN IF EXISTS original_cost,
+    DROP COLUMN IF EXISTS original_currency,
+    DROP COLUMN IF EXISTS exchange_rate;
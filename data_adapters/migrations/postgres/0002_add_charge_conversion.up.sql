@@ -0,0 +1,6 @@
+-- converted charges keep the original charge and the rate used
+ALTER TABLE call_info
+    ADD COLUMN IF NOT EXISTS billing_currency CHAR(3) NULL,
+    ADD COLUMN IF NOT EXISTS original_cost NUMERIC(20, 8) NULL,
+    ADD COLUMN IF NOT EXISTS original_currency CHAR(3) NULL,
+    ADD COLUMN IF NOT EXISTS exchange_rate NUMERIC(20, 8) NULL;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS billing_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR(64) NOT NULL,
+    call_id VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    next_attempt_at BIGINT NOT NULL,
+    enqueued_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_billing_outbox_next_attempt_at ON billing_outbox (next_attempt_at);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id VARCHAR(36) NOT NULL,
+    url VARCHAR(512) NOT NULL,
+    call_id VARCHAR(64) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER NOT NULL,
+    error TEXT,
+    delivered BOOLEAN NOT NULL,
+    attempt_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_delivery_id ON webhook_deliveries (delivery_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_call_id ON webhook_deliveries (call_id);
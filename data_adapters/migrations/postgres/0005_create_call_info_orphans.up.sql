@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS call_info_orphans (
+    id BIGSERIAL PRIMARY KEY,
+    call_id VARCHAR(64) NOT NULL,
+    balance_response TEXT NOT NULL,
+    parked_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_call_info_orphans_call_id ON call_info_orphans (call_id);
@@ -0,0 +1,2 @@
+ALTER TABLE call_info
+    DROP COLUMN IF EXISTS billing_provisional;
@@ -0,0 +1,3 @@
+-- charges rated locally are marked until the balance service bills the call
+ALTER TABLE call_info
+    ADD COLUMN IF NOT EXISTS billing_provisional BOOLEAN NOT NULL DEFAULT FALSE;
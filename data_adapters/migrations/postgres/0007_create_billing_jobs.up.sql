@@ -0,0 +1,13 @@
+-- job table of the sql queue, a queue on another table needs a table with the same columns
+CREATE TABLE IF NOT EXISTS billing_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    body TEXT NOT NULL,
+    attributes TEXT NULL,
+    status VARCHAR(16) NOT NULL,
+    attempts INTEGER NOT NULL,
+    lease_token VARCHAR(36) NULL,
+    visible_at BIGINT NOT NULL,
+    sent_at BIGINT NOT NULL,
+    first_received_at BIGINT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_billing_jobs_claim ON billing_jobs (status, visible_at);
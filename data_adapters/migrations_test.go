@@ -0,0 +1,134 @@
+package dataadapters
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/logger"
+)
+
+// TestPositiveMigrations - test both engines embed the same migrations
+func TestPositiveMigrations(t *testing.T) {
+
+	check := assert.New(t)
+	mysqlMigrations, err := Migrations(MySQLEngine)
+	check.NoError(err)
+	postgresMigrations, err := Migrations(PostgresEngine)
+	check.NoError(err)
+	check.Len(postgresMigrations, len(mysqlMigrations))
+	for i, migration := range mysqlMigrations {
+		check.Equal(i+1, migration.Version)
+		check.Equal(migration.Name, postgresMigrations[i].Name)
+	}
+	check.Equal("create_call_info", mysqlMigrations[0].Name)
+
+	// statements end with a semicolon at the end of a line
+	check.Len(splitStatements(postgresMigrations[2].Up), 2)
+	check.Len(splitStatements(mysqlMigrations[2].Up), 1)
+
+	_, err = Migrations("oracle")
+	check.EqualError(err, "no migrations for database engine oracle")
+}
+
+// TestPositiveMigrateUp - test pending migrations are applied and recorded
+func TestPositiveMigrateUp(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	// mock the migrations table with the first three migrations applied
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM information_schema.tables WHERE table_schema = DATABASE\\(\\)").
+		WithArgs("schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, 1).AddRow(2, 1).AddRow(3, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS webhook_deliveries").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(4, "create_webhook_deliveries", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS call_info_orphans").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(5, "create_call_info_orphans", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("ALTER TABLE call_info").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(6, "add_billing_provisional", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS billing_jobs").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(7, "create_billing_jobs", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	migrated, err := MigrateUp()
+	check.NoError(err)
+	check.Len(migrated, 4)
+	check.NoError(mock.ExpectationsWereMet())
+}
+
+// TestNegativeCheckSchema - test an outdated schema is reported and migrations are reverted latest first
+func TestNegativeCheckSchema(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("postgres", db)
+	defer db.Close()
+
+	// a database without the migrations table has every migration pending and is not changed by the check
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM information_schema.tables WHERE table_schema = CURRENT_SCHEMA\\(\\)").
+		WithArgs("schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	check.EqualError(CheckSchema(), "database schema is outdated, pending migrations 1_create_call_info, "+
+		"2_add_charge_conversion, 3_create_billing_outbox, 4_create_webhook_deliveries, 5_create_call_info_orphans, "+
+		"6_add_billing_provisional, 7_create_billing_jobs, run migrate up")
+
+	// mock the migrations table with the first two migrations applied
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM information_schema.tables").
+			WithArgs("schema_migrations").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+			WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, 1).AddRow(2, 1))
+	}
+	check.EqualError(CheckSchema(), "database schema is outdated, pending migrations 3_create_billing_outbox, "+
+		"4_create_webhook_deliveries, 5_create_call_info_orphans, "+
+		"6_add_billing_provisional, 7_create_billing_jobs, run migrate up")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("ALTER TABLE call_info").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations WHERE version = \\$1").
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	reverted, err := MigrateDown(1)
+	check.NoError(err)
+	check.Len(reverted, 1)
+	check.Equal("add_charge_conversion", reverted[0].Name)
+	check.NoError(mock.ExpectationsWereMet())
+}
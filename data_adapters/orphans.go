@@ -0,0 +1,143 @@
+package dataadapters
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go-worker/logger"
+	"go-worker/models"
+)
+
+const (
+	// OrphansTable - table parking charges of calls whose call info row did not exist when they were billed
+	OrphansTable = "call_info_orphans"
+	// defaultOrphanWindow - time a parked charge is retried for before it is left for apply-orphans
+	defaultOrphanWindow = 15 * time.Minute
+	// defaultOrphanRetryDelay - time between retries of parked charges
+	defaultOrphanRetryDelay = time.Minute
+)
+
+// callInfoOrphan - holds a single row of the orphan table
+type callInfoOrphan struct {
+	ID              int64  `gorm:"primary_key"`
+	CallID          string `gorm:"size:64;not null;index"`
+	BalanceResponse string `gorm:"type:text;not null"`
+	ParkedAt        int64  `gorm:"not null"`
+}
+
+// TableName - returns the orphan table name
+func (callInfoOrphan) TableName() string {
+	return OrphansTable
+}
+
+// parkedResponse - holds a parked balance response along with its conversion, which is not part of its json
+type parkedResponse struct {
+	models.BalanceResponse
+	Conversion *models.Conversion `json:"conversion,omitempty"`
+}
+
+// ParkOrphan - keeps the balance response of a call without a call info row, so it can be applied later
+func ParkOrphan(balanceResponse models.BalanceResponse) error {
+	data, err := json.Marshal(parkedResponse{BalanceResponse: balanceResponse, Conversion: balanceResponse.Conversion})
+	if err != nil {
+		return errors.Wrap(err, "unable to encode balance response")
+	}
+	query := "INSERT INTO " + OrphansTable + " (call_id, balance_response, parked_at) VALUES (?, ?, ?);"
+	err = billingDB.Exec(query, balanceResponse.CallID, string(data), time.Now().UnixNano()).Error
+	return errors.Wrap(err, "unable to park balance response")
+}
+
+// ApplyOrphans - applies parked balance responses whose call info row exists by now and deletes them,
+// returns the number applied and the number still parked
+func ApplyOrphans() (int, int, error) {
+	return applyOrphans(0)
+}
+
+// applyOrphans - applies the balance responses parked after parkedAfter, in unix nanoseconds
+func applyOrphans(parkedAfter int64) (int, int, error) {
+	var orphans []callInfoOrphan
+	if err := billingDB.Where("parked_at > ?", parkedAfter).Order("id").Find(&orphans).Error; err != nil {
+		return 0, 0, errors.Wrap(err, "unable to read orphan table")
+	}
+	applied := 0
+	for _, orphan := range orphans {
+		var parked parkedResponse
+		if err := json.Unmarshal([]byte(orphan.BalanceResponse), &parked); err != nil {
+			logger.Log.WithError(err).WithField("call_id", orphan.CallID).Error("Unable to decode parked balance response")
+			continue
+		}
+		balanceResponse := parked.BalanceResponse
+		balanceResponse.Conversion = parked.Conversion
+		err := UpdateCallInfo(balanceResponse)
+		if err == ErrCallNotFound {
+			continue
+		}
+		if err != nil {
+			return applied, len(orphans) - applied, err
+		}
+		if err = billingDB.Exec("DELETE FROM "+OrphansTable+" WHERE id = ?;", orphan.ID).Error; err != nil {
+			return applied, len(orphans) - applied, errors.Wrap(err, "unable to delete applied orphan")
+		}
+		applied++
+	}
+	return applied, len(orphans) - applied, nil
+}
+
+// OrphanRetrier - retries parked charges periodically, so a call info row inserted shortly after its charge
+// gets the charge without the message being billed again, charges parked longer than the window are left for apply-orphans
+type OrphanRetrier struct {
+	Window    time.Duration
+	Interval  time.Duration
+	closeChan chan bool
+	wg        sync.WaitGroup
+}
+
+// NewOrphanRetrier - returns a retrier of the charges parked within window, retried every interval
+func NewOrphanRetrier(window, interval time.Duration) *OrphanRetrier {
+	if window <= 0 {
+		window = defaultOrphanWindow
+	}
+	if interval <= 0 {
+		interval = defaultOrphanRetryDelay
+	}
+	return &OrphanRetrier{Window: window, Interval: interval}
+}
+
+// Start - retries parked charges until the retrier is closed
+func (r *OrphanRetrier) Start() {
+	r.closeChan = make(chan bool)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.closeChan:
+				return
+			case <-ticker.C:
+				applied, _, err := r.RetryOnce(time.Now())
+				if err != nil {
+					logger.Log.WithError(err).Error("Unable to retry parked charges")
+				} else if applied > 0 {
+					logger.Log.Infof("Applied %d parked charges", applied)
+				}
+			}
+		}
+	}()
+}
+
+// Close - stops the retries
+func (r *OrphanRetrier) Close() {
+	close(r.closeChan)
+	r.wg.Wait()
+}
+
+// RetryOnce - applies the charges parked within the window before now, returns the number applied
+// and the number of those still parked
+func (r *OrphanRetrier) RetryOnce(now time.Time) (int, int, error) {
+	return applyOrphans(now.Add(-r.Window).UnixNano())
+}
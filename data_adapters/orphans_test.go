@@ -0,0 +1,79 @@
+package dataadapters
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/logger"
+)
+
+// TestNegativeUpdationMissingCall - test updates matching no call info row report the call as not found
+func TestNegativeUpdationMissingCall(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	// mock update query
+	mock.ExpectExec("UPDATE call_info SET billing_cost = ?").
+		WithArgs("1.2", "USD", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	check.Equal(ErrCallNotFound, UpdateCallInfo(getBalanceResponse()))
+	check.NoError(mock.ExpectationsWereMet())
+}
+
+// TestPositiveApplyOrphans - test parked charges are applied once their call info row exists
+func TestPositiveApplyOrphans(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	// mock parking a charge
+	balanceResponse := getBalanceResponse()
+	mock.ExpectExec("INSERT INTO call_info_orphans").
+		WithArgs("e21b0dda-6566-402a-8f8c-0657e5b87eeb", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	check.NoError(ParkOrphan(balanceResponse))
+
+	// mock applying two parked charges, the second call is still missing
+	mock.ExpectQuery("SELECT \\* FROM `call_info_orphans`").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "call_id", "balance_response", "parked_at"}).
+			AddRow(1, "e21b0dda-6566-402a-8f8c-0657e5b87eeb",
+				`{"call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "charge_amount": "1.2", "currency": "EUR",
+				"conversion": {"OriginalAmount": "1.2", "OriginalCurrency": "EUR", "Amount": "1.3200", "Currency": "USD", "Rate": "1.1"}}`, 1).
+			AddRow(2, "d12b0dda-6566-402a-8f8c-0657e5b87eeb", `{"call_id": "d12b0dda-6566-402a-8f8c-0657e5b87eeb", "charge_amount": "2"}`, 1))
+	mock.ExpectExec("UPDATE call_info SET billing_cost = \\?, billing_currency = \\?").
+		WithArgs("1.3200", "USD", "1.2", "EUR", "1.1", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM call_info_orphans").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE call_info SET billing_cost = ?").
+		WithArgs("2", "USD", "d12b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, remaining, err := ApplyOrphans()
+	check.NoError(err)
+	check.Equal(1, applied)
+	check.Equal(1, remaining)
+	check.NoError(mock.ExpectationsWereMet())
+}
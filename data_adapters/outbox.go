@@ -0,0 +1,139 @@
+package dataadapters
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"go-worker/models"
+	"go-worker/money"
+)
+
+const (
+	// OutboxTable - table holding events waiting to be published
+	OutboxTable = "billing_outbox"
+	// CallBilledEventType - type of the events announcing a call was billed
+	CallBilledEventType = "gobilling.call_billed"
+)
+
+// outboxEnabled - whether call info updates also write a call billed event to the outbox
+var outboxEnabled bool
+
+// OutboxEvent - holds an event written in the same transaction as the change it announces,
+// the outbox relay publishes it and deletes it once published
+type OutboxEvent struct {
+	ID            int64  `gorm:"primary_key"`
+	EventType     string `gorm:"size:64;not null"`
+	CallID        string `gorm:"size:64;not null"`
+	Payload       string `gorm:"type:text;not null"`
+	Attempts      int    `gorm:"not null"`
+	NextAttemptAt int64  `gorm:"not null;index"`
+	EnqueuedAt    int64  `gorm:"not null"`
+}
+
+// TableName - returns the outbox table name
+func (OutboxEvent) TableName() string {
+	return OutboxTable
+}
+
+// CallBilledEvent - announces the charge recorded for a call,
+// the original charge and rate are set when it was converted into the reporting currency,
+// provisional charges are not billed and never get one
+type CallBilledEvent struct {
+	CallID             string         `json:"call_id"`
+	TotalConsumedUnits int            `json:"total_consumed_units"`
+	ChargeAmount       money.Decimal  `json:"charge_amount"`
+	Currency           string         `json:"currency"`
+	OriginalAmount     *money.Decimal `json:"original_amount,omitempty"`
+	OriginalCurrency   string         `json:"original_currency,omitempty"`
+	ExchangeRate       *money.Decimal `json:"exchange_rate,omitempty"`
+	BilledAt           string         `json:"billed_at"`
+}
+
+// OutboxStore - reads and updates the outbox table
+type OutboxStore struct {
+	db *gorm.DB
+}
+
+// NewOutboxStore - returns a store for the outbox in the call info database
+func NewOutboxStore() *OutboxStore {
+	return &OutboxStore{db: billingDB}
+}
+
+// Claim - returns up to limit events due at now and leases them until now plus lease,
+// so relays of other workers do not publish them at the same time
+func (s *OutboxStore) Claim(now time.Time, lease time.Duration, limit int) ([]OutboxEvent, error) {
+	var due []OutboxEvent
+	err := s.db.Where("next_attempt_at <= ?", now.UnixNano()).Order("id").Limit(limit).Find(&due).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read outbox")
+	}
+	leasedUntil := now.Add(lease).UnixNano()
+	var claimed []OutboxEvent
+	for _, event := range due {
+		result := s.db.Exec("UPDATE "+OutboxTable+" SET next_attempt_at = ? WHERE id = ? AND next_attempt_at = ?;",
+			leasedUntil, event.ID, event.NextAttemptAt)
+		if result.Error != nil {
+			return claimed, errors.Wrap(result.Error, "unable to lease outbox event")
+		}
+		// another relay leased the event first
+		if result.RowsAffected == 0 {
+			continue
+		}
+		event.NextAttemptAt = leasedUntil
+		claimed = append(claimed, event)
+	}
+	return claimed, nil
+}
+
+// Delete - removes published events from the outbox
+func (s *OutboxStore) Delete(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	err := s.db.Exec("DELETE FROM "+OutboxTable+" WHERE id IN (?);", ids).Error
+	return errors.Wrap(err, "unable to delete published outbox events")
+}
+
+// Retry - records a failed attempt and the time of the next one
+func (s *OutboxStore) Retry(id int64, attempts int, nextAttemptAt time.Time) error {
+	err := s.db.Exec("UPDATE "+OutboxTable+" SET attempts = ?, next_attempt_at = ? WHERE id = ?;",
+		attempts, nextAttemptAt.UnixNano(), id).Error
+	return errors.Wrap(err, "unable to reschedule outbox event")
+}
+
+// insertOutboxEvent - writes the call billed event of a balance response in a transaction
+func insertOutboxEvent(tx *gorm.DB, balanceResponse models.BalanceResponse, now time.Time) error {
+	payload, err := json.Marshal(callBilledEvent(balanceResponse, now))
+	if err != nil {
+		return errors.Wrap(err, "unable to encode call billed event")
+	}
+	query := "INSERT INTO " + OutboxTable + " (event_type, call_id, payload, attempts, next_attempt_at, enqueued_at) " +
+		"VALUES (?, ?, ?, 0, ?, ?);"
+	err = tx.Exec(query, CallBilledEventType, balanceResponse.CallID, string(payload), now.UnixNano(), now.UnixNano()).Error
+	return errors.Wrap(err, "unable to write outbox event")
+}
+
+// callBilledEvent - returns the event announcing the charge of a balance response
+func callBilledEvent(balanceResponse models.BalanceResponse, now time.Time) CallBilledEvent {
+	event := CallBilledEvent{
+		CallID:             balanceResponse.CallID,
+		TotalConsumedUnits: balanceResponse.TotalConsumedUnits,
+		ChargeAmount:       balanceResponse.ChargeAmount,
+		Currency:           balanceResponse.Currency,
+		BilledAt:           now.UTC().Format(time.RFC3339Nano),
+	}
+	if event.Currency == "" {
+		event.Currency = money.DefaultCurrency
+	}
+	if conversion := balanceResponse.Conversion; conversion != nil {
+		event.ChargeAmount = conversion.Amount
+		event.Currency = conversion.Currency
+		event.OriginalAmount = &conversion.OriginalAmount
+		event.OriginalCurrency = conversion.OriginalCurrency
+		event.ExchangeRate = &conversion.Rate
+	}
+	return event
+}
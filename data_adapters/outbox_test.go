@@ -0,0 +1,96 @@
+package dataadapters
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/logger"
+)
+
+// TestPositiveUpdationOutbox - test the update and its outbox event are written in one transaction
+func TestPositiveUpdationOutbox(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+	outboxEnabled = true
+	defer func() { outboxEnabled = false }()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	// mock transaction
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE call_info SET billing_cost = ?").
+		WithArgs("1.2", "USD", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO billing_outbox").
+		WithArgs(CallBilledEventType, "e21b0dda-6566-402a-8f8c-0657e5b87eeb", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	check.NoError(UpdateCallInfo(getBalanceResponse()))
+	check.NoError(mock.ExpectationsWereMet())
+}
+
+// TestPositiveProvisionalUpdationOutbox - test provisional charges are written without an outbox event
+func TestPositiveProvisionalUpdationOutbox(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+	outboxEnabled = true
+	defer func() { outboxEnabled = false }()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	// mock update query, any other statement fails the test
+	mock.ExpectExec("UPDATE call_info SET billing_cost = ?").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	balanceResponse := getBalanceResponse()
+	balanceResponse.Provisional = true
+	check.NoError(UpdateCallInfo(balanceResponse))
+	check.NoError(mock.ExpectationsWereMet())
+}
+
+// TestNegativeUpdationOutbox - test the update is rolled back when its outbox event can not be written
+func TestNegativeUpdationOutbox(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+	outboxEnabled = true
+	defer func() { outboxEnabled = false }()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	// mock transaction
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE call_info SET billing_cost = ?").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO billing_outbox").
+		WillReturnError(errors.New("table billing_outbox doesn't exist"))
+	mock.ExpectRollback()
+
+	check.Error(UpdateCallInfo(getBalanceResponse()))
+	check.NoError(mock.ExpectationsWereMet())
+}
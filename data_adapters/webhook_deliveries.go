@@ -0,0 +1,30 @@
+package dataadapters
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"go-worker/models"
+)
+
+// WebhookDeliveriesTable - table logging webhook delivery attempts
+const WebhookDeliveriesTable = "webhook_deliveries"
+
+// WebhookDeliveryLog - logs webhook delivery attempts in the call info database
+type WebhookDeliveryLog struct {
+	db *gorm.DB
+}
+
+// NewWebhookDeliveryLog - returns the delivery log in the call info database
+func NewWebhookDeliveryLog() *WebhookDeliveryLog {
+	return &WebhookDeliveryLog{db: billingDB}
+}
+
+// Record - writes a delivery attempt to the log
+func (l *WebhookDeliveryLog) Record(delivery models.WebhookDelivery) error {
+	query := "INSERT INTO " + WebhookDeliveriesTable + " (delivery_id, url, call_id, status, attempt, status_code, error, " +
+		"delivered, attempt_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);"
+	err := l.db.Exec(query, delivery.DeliveryID, delivery.URL, delivery.CallID, delivery.Status, delivery.Attempt,
+		delivery.StatusCode, delivery.Error, delivery.Delivered, delivery.AttemptAt.UnixNano()).Error
+	return errors.Wrap(err, "unable to record webhook delivery")
+}
@@ -0,0 +1,273 @@
+package dataadapters
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"go-worker/logger"
+	"go-worker/models"
+)
+
+const (
+	// defaultWriteBatchInterval - time pending writes wait for a full batch
+	defaultWriteBatchInterval = 100 * time.Millisecond
+)
+
+// writeBatcher - batcher shared by the workers, nil when writes are not batched
+var writeBatcher *WriteBatcher
+
+// PendingWrite - holds a call info update waiting for its batch to be flushed
+type PendingWrite struct {
+	Response models.BalanceResponse
+	done     chan struct{}
+	err      error
+}
+
+// Wait - waits for the batch of the write to be flushed and returns its error,
+// ErrCallNotFound when the call info row of the write does not exist
+func (w *PendingWrite) Wait() error {
+	<-w.done
+	return w.err
+}
+
+// WriteBatcher - gathers call info updates from all workers and writes them in one transaction
+// once MaxSize updates are pending or Interval has passed, each batch is written with one multi
+// row update for plain charges and one for converted charges
+type WriteBatcher struct {
+	MaxSize   int
+	Interval  time.Duration
+	db        *gorm.DB
+	lock      sync.Mutex
+	pending   []*PendingWrite
+	flushChan chan bool
+	closeChan chan bool
+	wg        sync.WaitGroup
+}
+
+// NewWriteBatcher - returns a batcher writing to the call info database, the default interval is used when it is not positive
+func NewWriteBatcher(maxSize int, interval time.Duration) *WriteBatcher {
+	if interval <= 0 {
+		interval = defaultWriteBatchInterval
+	}
+	return &WriteBatcher{MaxSize: maxSize, Interval: interval, db: billingDB}
+}
+
+// SharedWriteBatcher - returns the batcher shared by the workers, nil when writes are not batched
+func SharedWriteBatcher() *WriteBatcher {
+	return writeBatcher
+}
+
+// Start - flushes batches until the batcher is closed
+func (b *WriteBatcher) Start() {
+	b.flushChan = make(chan bool, 1)
+	b.closeChan = make(chan bool)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		interval := b.Interval
+		if interval <= 0 {
+			interval = defaultWriteBatchInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.closeChan:
+				b.Flush()
+				return
+			case <-b.flushChan:
+				b.Flush()
+			case <-ticker.C:
+				b.Flush()
+			}
+		}
+	}()
+}
+
+// Close - flushes the pending writes and stops the batcher
+func (b *WriteBatcher) Close() {
+	close(b.closeChan)
+	b.wg.Wait()
+}
+
+// Submit - queues a call info update for the next batch
+func (b *WriteBatcher) Submit(balanceResponse models.BalanceResponse) *PendingWrite {
+	write := &PendingWrite{Response: balanceResponse, done: make(chan struct{})}
+	b.lock.Lock()
+	b.pending = append(b.pending, write)
+	full := len(b.pending) >= b.MaxSize
+	b.lock.Unlock()
+	if full {
+		select {
+		case b.flushChan <- true:
+		default:
+		}
+	}
+	return write
+}
+
+// Flush - writes the pending updates in one transaction and reports the result to each of them
+func (b *WriteBatcher) Flush() {
+	b.lock.Lock()
+	writes := b.pending
+	b.pending = nil
+	b.lock.Unlock()
+	if len(writes) == 0 {
+		return
+	}
+
+	missing, err := b.write(writes)
+	if err != nil {
+		logger.Log.WithError(err).WithField("count", len(writes)).Error("Unable to write billing info batch")
+	}
+	for _, write := range writes {
+		write.err = err
+		if err == nil && missing[write.Response.CallID] {
+			write.err = ErrCallNotFound
+		}
+		close(write.done)
+	}
+}
+
+// write - writes a batch in one transaction and returns the call ids without a call info row
+// a call updated more than once in a batch gets its last update
+func (b *WriteBatcher) write(writes []*PendingWrite) (map[string]bool, error) {
+	latest := map[string]models.BalanceResponse{}
+	var callIDs []string
+	for _, write := range writes {
+		if _, ok := latest[write.Response.CallID]; !ok {
+			callIDs = append(callIDs, write.Response.CallID)
+		}
+		latest[write.Response.CallID] = write.Response
+	}
+	var plain, converted []models.BalanceResponse
+	for _, callID := range callIDs {
+		if latest[callID].Conversion != nil {
+			converted = append(converted, latest[callID])
+		} else {
+			plain = append(plain, latest[callID])
+		}
+	}
+
+	tx := b.db.Begin()
+	matched, err := updateCharges(tx, plain, converted)
+	missing := map[string]bool{}
+	if err == nil && matched < int64(len(callIDs)) {
+		missing, err = missingCalls(tx, callIDs)
+	}
+	if err == nil && outboxEnabled {
+		now := time.Now()
+		for _, callID := range callIDs {
+			if !missing[callID] {
+				if err = insertOutboxEvent(tx, latest[callID], now); err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return missing, errors.Wrap(tx.Commit().Error, "unable to commit billing info batch")
+}
+
+// caseColumn - holds a column set by a multi row update and the value of each row
+type caseColumn struct {
+	name    string
+	numeric bool
+	value   func(models.BalanceResponse) interface{}
+}
+
+// plainColumns - columns written for charges in their own currency
+var plainColumns = []caseColumn{
+	{"billing_cost", true, func(r models.BalanceResponse) interface{} { return r.ChargeAmount.String() }},
+	{"billing_currency", false, func(r models.BalanceResponse) interface{} { return chargeCurrency(r) }},
+}
+
+// convertedColumns - columns written for charges converted into the reporting currency
+var convertedColumns = []caseColumn{
+	{"billing_cost", true, func(r models.BalanceResponse) interface{} { return r.Conversion.Amount.String() }},
+	{"billing_currency", false, func(r models.BalanceResponse) interface{} { return r.Conversion.Currency }},
+	{"original_cost", true, func(r models.BalanceResponse) interface{} { return r.Conversion.OriginalAmount.String() }},
+	{"original_currency", false, func(r models.BalanceResponse) interface{} { return r.Conversion.OriginalCurrency }},
+	{"exchange_rate", true, func(r models.BalanceResponse) interface{} { return r.Conversion.Rate.String() }},
+}
+
+// updateCharges - updates the charges of a batch with one statement per kind of charge
+// and returns the number of matched rows
+func updateCharges(tx *gorm.DB, plain, converted []models.BalanceResponse) (int64, error) {
+	var matched int64
+	for _, group := range []struct {
+		responses []models.BalanceResponse
+		columns   []caseColumn
+	}{{plain, plainColumns}, {converted, convertedColumns}} {
+		if len(group.responses) == 0 {
+			continue
+		}
+		query, args := caseUpdate(tx.Dialect().GetName(), group.responses, group.columns)
+		result := tx.Exec(query, args...)
+		if result.Error != nil {
+			return 0, errors.Wrap(result.Error, "unable to update billing info batch")
+		}
+		matched += result.RowsAffected
+	}
+	return matched, nil
+}
+
+// caseUpdate - returns a multi row update setting each column to its value for the row's call id, e.g.
+// UPDATE call_info SET billing_cost = CASE call_id WHEN ? THEN ? END, billing_provisional = FALSE WHERE call_id IN (?)
+// batched charges are billed by the balance api, so they clear the provisional flag of locally rated ones,
+// and postgresql types the values of a case as text, so numeric values are cast
+func caseUpdate(dialect string, responses []models.BalanceResponse, columns []caseColumn) (string, []interface{}) {
+	var args []interface{}
+	var assignments []string
+	for _, column := range columns {
+		value := "?"
+		if column.numeric && dialect == PostgresEngine {
+			value = "CAST(? AS NUMERIC)"
+		}
+		assignments = append(assignments, column.name+" = CASE call_id"+strings.Repeat(" WHEN ? THEN "+value, len(responses))+" END")
+		for _, response := range responses {
+			args = append(args, response.CallID, column.value(response))
+		}
+	}
+	for _, response := range responses {
+		args = append(args, response.CallID)
+	}
+	assignments = append(assignments, "billing_provisional = FALSE")
+	query := "UPDATE call_info SET " + strings.Join(assignments, ", ") + " WHERE call_id IN (" + placeholders(len(responses)) + ");"
+	return query, args
+}
+
+// missingCalls - returns the call ids of a batch without a call info row
+func missingCalls(tx *gorm.DB, callIDs []string) (map[string]bool, error) {
+	args := make([]interface{}, 0, len(callIDs))
+	missing := make(map[string]bool, len(callIDs))
+	for _, callID := range callIDs {
+		args = append(args, callID)
+		missing[callID] = true
+	}
+	rows, err := tx.Raw("SELECT call_id FROM call_info WHERE call_id IN ("+placeholders(len(callIDs))+");", args...).Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read call info of batch")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var callID string
+		if err = rows.Scan(&callID); err != nil {
+			return nil, errors.Wrap(err, "unable to read call info of batch")
+		}
+		delete(missing, callID)
+	}
+	return missing, errors.Wrap(rows.Err(), "unable to read call info of batch")
+}
+
+// placeholders - returns n comma separated query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
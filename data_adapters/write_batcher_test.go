@@ -0,0 +1,146 @@
+package dataadapters
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/logger"
+	"go-worker/models"
+	"go-worker/money"
+)
+
+// TestPositiveWriteBatch - test a batch is written in one transaction and missing calls are reported
+func TestPositiveWriteBatch(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	// the first call is updated twice, only its last charge is written
+	batcher := NewWriteBatcher(10, time.Second)
+	first := getBalanceResponse()
+	first.ChargeAmount = money.MustParse("1.1")
+	firstWrite := batcher.Submit(first)
+	missing := getBalanceResponse()
+	missing.CallID = "d12b0dda-6566-402a-8f8c-0657e5b87eeb"
+	missingWrite := batcher.Submit(missing)
+	converted := getBalanceResponse()
+	converted.CallID = "f31b0dda-6566-402a-8f8c-0657e5b87eeb"
+	converted.Conversion = &models.Conversion{OriginalAmount: converted.ChargeAmount, OriginalCurrency: "EUR",
+		Amount: money.MustParse("1.3200"), Currency: "USD", Rate: money.MustParse("1.1")}
+	convertedWrite := batcher.Submit(converted)
+	lastWrite := batcher.Submit(getBalanceResponse())
+
+	// mock the batch transaction
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE call_info SET billing_cost = CASE call_id WHEN \\? THEN \\? WHEN \\? THEN \\? END, "+
+		"billing_currency = CASE call_id WHEN \\? THEN \\? WHEN \\? THEN \\? END, billing_provisional = FALSE WHERE call_id IN \\(\\?, \\?\\)").
+		WithArgs(first.CallID, "1.2", missing.CallID, "1.2", first.CallID, "USD", missing.CallID, "USD", first.CallID, missing.CallID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE call_info SET billing_cost = CASE call_id WHEN \\? THEN \\? END, billing_currency = CASE call_id").
+		WithArgs(converted.CallID, "1.3200", converted.CallID, "USD", converted.CallID, "1.2", converted.CallID, "EUR",
+			converted.CallID, "1.1", converted.CallID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT call_id FROM call_info WHERE call_id IN").
+		WithArgs(first.CallID, missing.CallID, converted.CallID).
+		WillReturnRows(sqlmock.NewRows([]string{"call_id"}).AddRow(first.CallID).AddRow(converted.CallID))
+	mock.ExpectCommit()
+
+	batcher.Flush()
+	check.NoError(firstWrite.Wait())
+	check.NoError(lastWrite.Wait())
+	check.NoError(convertedWrite.Wait())
+	check.Equal(ErrCallNotFound, missingWrite.Wait())
+	check.NoError(mock.ExpectationsWereMet())
+}
+
+// TestNegativeWriteBatch - test every write of a failed batch gets its error
+func TestNegativeWriteBatch(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("mysql", db)
+	defer db.Close()
+
+	batcher := NewWriteBatcher(2, time.Second)
+	batcher.Start()
+	defer batcher.Close()
+
+	// mock a failing batch update
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE call_info SET billing_cost = CASE call_id").
+		WillReturnError(errors.New("deadlock found"))
+	mock.ExpectRollback()
+
+	// a full batch is flushed without waiting for the interval
+	other := getBalanceResponse()
+	other.CallID = "d12b0dda-6566-402a-8f8c-0657e5b87eeb"
+	firstWrite := batcher.Submit(getBalanceResponse())
+	otherWrite := batcher.Submit(other)
+	check.Contains(firstWrite.Wait().Error(), "deadlock found")
+	check.Contains(otherWrite.Wait().Error(), "deadlock found")
+	check.NoError(mock.ExpectationsWereMet())
+}
+
+// TestNegativeWriteBatchInterval - test intervals which are not positive fall back to the default
+func TestNegativeWriteBatchInterval(t *testing.T) {
+
+	check := assert.New(t)
+	batcher := NewWriteBatcher(10, -time.Second)
+	check.Equal(defaultWriteBatchInterval, batcher.Interval)
+
+	// an interval cleared after construction does not stop the batcher from starting
+	batcher.Interval = 0
+	check.NotPanics(func() {
+		batcher.Start()
+		batcher.Close()
+	})
+}
+
+// TestPositiveWriteBatchPostgres - test numeric values of a postgresql batch are cast
+func TestPositiveWriteBatchPostgres(t *testing.T) {
+
+	check := assert.New(t)
+	logger.Init()
+
+	// create sqlmock object
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	billingDB, err = gorm.Open("postgres", db)
+	defer db.Close()
+
+	batcher := NewWriteBatcher(10, time.Second)
+	write := batcher.Submit(getBalanceResponse())
+
+	// mock the batch transaction
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE call_info SET billing_cost = CASE call_id WHEN \\$1 THEN CAST\\(\\$2 AS NUMERIC\\) END, "+
+		"billing_currency = CASE call_id WHEN \\$3 THEN \\$4 END, billing_provisional = FALSE WHERE call_id IN \\(\\$5\\)").
+		WithArgs("e21b0dda-6566-402a-8f8c-0657e5b87eeb", "1.2", "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "USD", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	batcher.Flush()
+	check.NoError(write.Wait())
+	check.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,122 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CloudEventsSpecVersion - cloudevents specification version supported
+	CloudEventsSpecVersion = "1.0"
+	// CloudEventsContentType - content type of structured mode cloudevents
+	CloudEventsContentType = "application/cloudevents+json"
+	// CloudEventsAttributePrefix - prefix of the message attributes carrying binary mode context attributes
+	CloudEventsAttributePrefix = "ce_"
+	// jsonContentType - content type of json data, assumed when datacontenttype is not given
+	jsonContentType = "application/json"
+)
+
+// CloudEvent - holds a cloudevents 1.0 event, in structured mode the data is in Data
+// or DataBase64 while in binary mode it is the message body
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// ParseStructuredCloudEvent - parses a structured mode cloudevent, reporting false for bodies
+// which are not one, the content type marks cloudevents but bodies with a specversion are detected too
+func ParseStructuredCloudEvent(body []byte, contentType string) (*CloudEvent, bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != CloudEventsContentType {
+		trimmed := bytes.TrimSpace(body)
+		if !bytes.HasPrefix(trimmed, []byte("{")) || !bytes.Contains(trimmed, []byte(`"specversion"`)) {
+			return nil, false, nil
+		}
+	}
+	event := &CloudEvent{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, true, errors.Wrap(err, "invalid structured cloudevent")
+	}
+	return event, true, event.Validate()
+}
+
+// ParseBinaryCloudEvent - parses the context attributes of a binary mode cloudevent from
+// message attributes, reporting false for messages which are not one
+func ParseBinaryCloudEvent(attributes map[string]string) (*CloudEvent, bool, error) {
+	specVersion, ok := attributes[CloudEventsAttributePrefix+"specversion"]
+	if !ok {
+		return nil, false, nil
+	}
+	event := &CloudEvent{
+		SpecVersion: specVersion,
+		ID:          attributes[CloudEventsAttributePrefix+"id"],
+		Source:      attributes[CloudEventsAttributePrefix+"source"],
+		Type:        attributes[CloudEventsAttributePrefix+"type"],
+		Subject:     attributes[CloudEventsAttributePrefix+"subject"],
+		Time:        attributes[CloudEventsAttributePrefix+"time"],
+		DataSchema:  attributes[CloudEventsAttributePrefix+"dataschema"],
+	}
+	return event, true, event.Validate()
+}
+
+// Validate - checks the required context attributes are present and the time is a timestamp
+func (e *CloudEvent) Validate() error {
+	switch {
+	case e.SpecVersion != CloudEventsSpecVersion:
+		return errors.Errorf("unsupported cloudevents specversion %q", e.SpecVersion)
+	case e.ID == "":
+		return errors.New("cloudevent id is required")
+	case e.Source == "":
+		return errors.New("cloudevent source is required")
+	case e.Type == "":
+		return errors.New("cloudevent type is required")
+	case e.Data != nil && e.DataBase64 != "":
+		return errors.New("cloudevent has both data and data_base64")
+	}
+	if _, err := e.ParsedTime(); err != nil {
+		return errors.Wrap(err, "invalid cloudevent time")
+	}
+	return nil
+}
+
+// ParsedTime - returns the time of the event, zero when it has none
+func (e *CloudEvent) ParsedTime() (time.Time, error) {
+	if e.Time == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, e.Time)
+}
+
+// Payload - returns the data of a structured mode event and its content type, base64 data
+// is returned still encoded as binary bodies are base64 encoded on the queue too
+func (e *CloudEvent) Payload() ([]byte, string) {
+	contentType := e.DataContentType
+	if contentType == "" {
+		contentType = jsonContentType
+	}
+	if e.DataBase64 != "" {
+		return []byte(e.DataBase64), contentType
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != jsonContentType && !strings.HasSuffix(mediaType, "+json") {
+		// non json data is carried as a json string
+		var data string
+		if err := json.Unmarshal(e.Data, &data); err == nil {
+			return []byte(data), contentType
+		}
+	}
+	return e.Data, contentType
+}
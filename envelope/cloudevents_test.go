@@ -0,0 +1,60 @@
+package envelope
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPositiveParseCloudEvent - tests structured and binary mode cloudevents are parsed
+func TestPositiveParseCloudEvent(t *testing.T) {
+	check := assert.New(t)
+
+	body := []byte(`{"specversion": "1.0", "id": "A234-1234-1234", "source": "/pbx/eu-1", "type": "gobilling.billing_event",
+		"subject": "call/e21b0dda", "time": "2021-07-01T01:00:00Z", "data": {"user_id": 1}}`)
+	event, ok, err := ParseStructuredCloudEvent(body, "")
+	check.True(ok)
+	check.NoError(err)
+	check.Equal("/pbx/eu-1", event.Source)
+	data, contentType := event.Payload()
+	check.JSONEq(`{"user_id": 1}`, string(data))
+	check.Equal(jsonContentType, contentType)
+	eventTime, err := event.ParsedTime()
+	check.NoError(err)
+	check.Equal(2021, eventTime.Year())
+
+	// base64 data is passed on still encoded along with its content type
+	body = []byte(`{"specversion": "1.0", "id": "1", "source": "/pbx", "type": "t", "datacontenttype": "application/x-protobuf", "data_base64": "EAE="}`)
+	event, _, err = ParseStructuredCloudEvent(body, CloudEventsContentType)
+	check.NoError(err)
+	data, contentType = event.Payload()
+	check.Equal("EAE=", string(data))
+	check.Equal("application/x-protobuf", contentType)
+
+	event, ok, err = ParseBinaryCloudEvent(map[string]string{
+		"ce_specversion": "1.0", "ce_id": "1", "ce_source": "/pbx", "ce_type": "t", "ce_subject": "call/1",
+	})
+	check.True(ok)
+	check.NoError(err)
+	check.Equal("call/1", event.Subject)
+
+	_, ok, _ = ParseStructuredCloudEvent([]byte(`{"user_id": 1}`), "")
+	check.False(ok)
+	_, ok, _ = ParseBinaryCloudEvent(map[string]string{"source": "pbx"})
+	check.False(ok)
+}
+
+// TestNegativeParseCloudEvent - tests cloudevents missing required attributes are rejected
+func TestNegativeParseCloudEvent(t *testing.T) {
+	check := assert.New(t)
+
+	_, ok, err := ParseStructuredCloudEvent([]byte(`{"specversion": "0.3", "id": "1", "source": "/pbx", "type": "t"}`), "")
+	check.True(ok)
+	check.Error(err)
+	_, _, err = ParseStructuredCloudEvent([]byte(`{"specversion": "1.0", "source": "/pbx", "type": "t"}`), "")
+	check.Error(err)
+	_, _, err = ParseStructuredCloudEvent([]byte(`not json`), CloudEventsContentType)
+	check.Error(err)
+	_, _, err = ParseBinaryCloudEvent(map[string]string{"ce_specversion": "1.0", "ce_id": "1", "ce_source": "/pbx", "ce_type": "t", "ce_time": "yesterday"})
+	check.Error(err)
+}
@@ -0,0 +1,135 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// SNSNotificationType - type of sns envelopes carrying a published message
+	SNSNotificationType = "Notification"
+)
+
+// SNSMessageAttribute - holds a message attribute of an sns notification
+type SNSMessageAttribute struct {
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+}
+
+// SNSNotification - holds an sns envelope delivered to a queue without raw message delivery
+type SNSNotification struct {
+	Type              string                         `json:"Type"`
+	MessageID         string                         `json:"MessageId"`
+	TopicArn          string                         `json:"TopicArn"`
+	Subject           *string                        `json:"Subject"`
+	Message           string                         `json:"Message"`
+	Timestamp         string                         `json:"Timestamp"`
+	SignatureVersion  string                         `json:"SignatureVersion"`
+	Signature         string                         `json:"Signature"`
+	SigningCertURL    string                         `json:"SigningCertURL"`
+	UnsubscribeURL    string                         `json:"UnsubscribeURL"`
+	MessageAttributes map[string]SNSMessageAttribute `json:"MessageAttributes"`
+}
+
+// ParseSNS - parses a message body as an sns envelope, reporting false for bodies which are not one
+func ParseSNS(body []byte) (*SNSNotification, bool) {
+	trimmed := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil, false
+	}
+	notification := &SNSNotification{}
+	if err := json.Unmarshal(body, notification); err != nil {
+		return nil, false
+	}
+	if notification.Type == "" || notification.MessageID == "" || notification.TopicArn == "" {
+		return nil, false
+	}
+	return notification, true
+}
+
+// Attributes - returns the string values of the notification's message attributes
+func (n *SNSNotification) Attributes() map[string]string {
+	attributes := make(map[string]string, len(n.MessageAttributes))
+	for name, attribute := range n.MessageAttributes {
+		attributes[name] = attribute.Value
+	}
+	return attributes
+}
+
+// StringToSign - returns the canonical form of the notification covered by its signature
+func (n *SNSNotification) StringToSign() string {
+	var builder strings.Builder
+	write := func(key, value string) {
+		builder.WriteString(key + "\n" + value + "\n")
+	}
+	write("Message", n.Message)
+	write("MessageId", n.MessageID)
+	if n.Subject != nil {
+		write("Subject", *n.Subject)
+	}
+	write("Timestamp", n.Timestamp)
+	write("TopicArn", n.TopicArn)
+	write("Type", n.Type)
+	return builder.String()
+}
+
+// SNSVerifier - verifies sns signatures against a configured signing certificate
+// instead of downloading the certificate named in each notification
+type SNSVerifier struct {
+	publicKey *rsa.PublicKey
+}
+
+// NewSNSVerifier - returns a verifier for the pem encoded certificate in certFile
+func NewSNSVerifier(certFile string) (*SNSVerifier, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read sns certificate")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("sns certificate is not pem encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse sns certificate")
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("sns certificate does not hold an rsa key")
+	}
+	return &SNSVerifier{publicKey: publicKey}, nil
+}
+
+// Verify - checks the signature of a notification, signature version 1 uses sha1 and version 2 sha256
+func (v *SNSVerifier) Verify(n *SNSNotification) error {
+	signature, err := base64.StdEncoding.DecodeString(n.Signature)
+	if err != nil {
+		return errors.Wrap(err, "sns signature is not base64 encoded")
+	}
+	var hash crypto.Hash
+	var digest []byte
+	switch n.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(n.StringToSign()))
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256([]byte(n.StringToSign()))
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return errors.Errorf("unsupported sns signature version %q", n.SignatureVersion)
+	}
+	if err = rsa.VerifyPKCS1v15(v.publicKey, hash, digest, signature); err != nil {
+		return errors.Wrap(err, "sns signature does not match")
+	}
+	return nil
+}
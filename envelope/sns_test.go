@@ -0,0 +1,122 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// snsBody - sns envelope of a billing event
+const snsBody = `{
+  "Type": "Notification",
+  "MessageId": "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+  "TopicArn": "arn:aws:sns:us-east-1:8888888888:billing-events",
+  "Message": "{\"user_id\": 1, \"call_id\": \"e21b0dda-6566-402a-8f8c-0657e5b87eeb\"}",
+  "Timestamp": "2020-05-01T10:00:00.000Z",
+  "SignatureVersion": "2",
+  "Signature": "",
+  "MessageAttributes": {"source": {"Type": "String", "Value": "pbx"}}
+}`
+
+// TestPositiveParseSNS - tests an sns envelope is detected and parsed
+func TestPositiveParseSNS(t *testing.T) {
+	check := assert.New(t)
+	notification, ok := ParseSNS([]byte(snsBody))
+	check.True(ok)
+	check.Equal(SNSNotificationType, notification.Type)
+	check.Equal("arn:aws:sns:us-east-1:8888888888:billing-events", notification.TopicArn)
+	check.Contains(notification.Message, "e21b0dda-6566-402a-8f8c-0657e5b87eeb")
+	check.Equal(map[string]string{"source": "pbx"}, notification.Attributes())
+}
+
+// TestNegativeParseSNS - tests plain billing events are not taken for sns envelopes
+func TestNegativeParseSNS(t *testing.T) {
+	check := assert.New(t)
+	_, ok := ParseSNS([]byte(`{"user_id": 1, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb"}`))
+	check.False(ok)
+	_, ok = ParseSNS([]byte("Test SQS!"))
+	check.False(ok)
+}
+
+// TestPositiveVerifySNS - tests a notification signed with the configured certificate is accepted
+func TestPositiveVerifySNS(t *testing.T) {
+	check := assert.New(t)
+	key, certFile := getSNSCertificate(t)
+	verifier, err := NewSNSVerifier(certFile)
+	check.NoError(err)
+
+	notification, _ := ParseSNS([]byte(snsBody))
+	signSNS(t, key, notification)
+	check.NoError(verifier.Verify(notification))
+}
+
+// TestNegativeVerifySNS - tests tampered, unsigned and foreign notifications are rejected
+func TestNegativeVerifySNS(t *testing.T) {
+	check := assert.New(t)
+	key, certFile := getSNSCertificate(t)
+	verifier, err := NewSNSVerifier(certFile)
+	check.NoError(err)
+
+	notification, _ := ParseSNS([]byte(snsBody))
+	check.Error(verifier.Verify(notification))
+
+	signSNS(t, key, notification)
+	notification.Message = `{"user_id": 2}`
+	check.Error(verifier.Verify(notification))
+
+	otherKey, _ := getSNSCertificate(t)
+	signSNS(t, otherKey, notification)
+	check.Error(verifier.Verify(notification))
+
+	notification.SignatureVersion = "3"
+	check.Error(verifier.Verify(notification))
+
+	_, err = NewSNSVerifier(filepath.Join(t.TempDir(), "missing.pem"))
+	check.Error(err)
+}
+
+// getSNSCertificate - writes a self signed certificate to a temporary file
+func getSNSCertificate(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.us-east-1.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err)
+	}
+	certFile := filepath.Join(t.TempDir(), "sns.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("unable to write certificate: %s", err)
+	}
+	return key, certFile
+}
+
+// signSNS - signs a notification with signature version 2
+func signSNS(t *testing.T, key *rsa.PrivateKey, notification *SNSNotification) {
+	digest := sha256.Sum256([]byte(notification.StringToSign()))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("unable to sign notification: %s", err)
+	}
+	notification.SignatureVersion = "2"
+	notification.Signature = base64.StdEncoding.EncodeToString(signature)
+}
@@ -0,0 +1,113 @@
+package exchange
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+	"go-worker/models"
+	"go-worker/money"
+	"go-worker/utils"
+)
+
+const (
+	// FileProvider - name of the provider reading rates from exchange.rates_file
+	FileProvider = "file"
+	// defaultDecimals - decimal places converted amounts are rounded to
+	defaultDecimals = 4
+)
+
+// ErrNoRate - no rate converts between two currencies at a time
+var ErrNoRate = errors.New("no exchange rate")
+
+// RateProvider - returns the rate converting one unit of a currency into another at a time
+type RateProvider interface {
+	Rate(from, to string, at time.Time) (money.Decimal, error)
+}
+
+// ProviderFactory - creates a rate provider from config
+type ProviderFactory func() (RateProvider, error)
+
+var (
+	providersMutex sync.RWMutex
+	providers      = map[string]ProviderFactory{FileProvider: newFileProvider}
+)
+
+// RegisterProvider - makes a rate provider available by name to exchange.provider
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	providers[name] = factory
+}
+
+// Converter - converts charges into the reporting currency at the rate effective when the call was answered
+type Converter struct {
+	Provider          RateProvider
+	ReportingCurrency string
+	decimals          int32
+}
+
+// NewConverter - returns a converter with the configured provider, or nil when conversion is disabled
+func NewConverter() (*Converter, error) {
+	cfg := config.GetConfig()
+	if !cfg.GetBool("exchange.enabled") {
+		return nil, nil
+	}
+	name := utils.GetValue(cfg.GetString("exchange.provider"), FileProvider).(string)
+	providersMutex.RLock()
+	factory, ok := providers[name]
+	providersMutex.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown exchange rate provider %q", name)
+	}
+	provider, err := factory()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create exchange rate provider %q", name)
+	}
+	decimals := defaultDecimals
+	if cfg.IsSet("exchange.decimals") {
+		decimals = cfg.GetInt("exchange.decimals")
+	}
+	reportingCurrency := utils.GetValue(cfg.GetString("exchange.reporting_currency"), money.DefaultCurrency).(string)
+	return NewProviderConverter(provider, reportingCurrency, decimals)
+}
+
+// NewProviderConverter - returns a converter into reportingCurrency with rates from provider,
+// rounding converted amounts to decimals places
+func NewProviderConverter(provider RateProvider, reportingCurrency string, decimals int) (*Converter, error) {
+	if err := money.ValidateCurrency(reportingCurrency); err != nil {
+		return nil, errors.Wrap(err, "invalid reporting currency")
+	}
+	if decimals < 0 || decimals > money.MaxScale {
+		return nil, errors.Errorf("exchange decimals must be between 0 and %d", money.MaxScale)
+	}
+	return &Converter{Provider: provider, ReportingCurrency: reportingCurrency, decimals: int32(decimals)}, nil
+}
+
+// Convert - converts a charge into the reporting currency at the rate effective at a time,
+// charges already in the reporting currency are kept as they are at a rate of 1
+func (c *Converter) Convert(charge money.Money, at time.Time) (*models.Conversion, error) {
+	conversion := &models.Conversion{
+		OriginalAmount:   charge.Amount,
+		OriginalCurrency: charge.Currency,
+		Amount:           charge.Amount,
+		Currency:         c.ReportingCurrency,
+		Rate:             money.MustParse("1"),
+	}
+	if charge.Currency == c.ReportingCurrency {
+		return conversion, nil
+	}
+	rate, err := c.Provider.Rate(charge.Currency, c.ReportingCurrency, at)
+	if err != nil {
+		return nil, err
+	}
+	if rate.Sign() <= 0 {
+		return nil, errors.Errorf("exchange rate %s from %s to %s is not positive", rate, charge.Currency, c.ReportingCurrency)
+	}
+	conversion.Rate = rate
+	conversion.Amount = money.FromRat(new(big.Rat).Mul(charge.Amount.Rat(), rate.Rat()), c.decimals)
+	return conversion, nil
+}
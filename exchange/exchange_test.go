@@ -0,0 +1,99 @@
+package exchange
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/config"
+	"go-worker/money"
+)
+
+// TestPositiveConvert - tests charges are converted at the rate effective when the call was answered
+func TestPositiveConvert(t *testing.T) {
+	check := assert.New(t)
+	converter := getConverter(t)
+
+	// the july rate replaces the june rate
+	conversion, err := converter.Convert(money.Money{Amount: money.MustParse("1.2"), Currency: "EUR"}, getTime("2021-07-01T00:30:00Z"))
+	check.NoError(err)
+	check.Equal("1.2", conversion.OriginalAmount.String())
+	check.Equal("EUR", conversion.OriginalCurrency)
+	check.Equal("1.3200", conversion.Amount.String())
+	check.Equal("USD", conversion.Currency)
+	check.Equal("1.1", conversion.Rate.String())
+
+	conversion, err = converter.Convert(money.Money{Amount: money.MustParse("1.2"), Currency: "EUR"}, getTime("2021-06-30T23:59:59Z"))
+	check.NoError(err)
+	check.Equal("1.2000", conversion.Amount.String())
+
+	// pairs without rates of their own use the inverse rate
+	conversion, err = converter.Convert(money.Money{Amount: money.MustParse("10"), Currency: "GBP"}, getTime("2021-07-01T00:30:00Z"))
+	check.NoError(err)
+	check.Equal("1.25000000", conversion.Rate.String())
+	check.Equal("12.5000", conversion.Amount.String())
+
+	// charges in the reporting currency are kept
+	conversion, err = converter.Convert(money.Money{Amount: money.MustParse("0.515"), Currency: "USD"}, getTime("2021-07-01T00:30:00Z"))
+	check.NoError(err)
+	check.Equal("0.515", conversion.Amount.String())
+	check.Equal("1", conversion.Rate.String())
+}
+
+// TestNegativeConvert - tests missing rates, invalid rates and unknown providers are reported
+func TestNegativeConvert(t *testing.T) {
+	check := assert.New(t)
+	converter := getConverter(t)
+
+	_, err := converter.Convert(money.Money{Amount: money.MustParse("1"), Currency: "EUR"}, getTime("2021-05-01T00:00:00Z"))
+	check.True(errors.Is(err, ErrNoRate))
+	_, err = converter.Convert(money.Money{Amount: money.MustParse("1"), Currency: "JPY"}, getTime("2021-07-01T00:00:00Z"))
+	check.True(errors.Is(err, ErrNoRate))
+
+	_, err = NewTable([]Rate{{From: "EUR", To: "USD", Rate: "-1", EffectiveFrom: "2021-06-01"}})
+	check.Error(err)
+	_, err = NewTable([]Rate{{From: "eur", To: "USD", Rate: "1.1", EffectiveFrom: "2021-06-01"}})
+	check.Error(err)
+	_, err = NewTable([]Rate{{From: "EUR", To: "USD", Rate: "1.1", EffectiveFrom: "june"}})
+	check.Error(err)
+
+	v := viper.New()
+	v.Set("exchange.enabled", true)
+	v.Set("exchange.provider", "ecb")
+	config.SetConfig(v)
+	_, err = NewConverter()
+	check.Error(err)
+}
+
+// getConverter - returns a converter into USD with rates from a rates file
+func getConverter(t *testing.T) *Converter {
+	ratesFile := filepath.Join(t.TempDir(), "exchange_rates.json")
+	err := os.WriteFile(ratesFile, []byte(`[
+		{"from": "EUR", "to": "USD", "rate": "1.1", "effective_from": "2021-07-01"},
+		{"from": "EUR", "to": "USD", "rate": "1", "effective_from": "2021-06-01"},
+		{"from": "USD", "to": "GBP", "rate": "0.8", "effective_from": "2021-06-01T00:00:00Z"}
+	]`), 0o644)
+	if err != nil {
+		t.Fatalf("unable to write rates file: %s", err)
+	}
+	v := viper.New()
+	v.Set("exchange.enabled", true)
+	v.Set("exchange.rates_file", ratesFile)
+	config.SetConfig(v)
+	converter, err := NewConverter()
+	if err != nil {
+		t.Fatalf("unable to create converter: %s", err)
+	}
+	return converter
+}
+
+// getTime - parses an RFC3339 time
+func getTime(value string) time.Time {
+	parsed, _ := time.Parse(time.RFC3339, value)
+	return parsed
+}
@@ -0,0 +1,133 @@
+package exchange
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+	"go-worker/money"
+)
+
+// dateLayout - layout of effective dates without a time
+const dateLayout = "2006-01-02"
+
+// Rate - rate converting one unit of From into To, effective from a date or RFC3339 time
+// until the next rate of the same pair
+type Rate struct {
+	From          string `json:"from" mapstructure:"from"`
+	To            string `json:"to" mapstructure:"to"`
+	Rate          string `json:"rate" mapstructure:"rate"`
+	EffectiveFrom string `json:"effective_from" mapstructure:"effective_from"`
+}
+
+// effectiveRate - holds a parsed rate and when it takes effect
+type effectiveRate struct {
+	rate          money.Decimal
+	effectiveFrom time.Time
+}
+
+// Table - provides rates from a list of effective dated rates,
+// a pair without rates of its own uses the inverse of the opposite pair
+type Table struct {
+	rates map[string][]effectiveRate
+}
+
+// NewTable - returns a table of the given rates
+func NewTable(rates []Rate) (*Table, error) {
+	table := &Table{rates: make(map[string][]effectiveRate)}
+	for _, r := range rates {
+		parsed, err := parseRate(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid exchange rate from %s to %s", r.From, r.To)
+		}
+		key := pairKey(r.From, r.To)
+		table.rates[key] = append(table.rates[key], parsed)
+	}
+	for _, pairRates := range table.rates {
+		sort.Slice(pairRates, func(i, j int) bool {
+			return pairRates[i].effectiveFrom.Before(pairRates[j].effectiveFrom)
+		})
+	}
+	return table, nil
+}
+
+// LoadTable - returns a table of the rates in a JSON file
+func LoadTable(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read exchange rates file")
+	}
+	var rates []Rate
+	if err = json.Unmarshal(data, &rates); err != nil {
+		return nil, errors.Wrap(err, "invalid exchange rates file")
+	}
+	return NewTable(rates)
+}
+
+// Rate - returns the latest rate of a pair effective at a time
+func (t *Table) Rate(from, to string, at time.Time) (money.Decimal, error) {
+	if rate, ok := t.effective(from, to, at); ok {
+		return rate, nil
+	}
+	if inverse, ok := t.effective(to, from, at); ok && inverse.Sign() > 0 {
+		return money.FromRat(new(big.Rat).Inv(inverse.Rat()), money.MaxScale), nil
+	}
+	return money.Decimal{}, errors.Wrapf(ErrNoRate, "from %s to %s at %s", from, to, at.UTC().Format(time.RFC3339))
+}
+
+// effective - returns the rate of a pair effective at a time
+func (t *Table) effective(from, to string, at time.Time) (money.Decimal, bool) {
+	pairRates := t.rates[pairKey(from, to)]
+	// index of the first rate taking effect after the time
+	i := sort.Search(len(pairRates), func(i int) bool {
+		return pairRates[i].effectiveFrom.After(at)
+	})
+	if i == 0 {
+		return money.Decimal{}, false
+	}
+	return pairRates[i-1].rate, true
+}
+
+// newFileProvider - returns the table in exchange.rates_file
+func newFileProvider() (RateProvider, error) {
+	ratesFile := config.GetConfig().GetString("exchange.rates_file")
+	if ratesFile == "" {
+		return nil, errors.New("exchange.rates_file is not set")
+	}
+	return LoadTable(ratesFile)
+}
+
+// parseRate - parses the currencies, rate and effective date of a rate
+func parseRate(r Rate) (effectiveRate, error) {
+	var parsed effectiveRate
+	if err := money.ValidateCurrency(r.From); err != nil {
+		return parsed, err
+	}
+	if err := money.ValidateCurrency(r.To); err != nil {
+		return parsed, err
+	}
+	rate, err := money.Parse(r.Rate)
+	if err != nil {
+		return parsed, err
+	}
+	if rate.Sign() <= 0 {
+		return parsed, errors.Errorf("rate must be positive, got %q", r.Rate)
+	}
+	parsed.rate = rate
+	if parsed.effectiveFrom, err = time.Parse(dateLayout, r.EffectiveFrom); err != nil {
+		if parsed.effectiveFrom, err = time.Parse(time.RFC3339, r.EffectiveFrom); err != nil {
+			return parsed, errors.Errorf("effective_from must be a date or RFC3339 time, got %q", r.EffectiveFrom)
+		}
+	}
+	return parsed, nil
+}
+
+// pairKey - returns the key of a currency pair
+func pairKey(from, to string) string {
+	return from + "/" + to
+}
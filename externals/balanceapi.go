@@ -1,6 +1,7 @@
 package externals
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -12,8 +13,10 @@ import (
 )
 
 // BalanceRequestHandler - holds customizable fields to request Balance API
+// events are billed in batches through BatchPath when it is set
 type BalanceRequestHandler struct {
 	URL        string
+	BatchPath  string
 	Username   string
 	Password   string
 	Timeout    int
@@ -22,11 +25,39 @@ type BalanceRequestHandler struct {
 	Log        *logrus.Entry
 }
 
+// BatchEvent - holds a billing event of a batch billing request along with the id its result is reported under
+type BatchEvent struct {
+	ID    string
+	Event models.BillingEvent
+}
+
+// BatchResult - holds the status and balance api response of one event of a batch,
+// Error holds the reason of an event which was not billed
+type BatchResult struct {
+	Status   int
+	Response []byte
+	Error    string
+}
+
+// batchResult - holds the result of one event in a batch billing response
+type batchResult struct {
+	ID       string          `json:"id"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+	Error    string          `json:"error"`
+}
+
+// batchResponse - holds a batch billing response
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
 // NewBalanceRequestHandler - returns a new object for BalanceRequestHandler
 func NewBalanceRequestHandler(log *logrus.Entry) *BalanceRequestHandler {
 	cfg := config.GetConfig()
 	balanceHandler := &BalanceRequestHandler{
 		URL:        cfg.GetString("balance_service.url"),
+		BatchPath:  cfg.GetString("balance_service.batch_path"),
 		Username:   cfg.GetString("balance_service.username"),
 		Password:   cfg.GetString("balance_service.password"),
 		Timeout:    cfg.GetInt("balance_service.timeout"),
@@ -39,23 +70,89 @@ func NewBalanceRequestHandler(log *logrus.Entry) *BalanceRequestHandler {
 
 // BillUser - bills the user based on call duration
 func (br *BalanceRequestHandler) BillUser(billEvent models.BillingEvent) ([]byte, bool) {
+	statusCode, response := br.Bill(billEvent)
+	return response, statusCode == http.StatusOK
+}
+
+// Bill - bills the user based on call duration and returns the status code and body of the response
+func (br *BalanceRequestHandler) Bill(billEvent models.BillingEvent) (int, []byte) {
 
 	// prepare url and body
 	path := fmt.Sprintf("Billing/%d", billEvent.UserID)
-	data := make(map[string]interface{})
-	data["product_id"] = billEvent.ProductID
-	data["call_id"] = billEvent.CallID
-	data["answer_time"] = billEvent.AnswerTime
-	data["hangup_time"] = billEvent.HangupTime
+	data := billingData(billEvent)
 
 	// make api request
 	statusCode, response := br.makeRequest(http.MethodPost, path, data)
 	if statusCode != http.StatusOK {
 		br.Log.Errorf("Failed to call billing api: %d -- %s", statusCode, string(response))
-		return response, false
+		return statusCode, response
 	}
 	br.Log.WithFields(logrus.Fields{"response": string(response), "response_code": statusCode}).Debug("Response for billing from API")
-	return response, true
+	return statusCode, response
+}
+
+// BillBatch - bills a batch of events in one request to the batch endpoint and returns the result
+// of each event by its id, events missing from the map have no result. When the request itself
+// fails every event gets its status
+func (br *BalanceRequestHandler) BillBatch(events []BatchEvent) map[string]BatchResult {
+	entries := make([]map[string]interface{}, 0, len(events))
+	for _, batchEvent := range events {
+		entry := billingData(batchEvent.Event)
+		entry["id"] = batchEvent.ID
+		entry["user_id"] = batchEvent.Event.UserID
+		entries = append(entries, entry)
+	}
+
+	// make api request
+	statusCode, response := br.makeRequest(http.MethodPost, br.BatchPath, map[string]interface{}{"events": entries})
+	if statusCode != http.StatusOK {
+		br.Log.Errorf("Failed to call batch billing api: %d -- %s", statusCode, string(response))
+		results := make(map[string]BatchResult, len(events))
+		for _, batchEvent := range events {
+			results[batchEvent.ID] = BatchResult{Status: statusCode, Response: response}
+		}
+		return results
+	}
+	parsed := batchResponse{}
+	if err := json.Unmarshal(response, &parsed); err != nil {
+		br.Log.WithError(err).Error("Unable to map batch billing response to struct")
+		return nil
+	}
+
+	results := make(map[string]BatchResult, len(parsed.Results))
+	billed := 0
+	for _, result := range parsed.Results {
+		results[result.ID] = BatchResult{Status: result.Status, Response: result.Response, Error: result.Error}
+		if result.Status != http.StatusOK {
+			br.Log.WithFields(logrus.Fields{"id": result.ID, "status": result.Status, "error": result.Error}).Error("Failed to bill batch event")
+			continue
+		}
+		billed++
+	}
+	br.Log.WithFields(logrus.Fields{"count": len(events), "billed": billed}).Debug("Response for batch billing from API")
+	return results
+}
+
+// billingData - returns the request body fields of a billing event
+func billingData(billEvent models.BillingEvent) map[string]interface{} {
+	data := make(map[string]interface{})
+	data["product_id"] = billEvent.ProductID
+	data["call_id"] = billEvent.CallID
+	data["answer_time"] = billEvent.AnswerTime
+	data["hangup_time"] = billEvent.HangupTime
+
+	// fields added in later schema versions are only sent when the producer set them
+	optional := map[string]string{
+		"currency":    billEvent.Currency,
+		"direction":   billEvent.Direction,
+		"destination": billEvent.Destination,
+	}
+	for key, value := range optional {
+		if value != "" {
+			data[key] = value
+		}
+	}
+	return data
 }
 
 // makeRequest - prepares request and makes an API call
@@ -1,7 +1,9 @@
 package externals
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"testing"
 
 	"github.com/jarcoal/httpmock"
@@ -47,6 +49,28 @@ func TestPositiveBillUser(t *testing.T) {
 	check.Equal(1, info["POST https://balance-svc-dev.com/Billing/1"])
 }
 
+// TestPositiveBalanceResponse - tests charges decode exactly from json numbers and strings
+func TestPositiveBalanceResponse(t *testing.T) {
+	check := assert.New(t)
+
+	var balanceResponse models.BalanceResponse
+	check.NoError(json.Unmarshal([]byte(responseBody), &balanceResponse))
+	check.Equal("1.2", balanceResponse.ChargeAmount.String())
+	charge, err := balanceResponse.Charge()
+	check.NoError(err)
+	check.Equal("1.2 USD", charge.String())
+
+	check.NoError(json.Unmarshal([]byte(`{"call_id": "1", "charge_amount": "0.10000000", "currency": "EUR"}`), &balanceResponse))
+	check.Equal("0.10000000", balanceResponse.ChargeAmount.String())
+	check.Equal("EUR", balanceResponse.Currency)
+
+	// more decimal places than call_info holds and unknown currencies are rejected
+	check.Error(json.Unmarshal([]byte(`{"call_id": "1", "charge_amount": 0.123456789}`), &balanceResponse))
+	check.NoError(json.Unmarshal([]byte(`{"call_id": "1", "charge_amount": 1, "currency": "euro"}`), &balanceResponse))
+	_, err = balanceResponse.Charge()
+	check.Error(err)
+}
+
 // TestNegativeBillUser - test a failure api response
 func TestNegativeBillUser(t *testing.T) {
 
@@ -77,6 +101,73 @@ func TestNegativeBillUser(t *testing.T) {
 	check.Equal(1, info["POST https://balance-svc-dev.com/Billing/1"])
 }
 
+// TestPositiveBillBatch - test a batch billing response is mapped to each event
+func TestPositiveBillBatch(t *testing.T) {
+
+	check := assert.New(t)
+
+	// disable transport swap for http mock
+	gorequest.DisableTransportSwap = true
+
+	// create request handler for mocking
+	requestHandler := utils.NewRequestHandler("balance_api")
+	httpmock.ActivateNonDefault(requestHandler.Handler.Client)
+	defer httpmock.DeactivateAndReset()
+
+	// mock http request, echoing the events back with the second one failing
+	httpmock.RegisterResponder("POST", "https://balance-svc-dev.com/Billing/batch",
+		func(req *http.Request) (*http.Response, error) {
+			body := struct {
+				Events []map[string]interface{} `json:"events"`
+			}{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return httpmock.NewStringResponse(400, err.Error()), nil
+			}
+			check.Len(body.Events, 2)
+			check.Equal(float64(1), body.Events[0]["user_id"])
+			return httpmock.NewStringResponse(200, fmt.Sprintf(`{"results": [
+				{"id": %q, "status": 200, "response": %s},
+				{"id": %q, "status": 402, "error": "insufficient balance"}]}`,
+				body.Events[0]["id"], responseBody, body.Events[1]["id"])), nil
+		})
+
+	// call batch balance api
+	balanceRequestHandler := getBalanceHandler(requestHandler)
+	balanceRequestHandler.BatchPath = "Billing/batch"
+	results := balanceRequestHandler.BillBatch([]BatchEvent{{ID: "m1", Event: getBillingEvent()}, {ID: "m2", Event: getBillingEvent()}})
+	check.Len(results, 2)
+	check.Equal(http.StatusOK, results["m1"].Status)
+	check.JSONEq(responseBody, string(results["m1"].Response))
+	check.Empty(results["m1"].Error)
+	check.Equal(http.StatusPaymentRequired, results["m2"].Status)
+	check.Equal("insufficient balance", results["m2"].Error)
+}
+
+// TestNegativeBillBatch - test a failed batch billing request gives every event its status
+func TestNegativeBillBatch(t *testing.T) {
+
+	check := assert.New(t)
+
+	// disable transport swap for http mock
+	gorequest.DisableTransportSwap = true
+
+	// create request handler for mocking
+	requestHandler := utils.NewRequestHandler("balance_api")
+	httpmock.ActivateNonDefault(requestHandler.Handler.Client)
+	defer httpmock.DeactivateAndReset()
+
+	// mock http request
+	httpmock.RegisterResponder("POST", "https://balance-svc-dev.com/Billing/batch",
+		httpmock.NewStringResponder(500, "unavailable"))
+
+	// call batch balance api
+	balanceRequestHandler := getBalanceHandler(requestHandler)
+	balanceRequestHandler.BatchPath = "Billing/batch"
+	results := balanceRequestHandler.BillBatch([]BatchEvent{{ID: "m1", Event: getBillingEvent()}})
+	check.Len(results, 1)
+	check.Equal(http.StatusInternalServerError, results["m1"].Status)
+}
+
 // getBillingEvent - prepares a bill event
 func getBillingEvent() (billEvent models.BillingEvent) {
 	billEvent.CallID = "e21b0dda-6566-402a-8f8c-0657e5b87eeb"
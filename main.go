@@ -8,17 +8,21 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"go-worker/commands"
 	"go-worker/config"
 	dataAdapters "go-worker/data_adapters"
 	"go-worker/logger"
+	"go-worker/outbox"
+	"go-worker/queue"
 	"go-worker/workerpool"
 )
 
 func main() {
 
 	// capture os signals
-	signalChan := make(chan os.Signal)
+	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
 
 	// Initialize config, logger, adapters
@@ -26,7 +30,35 @@ func main() {
 	flag.Parse()
 	config.Init(*environment)
 	logger.Init()
-	dataAdapters.Init()
+
+	// Run subcommand if one is given
+	if flag.NArg() > 0 {
+		runCommand(flag.Arg(0), flag.Args()[1:])
+		return
+	}
+	if err := dataAdapters.Init(); err != nil {
+		logger.Log.WithError(err).Fatal("Data adapters initiation failed")
+	}
+	// refuse to run against a schema missing migrations of this build
+	if config.GetConfig().GetBool("database.check_schema") {
+		if err := dataAdapters.CheckSchema(); err != nil {
+			logger.Log.WithError(err).Fatal("Database schema check failed")
+		}
+	}
+
+	// Start retries of parked charges
+	orphans := dataAdapters.NewOrphanRetrier(time.Duration(config.GetConfig().GetInt("orphans.retry_window"))*time.Second,
+		time.Duration(config.GetConfig().GetInt("orphans.retry_delay"))*time.Second)
+	orphans.Start()
+
+	// Start outbox relay
+	relay, err := outbox.NewRelay(logger.Log.WithField("prefix", "outbox"))
+	if err != nil {
+		logger.Log.Fatalf("Outbox relay initiation failed with error: %s", err.Error())
+	}
+	if relay != nil {
+		relay.Start()
+	}
 
 	// Start worker pool
 	pool, err := workerpool.New(config.GetConfig().GetInt("worker.count"))
@@ -45,5 +77,32 @@ func main() {
 	<-signalChan
 	// Stop worker pool
 	pool.Close()
+	// the relay and the orphan retrier read the database, so they are stopped before it is closed
+	if relay != nil {
+		relay.Close()
+	}
+	orphans.Close()
+	dataAdapters.Close()
+	if err = queue.Close(); err != nil {
+		logger.Log.WithError(err).Error("Unable to close queue")
+	}
 	logger.Log.Infoln("Successfully terminated worker pool")
 }
+
+// runCommand - runs a subcommand and exits with a non zero code on failure
+func runCommand(name string, args []string) {
+	var err error
+	switch name {
+	case "enqueue":
+		err = commands.Enqueue(args)
+	case "apply-orphans":
+		err = commands.ApplyOrphans(args)
+	case "migrate":
+		err = commands.Migrate(args)
+	default:
+		logger.Log.Fatalf("Unknown command: %s", name)
+	}
+	if err != nil {
+		logger.Log.Fatalf("Command %s failed with error: %s", name, err.Error())
+	}
+}
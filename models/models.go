@@ -1,17 +1,97 @@
 package models
 
-// BillingEvent - holds billing event information
+import (
+	"encoding/json"
+	"time"
+
+	"go-worker/money"
+)
+
+// BillingEvent - holds billing event information in the current schema version,
+// events of older versions are upcast to it by the schema package
+// cdr optionally carries the full call detail record, which may push the event
+// over the queue size limit and be offloaded to object storage
 type BillingEvent struct {
-	UserID     int    `json:"user_id"`
-	ProductID  int    `json:"product_id"`
-	CallID     string `json:"call_id"`
-	AnswerTime string `json:"answer_time"`
-	HangupTime string `json:"hangup_time"`
+	SchemaVersion int             `json:"schema_version,omitempty"`
+	UserID        int             `json:"user_id"`
+	ProductID     int             `json:"product_id"`
+	CallID        string          `json:"call_id"`
+	AnswerTime    string          `json:"answer_time"`
+	HangupTime    string          `json:"hangup_time"`
+	Currency      string          `json:"currency,omitempty"`
+	Direction     string          `json:"direction,omitempty"`
+	Destination   string          `json:"destination,omitempty"`
+	CDR           json.RawMessage `json:"cdr,omitempty"`
 }
 
 // BalanceResponse - holds balance api response
+// the charge amount is an exact decimal in Currency, the default currency when it is empty
+// provisional responses come from the local rating engine and are replaced once the api bills the event
+// Conversion is set once the charge is converted into the reporting currency
 type BalanceResponse struct {
-	CallID             string `json:"call_id"`
-	TotalConsumedUnits int    `json:"total_consumed_units"`
-	ChargeAmount       string `json:"charge_amount"`
+	CallID             string        `json:"call_id"`
+	TotalConsumedUnits int           `json:"total_consumed_units"`
+	ChargeAmount       money.Decimal `json:"charge_amount"`
+	Currency           string        `json:"currency,omitempty"`
+	Provisional        bool          `json:"provisional,omitempty"`
+	Conversion         *Conversion   `json:"-"`
+}
+
+// Conversion - holds a charge converted into the reporting currency and the rate used
+type Conversion struct {
+	OriginalAmount   money.Decimal
+	OriginalCurrency string
+	Amount           money.Decimal
+	Currency         string
+	Rate             money.Decimal
+}
+
+// Charge - returns the charge amount in its currency
+func (r BalanceResponse) Charge() (money.Money, error) {
+	return money.New(r.ChargeAmount, r.Currency)
+}
+
+// MessageMetadata - holds transport details of the queue message a billing event arrived in
+// for sns notifications the attributes are the sns message attributes
+type MessageMetadata struct {
+	MessageID     string
+	ReceiptHandle string
+	TopicARN      string
+	Attributes    map[string]string
+	// SchemaVersion - schema version the event was published in, before upcasting
+	SchemaVersion int
+	// ClaimCheckURL - location of the offloaded body, deleted once the message is acknowledged
+	ClaimCheckURL string
+	// EventID, EventType, EventSource, EventSubject and EventTime - context attributes of
+	// cloudevents, empty for bare billing events
+	EventID      string
+	EventType    string
+	EventSource  string
+	EventSubject string
+	EventTime    time.Time
+}
+
+// Notification - holds the outcome of billing a call sent to webhooks
+// the charge is only set for billed calls and the reason for failed ones
+type Notification struct {
+	CallID       string         `json:"call_id"`
+	UserID       int            `json:"user_id"`
+	Status       string         `json:"status"`
+	ChargeAmount *money.Decimal `json:"charge_amount,omitempty"`
+	Currency     string         `json:"currency,omitempty"`
+	Reason       string         `json:"reason,omitempty"`
+	OccurredAt   string         `json:"occurred_at"`
+}
+
+// WebhookDelivery - holds one attempt to deliver a notification to a webhook
+type WebhookDelivery struct {
+	DeliveryID string
+	URL        string
+	CallID     string
+	Status     string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Delivered  bool
+	AttemptAt  time.Time
 }
@@ -0,0 +1,237 @@
+package money
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultCurrency - currency of amounts which do not name one
+	DefaultCurrency = "USD"
+	// MaxScale - maximum number of decimal places of an amount
+	MaxScale = 8
+	// maxExponent - largest power of ten accepted in exponent forms
+	maxExponent = 30
+)
+
+var (
+	// decimalPattern - plain and exponent forms of decimal numbers
+	decimalPattern = regexp.MustCompile(`^([+-]?)(\d+)(?:\.(\d*))?(?:[eE]([+-]?\d+))?$`)
+	// currencyPattern - iso 4217 currency codes
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// Decimal - exact decimal number held as an unscaled integer and the number of decimal
+// places, so amounts are never rounded through floats, the zero value is 0
+type Decimal struct {
+	unscaled *big.Int
+	scale    int32
+}
+
+// Money - holds an amount in a currency
+type Money struct {
+	Amount   Decimal `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+// Parse - parses a decimal in plain or exponent form, keeping its scale
+func Parse(value string) (Decimal, error) {
+	match := decimalPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return Decimal{}, errors.Errorf("invalid decimal %q", value)
+	}
+	unscaled, _ := new(big.Int).SetString(match[2]+match[3], 10)
+	scale := int64(len(match[3]))
+	if match[4] != "" {
+		exponent, err := strconv.ParseInt(match[4], 10, 32)
+		if err != nil {
+			return Decimal{}, errors.Errorf("invalid decimal exponent in %q", value)
+		}
+		scale -= exponent
+	}
+	if scale < -maxExponent {
+		return Decimal{}, errors.Errorf("decimal %q is out of range", value)
+	}
+	if scale < 0 {
+		unscaled.Mul(unscaled, pow10(-scale))
+		scale = 0
+	}
+	if scale > MaxScale {
+		return Decimal{}, errors.Errorf("decimal %q has more than %d decimal places", value, MaxScale)
+	}
+	if match[1] == "-" {
+		unscaled.Neg(unscaled)
+	}
+	return Decimal{unscaled: unscaled, scale: int32(scale)}, nil
+}
+
+// MustParse - parses a decimal and panics if it is invalid, for constants
+func MustParse(value string) Decimal {
+	d, err := Parse(value)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// FromRat - returns a rational rounded half away from zero to scale decimal places
+func FromRat(r *big.Rat, scale int32) Decimal {
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow10(int64(scale))))
+	quotient, remainder := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	// round half away from zero
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(scaled.Denom()) >= 0 {
+		if scaled.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	return Decimal{unscaled: quotient, scale: scale}
+}
+
+// String - returns the plain form of the decimal with all its decimal places
+func (d Decimal) String() string {
+	digits := d.int().String()
+	negative := strings.HasPrefix(digits, "-")
+	digits = strings.TrimPrefix(digits, "-")
+	if d.scale > 0 {
+		if len(digits) <= int(d.scale) {
+			digits = strings.Repeat("0", int(d.scale)-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-int(d.scale)] + "." + digits[len(digits)-int(d.scale):]
+	}
+	if negative {
+		return "-" + digits
+	}
+	return digits
+}
+
+// Scale - returns the number of decimal places
+func (d Decimal) Scale() int32 {
+	return d.scale
+}
+
+// Rat - returns the decimal as a rational
+func (d Decimal) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(d.int(), pow10(int64(d.scale)))
+}
+
+// Sign - returns -1, 0 or 1 for negative, zero and positive decimals
+func (d Decimal) Sign() int {
+	return d.int().Sign()
+}
+
+// Cmp - compares two decimals by value, ignoring their scales
+func (d Decimal) Cmp(other Decimal) int {
+	return d.Rat().Cmp(other.Rat())
+}
+
+// Round - returns the decimal rounded half away from zero to scale decimal places
+func (d Decimal) Round(scale int32) Decimal {
+	return FromRat(d.Rat(), scale)
+}
+
+// MarshalJSON - encodes the decimal as a json string, so clients do not read it as a float
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// UnmarshalJSON - decodes a decimal from a json string or number without float rounding
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		*d = Decimal{}
+		return nil
+	}
+	value := string(data)
+	if strings.HasPrefix(value, `"`) {
+		var err error
+		if value, err = strconv.Unquote(value); err != nil {
+			return errors.Wrap(err, "invalid decimal string")
+		}
+	}
+	parsed, err := Parse(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Value - writes the decimal to the database in its exact plain form
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// Scan - reads a decimal from a database column
+func (d *Decimal) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*d = Decimal{}
+		return nil
+	case []byte:
+		return d.scanString(string(value))
+	case string:
+		return d.scanString(value)
+	case int64:
+		*d = Decimal{unscaled: big.NewInt(value)}
+		return nil
+	case float64:
+		return d.scanString(strconv.FormatFloat(value, 'f', -1, 64))
+	default:
+		return errors.Errorf("unable to scan %T into a decimal", src)
+	}
+}
+
+// scanString - sets the decimal to a parsed string
+func (d *Decimal) scanString(value string) error {
+	parsed, err := Parse(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// int - returns the unscaled integer, zero for the zero value
+func (d Decimal) int() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return d.unscaled
+}
+
+// New - returns money of an amount in a currency, the default currency when it is empty
+func New(amount Decimal, currency string) (Money, error) {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	if err := ValidateCurrency(currency); err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// ValidateCurrency - checks a currency is an iso 4217 code
+func ValidateCurrency(currency string) error {
+	if !currencyPattern.MatchString(currency) {
+		return errors.Errorf("invalid currency %q, expected an iso 4217 code", currency)
+	}
+	return nil
+}
+
+// String - returns the amount followed by the currency
+func (m Money) String() string {
+	return m.Amount.String() + " " + m.Currency
+}
+
+// pow10 - returns 10 to the power of n
+func pow10(n int64) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(n), nil)
+}
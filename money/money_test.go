@@ -0,0 +1,89 @@
+package money
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPositiveParse - tests decimals keep their exact value and scale
+func TestPositiveParse(t *testing.T) {
+	check := assert.New(t)
+	var tests = []struct {
+		input    string
+		expected string
+	}{
+		{"1.2", "1.2"},
+		{"1.20", "1.20"},
+		{"-0.0050", "-0.0050"},
+		{"12", "12"},
+		{"1.5e2", "150"},
+		{"15e-3", "0.015"},
+		{"0.1", "0.1"},
+	}
+	for _, test := range tests {
+		d, err := Parse(test.input)
+		check.NoError(err)
+		check.Equal(test.expected, d.String())
+	}
+	check.Equal("0", Decimal{}.String())
+	check.Equal(0, MustParse("1.20").Cmp(MustParse("1.2")))
+}
+
+// TestNegativeParse - tests malformed decimals and too many decimal places are rejected
+func TestNegativeParse(t *testing.T) {
+	check := assert.New(t)
+	for _, input := range []string{"", "abc", "1.2.3", "0x10", "1.123456789", "1e-9", "NaN", "1e999999"} {
+		_, err := Parse(input)
+		check.Error(err, input)
+	}
+}
+
+// TestPositiveDecimalJSON - tests string and number forms decode without float rounding
+func TestPositiveDecimalJSON(t *testing.T) {
+	check := assert.New(t)
+	var charge struct {
+		Number Decimal `json:"number"`
+		Text   Decimal `json:"text"`
+		Empty  Decimal `json:"empty"`
+	}
+	check.NoError(json.Unmarshal([]byte(`{"number": 0.30000000, "text": "1.10", "empty": null}`), &charge))
+	check.Equal("0.30000000", charge.Number.String())
+	check.Equal("1.10", charge.Text.String())
+	check.Equal(0, charge.Empty.Sign())
+
+	encoded, err := json.Marshal(charge)
+	check.NoError(err)
+	check.JSONEq(`{"number": "0.30000000", "text": "1.10", "empty": "0"}`, string(encoded))
+
+	check.Error(json.Unmarshal([]byte(`{"number": true}`), &charge))
+}
+
+// TestPositiveRound - tests rationals and decimals are rounded half away from zero
+func TestPositiveRound(t *testing.T) {
+	check := assert.New(t)
+	check.Equal("0.52", MustParse("0.515").Round(2).String())
+	check.Equal("-0.52", MustParse("-0.515").Round(2).String())
+	check.Equal("0.3333", FromRat(big.NewRat(1, 3), 4).String())
+
+	value, err := MustParse("1.2").Value()
+	check.NoError(err)
+	check.Equal("1.2", value)
+	var scanned Decimal
+	check.NoError(scanned.Scan([]byte("4.5000")))
+	check.Equal("4.5000", scanned.String())
+}
+
+// TestNegativeCurrency - tests currencies must be iso 4217 codes
+func TestNegativeCurrency(t *testing.T) {
+	check := assert.New(t)
+	m, err := New(MustParse("1.2"), "")
+	check.NoError(err)
+	check.Equal("1.2 USD", m.String())
+	_, err = New(MustParse("1.2"), "eur")
+	check.Error(err)
+	_, err = New(MustParse("1.2"), "EURO")
+	check.Error(err)
+}
@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+
+	"go-worker/codec"
+	"go-worker/config"
+	dataAdapters "go-worker/data_adapters"
+	"go-worker/queue"
+)
+
+const (
+	// EventTypeAttribute - message attribute holding the type of a published event
+	EventTypeAttribute = "event_type"
+	// CallIDAttribute - message attribute holding the call id of a published event
+	CallIDAttribute = "call_id"
+	// snsARNPrefix - prefix of sns topic arns
+	snsARNPrefix = "arn:aws:sns:"
+)
+
+// Publisher - publishes outbox events downstream
+type Publisher interface {
+	Publish(event dataAdapters.OutboxEvent) error
+}
+
+// NewPublisher - returns a publisher to an sns topic arn or to any queue url queue.New accepts
+func NewPublisher(target string) (Publisher, error) {
+	if strings.HasPrefix(target, snsARNPrefix) {
+		client, err := newSNSClient(target)
+		if err != nil {
+			return nil, err
+		}
+		return &SNSPublisher{Client: client, TopicARN: target}, nil
+	}
+	client, err := queue.New(target)
+	if err != nil {
+		return nil, err
+	}
+	return &QueuePublisher{Client: client, QueueURL: target}, nil
+}
+
+// QueuePublisher - publishes outbox events as queue messages
+type QueuePublisher struct {
+	Client   sqsiface.SQSAPI
+	QueueURL string
+}
+
+// Publish - sends an outbox event to the queue
+func (p *QueuePublisher) Publish(event dataAdapters.OutboxEvent) error {
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	for name, value := range eventAttributes(event) {
+		attributes[name] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	_, err := p.Client.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:          aws.String(p.QueueURL),
+		MessageBody:       aws.String(event.Payload),
+		MessageAttributes: attributes,
+	})
+	return errors.Wrap(err, "unable to send outbox event")
+}
+
+// SNSPublisher - publishes outbox events to an sns topic
+type SNSPublisher struct {
+	Client   snsiface.SNSAPI
+	TopicARN string
+}
+
+// Publish - publishes an outbox event to the topic
+func (p *SNSPublisher) Publish(event dataAdapters.OutboxEvent) error {
+	attributes := map[string]*sns.MessageAttributeValue{}
+	for name, value := range eventAttributes(event) {
+		attributes[name] = &sns.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	_, err := p.Client.Publish(&sns.PublishInput{
+		TopicArn:          aws.String(p.TopicARN),
+		Message:           aws.String(event.Payload),
+		MessageAttributes: attributes,
+	})
+	return errors.Wrap(err, "unable to publish outbox event")
+}
+
+// eventAttributes - returns the message attributes of an outbox event
+func eventAttributes(event dataAdapters.OutboxEvent) map[string]string {
+	return map[string]string{
+		EventTypeAttribute:         event.EventType,
+		CallIDAttribute:            event.CallID,
+		codec.ContentTypeAttribute: codec.ContentTypeJSON,
+	}
+}
+
+// newSNSClient - returns an sns client for the region of a topic arn
+// outbox.endpoint overrides the aws endpoint, e.g. to point at a local sns server
+func newSNSClient(topicARN string) (snsiface.SNSAPI, error) {
+	parsed, err := arn.Parse(topicARN)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sns topic arn")
+	}
+	awsConfig := &aws.Config{Region: aws.String(parsed.Region)}
+	if endpoint := config.GetConfig().GetString("outbox.endpoint"); endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return sns.New(sess), nil
+}
@@ -0,0 +1,159 @@
+package outbox
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"go-worker/config"
+	dataAdapters "go-worker/data_adapters"
+)
+
+const (
+	// defaultPollInterval - time between reads of the outbox, and the first retry delay
+	defaultPollInterval = time.Second
+	// defaultMaxBackoff - longest delay between attempts of an event
+	defaultMaxBackoff = 5 * time.Minute
+	// defaultLeaseTime - time a claimed event is hidden from other relays
+	defaultLeaseTime = time.Minute
+	// defaultBatchSize - events claimed per read of the outbox
+	defaultBatchSize = 100
+)
+
+// Store - claims, deletes and reschedules outbox events
+type Store interface {
+	Claim(now time.Time, lease time.Duration, limit int) ([]dataAdapters.OutboxEvent, error)
+	Delete(ids []int64) error
+	Retry(id int64, attempts int, nextAttemptAt time.Time) error
+}
+
+// Relay - publishes outbox events at least once, deleting them once published
+// and retrying failed events with exponential backoff
+type Relay struct {
+	Store        Store
+	Publisher    Publisher
+	PollInterval time.Duration
+	MaxBackoff   time.Duration
+	LeaseTime    time.Duration
+	BatchSize    int
+	Log          *logrus.Entry
+	closeChan    chan bool
+	wg           sync.WaitGroup
+}
+
+// NewRelay - returns a relay to the configured queue or topic, or nil when the outbox is disabled
+func NewRelay(log *logrus.Entry) (*Relay, error) {
+	cfg := config.GetConfig()
+	if !cfg.GetBool("outbox.enabled") {
+		return nil, nil
+	}
+	target := cfg.GetString("outbox.url")
+	if target == "" {
+		return nil, errors.New("outbox.url is not set")
+	}
+	publisher, err := NewPublisher(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create outbox publisher")
+	}
+	return &Relay{
+		Store:        dataAdapters.NewOutboxStore(),
+		Publisher:    publisher,
+		PollInterval: time.Duration(cfg.GetInt("outbox.poll_interval")) * time.Millisecond,
+		MaxBackoff:   time.Duration(cfg.GetInt("outbox.max_backoff")) * time.Second,
+		LeaseTime:    time.Duration(cfg.GetInt("outbox.lease_time")) * time.Second,
+		BatchSize:    cfg.GetInt("outbox.batch_size"),
+		Log:          log,
+	}, nil
+}
+
+// Start - relays outbox events until the relay is closed
+func (r *Relay) Start() {
+	r.setDefaults()
+	r.closeChan = make(chan bool)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.PollInterval)
+		defer ticker.Stop()
+		for {
+			// keep relaying while full batches are claimed
+			for {
+				published, err := r.RelayOnce(time.Now())
+				if err != nil {
+					r.Log.WithError(err).Error("Unable to relay outbox events")
+				}
+				if err != nil || published < r.BatchSize {
+					break
+				}
+			}
+			select {
+			case <-r.closeChan:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close - stops the relay and waits for the batch being relayed
+func (r *Relay) Close() {
+	close(r.closeChan)
+	r.wg.Wait()
+}
+
+// RelayOnce - publishes the events due at now and returns how many were claimed
+func (r *Relay) RelayOnce(now time.Time) (int, error) {
+	r.setDefaults()
+	events, err := r.Store.Claim(now, r.LeaseTime, r.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var published []int64
+	for _, event := range events {
+		if err = r.Publisher.Publish(event); err != nil {
+			attempts := event.Attempts + 1
+			nextAttemptAt := now.Add(r.backoff(attempts))
+			r.Log.WithError(err).WithFields(logrus.Fields{
+				"call_id":  event.CallID,
+				"attempts": attempts,
+			}).Warn("Unable to publish outbox event, retrying later")
+			if err = r.Store.Retry(event.ID, attempts, nextAttemptAt); err != nil {
+				r.Log.WithError(err).WithField("call_id", event.CallID).Error("Unable to reschedule outbox event")
+			}
+			continue
+		}
+		published = append(published, event.ID)
+	}
+	// events whose delete fails are published again once their lease expires
+	return len(events), r.Store.Delete(published)
+}
+
+// backoff - returns the delay before an attempt, doubling from the poll interval up to max backoff
+func (r *Relay) backoff(attempts int) time.Duration {
+	delay := r.PollInterval
+	for i := 1; i < attempts && delay < r.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.MaxBackoff {
+		return r.MaxBackoff
+	}
+	return delay
+}
+
+// setDefaults - fills in unset options
+func (r *Relay) setDefaults() {
+	if r.PollInterval <= 0 {
+		r.PollInterval = defaultPollInterval
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = defaultMaxBackoff
+	}
+	if r.LeaseTime <= 0 {
+		r.LeaseTime = defaultLeaseTime
+	}
+	if r.BatchSize <= 0 {
+		r.BatchSize = defaultBatchSize
+	}
+}
@@ -0,0 +1,146 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	dataAdapters "go-worker/data_adapters"
+)
+
+// mockStore - holds outbox events in memory
+type mockStore struct {
+	events  map[int64]dataAdapters.OutboxEvent
+	deleted []int64
+}
+
+// mockSQS - records sent messages and fails the configured call ids
+type mockSQS struct {
+	sqsiface.SQSAPI
+	sent    []*sqs.SendMessageInput
+	failIDs map[string]bool
+}
+
+// TestPositiveRelay - tests published events are sent with their attributes and deleted
+func TestPositiveRelay(t *testing.T) {
+	check := assert.New(t)
+	store, mocksqs, relay := getRelay()
+	now := time.Now()
+
+	claimed, err := relay.RelayOnce(now)
+	check.NoError(err)
+	check.Equal(2, claimed)
+	check.Len(mocksqs.sent, 2)
+	check.ElementsMatch([]int64{1, 2}, store.deleted)
+	check.Empty(store.events)
+
+	message := mocksqs.sent[0]
+	check.Equal(`{"call_id": "1"}`, aws.StringValue(message.MessageBody))
+	check.Equal(dataAdapters.CallBilledEventType, aws.StringValue(message.MessageAttributes[EventTypeAttribute].StringValue))
+	check.Equal("1", aws.StringValue(message.MessageAttributes[CallIDAttribute].StringValue))
+}
+
+// TestNegativeRelay - tests failed events are kept and retried with growing delays
+func TestNegativeRelay(t *testing.T) {
+	check := assert.New(t)
+	store, mocksqs, relay := getRelay()
+	mocksqs.failIDs = map[string]bool{"2": true}
+	now := time.Now()
+
+	_, err := relay.RelayOnce(now)
+	check.NoError(err)
+	check.Equal([]int64{1}, store.deleted)
+	failed := store.events[2]
+	check.Equal(1, failed.Attempts)
+	check.Equal(now.Add(time.Second).UnixNano(), failed.NextAttemptAt)
+
+	// not due yet
+	claimed, err := relay.RelayOnce(now)
+	check.NoError(err)
+	check.Zero(claimed)
+
+	now = now.Add(time.Second)
+	_, err = relay.RelayOnce(now)
+	check.NoError(err)
+	check.Equal(2, store.events[2].Attempts)
+	check.Equal(now.Add(2*time.Second).UnixNano(), store.events[2].NextAttemptAt)
+
+	check.Equal(4*time.Second, relay.backoff(10))
+
+	// the event is published once the queue accepts it
+	mocksqs.failIDs = nil
+	_, err = relay.RelayOnce(now.Add(2 * time.Second))
+	check.NoError(err)
+	check.Empty(store.events)
+}
+
+// getRelay - returns a relay over two pending events
+func getRelay() (*mockStore, *mockSQS, *Relay) {
+	store := &mockStore{events: map[int64]dataAdapters.OutboxEvent{}}
+	for _, id := range []int64{1, 2} {
+		callID := string(rune('0' + id))
+		store.events[id] = dataAdapters.OutboxEvent{
+			ID:        id,
+			EventType: dataAdapters.CallBilledEventType,
+			CallID:    callID,
+			Payload:   `{"call_id": "` + callID + `"}`,
+		}
+	}
+	mocksqs := &mockSQS{}
+	relay := &Relay{
+		Store:        store,
+		Publisher:    &QueuePublisher{Client: mocksqs, QueueURL: "https://queue.amazonaws.com/88888EXAMPLE/billed-calls"},
+		PollInterval: time.Second,
+		MaxBackoff:   4 * time.Second,
+		Log:          logrus.NewEntry(logrus.New()),
+	}
+	return store, mocksqs, relay
+}
+
+// Claim - returns the due events in id order, leasing them
+func (s *mockStore) Claim(now time.Time, lease time.Duration, limit int) ([]dataAdapters.OutboxEvent, error) {
+	var claimed []dataAdapters.OutboxEvent
+	for id := int64(1); id <= 2 && len(claimed) < limit; id++ {
+		event, ok := s.events[id]
+		if !ok || event.NextAttemptAt > now.UnixNano() {
+			continue
+		}
+		event.NextAttemptAt = now.Add(lease).UnixNano()
+		s.events[id] = event
+		claimed = append(claimed, event)
+	}
+	return claimed, nil
+}
+
+// Delete - removes published events
+func (s *mockStore) Delete(ids []int64) error {
+	for _, id := range ids {
+		delete(s.events, id)
+	}
+	s.deleted = append(s.deleted, ids...)
+	return nil
+}
+
+// Retry - reschedules a failed event
+func (s *mockStore) Retry(id int64, attempts int, nextAttemptAt time.Time) error {
+	event := s.events[id]
+	event.Attempts = attempts
+	event.NextAttemptAt = nextAttemptAt.UnixNano()
+	s.events[id] = event
+	return nil
+}
+
+// SendMessage - records a message or fails it when its call id is in failIDs
+func (m *mockSQS) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	if m.failIDs[aws.StringValue(input.MessageAttributes[CallIDAttribute].StringValue)] {
+		return nil, errors.New("service unavailable")
+	}
+	m.sent = append(m.sent, input)
+	return &sqs.SendMessageOutput{MessageId: aws.String("id")}, nil
+}
@@ -0,0 +1,280 @@
+package producer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"go-worker/claimcheck"
+	"go-worker/config"
+	"go-worker/models"
+	"go-worker/queue"
+	"go-worker/schema"
+	"go-worker/signing"
+	"go-worker/utils"
+	"go-worker/validation"
+)
+
+const (
+	// MaxBatchSize - maximum number of entries sqs accepts in one SendMessageBatch call
+	MaxBatchSize = 10
+	// MaxDelaySeconds - maximum delivery delay sqs accepts for a message
+	MaxDelaySeconds = 900
+	// MaxMessageAttributes - maximum number of message attributes sqs accepts for a message
+	MaxMessageAttributes = 10
+	// MaxBatchBytes - maximum total size of the messages in one SendMessageBatch call
+	MaxBatchBytes = 256 * 1024
+	// fifoSuffix - suffix of sqs fifo queue urls
+	fifoSuffix = ".fifo"
+	// stringDataType - sqs data type for string message attributes
+	stringDataType = "String"
+)
+
+// Message - holds a billing event along with its delivery options
+type Message struct {
+	Event           models.BillingEvent
+	DelaySeconds    int64
+	Attributes      map[string]string
+	GroupID         string
+	DeduplicationID string
+}
+
+// FailedMessage - holds a message which could not be published and the reason
+type FailedMessage struct {
+	Message Message
+	Reason  string
+}
+
+// Producer - holds customizable fields to publish billing events
+// bodies over the claim check threshold are offloaded when ClaimCheck is set
+// and events are signed when Signer has a signing key
+type Producer struct {
+	SQSClient  sqsiface.SQSAPI
+	SQSURL     string
+	BatchSize  int
+	ClaimCheck *claimcheck.Checker
+	Signer     *signing.Keyring
+	Log        *logrus.Entry
+}
+
+// NewProducer - returns a new object for Producer
+func NewProducer(log *logrus.Entry) (*Producer, error) {
+	cfg := config.GetConfig()
+	queueURL := utils.GetValue(cfg.GetString("producer.url"), cfg.GetString("sqs.url")).(string)
+	svc, err := queue.New(queueURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create queue client")
+	}
+	checker, err := claimcheck.NewChecker()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create claim check store")
+	}
+	signer, err := signing.NewKeyring()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load signing keys")
+	}
+	producer := &Producer{
+		SQSClient:  svc,
+		SQSURL:     queueURL,
+		BatchSize:  utils.GetValue(cfg.GetInt("producer.batch_size"), MaxBatchSize).(int),
+		ClaimCheck: checker,
+		Signer:     signer,
+		Log:        log,
+	}
+	return producer, nil
+}
+
+// IsFIFO - returns true if the producer publishes to a fifo queue
+func (p *Producer) IsFIFO() bool {
+	return strings.HasSuffix(p.SQSURL, fifoSuffix)
+}
+
+// Publish - validates the messages and publishes them in batches
+// it returns the messages which failed along with an error if there were any
+func (p *Producer) Publish(messages []Message) ([]FailedMessage, error) {
+	var failed []FailedMessage
+	var batch []Message
+
+	batchSize := p.BatchSize
+	if batchSize <= 0 || batchSize > MaxBatchSize {
+		batchSize = MaxBatchSize
+	}
+	for _, message := range messages {
+		if err := p.Validate(message); err != nil {
+			failed = append(failed, FailedMessage{Message: message, Reason: err.Error()})
+			continue
+		}
+		batch = append(batch, message)
+		if len(batch) == batchSize {
+			failed = append(failed, p.sendBatch(batch)...)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		failed = append(failed, p.sendBatch(batch)...)
+	}
+
+	if len(failed) > 0 {
+		return failed, errors.Errorf("%d of %d messages failed to publish", len(failed), len(messages))
+	}
+	return nil, nil
+}
+
+// Validate - checks whether a message can be published
+func (p *Producer) Validate(message Message) error {
+	if err := validation.ValidateEvent(message.Event); err != nil {
+		return err
+	}
+	if message.DelaySeconds < 0 || message.DelaySeconds > MaxDelaySeconds {
+		return errors.Errorf("delay seconds must be between 0 and %d", MaxDelaySeconds)
+	}
+	maxAttributes := MaxMessageAttributes
+	if p.Signer.CanSign() {
+		maxAttributes -= signing.AttributeCount
+	}
+	if len(message.Attributes) > maxAttributes {
+		return errors.Errorf("at most %d message attributes are allowed", maxAttributes)
+	}
+	if p.IsFIFO() {
+		if message.DelaySeconds > 0 {
+			return errors.New("per message delay is not supported on fifo queues")
+		}
+	} else if message.GroupID != "" || message.DeduplicationID != "" {
+		return errors.New("group and deduplication ids are only supported on fifo queues")
+	}
+	return nil
+}
+
+// sendBatch - publishes a batch, split further when it exceeds the sqs batch size limit,
+// and returns the messages sqs rejected
+func (p *Producer) sendBatch(batch []Message) []FailedMessage {
+	var failed []FailedMessage
+	var entries []*sqs.SendMessageBatchRequestEntry
+	var size int
+
+	for i, message := range batch {
+		entry, err := p.prepareEntry(strconv.Itoa(i), message)
+		if err != nil {
+			failed = append(failed, FailedMessage{Message: message, Reason: err.Error()})
+			continue
+		}
+		entrySize := entryBytes(entry)
+		if len(entries) > 0 && size+entrySize > MaxBatchBytes {
+			failed = append(failed, p.sendEntries(batch, entries)...)
+			entries, size = nil, 0
+		}
+		entries = append(entries, entry)
+		size += entrySize
+	}
+	if len(entries) > 0 {
+		failed = append(failed, p.sendEntries(batch, entries)...)
+	}
+	return failed
+}
+
+// sendEntries - publishes prepared entries of a batch in one call and returns the messages sqs rejected
+func (p *Producer) sendEntries(batch []Message, entries []*sqs.SendMessageBatchRequestEntry) []FailedMessage {
+	var failed []FailedMessage
+	resp, err := p.SQSClient.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(p.SQSURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		p.Log.WithError(err).Error("Unable to publish messages to sqs")
+		for _, entry := range entries {
+			failed = append(failed, FailedMessage{Message: batch[entryIndex(entry.Id)], Reason: err.Error()})
+		}
+		return failed
+	}
+	for _, failedEntry := range resp.Failed {
+		message := batch[entryIndex(failedEntry.Id)]
+		p.Log.WithFields(logrus.Fields{
+			"Code":        aws.StringValue(failedEntry.Code),
+			"call_id":     message.Event.CallID,
+			"Message":     aws.StringValue(failedEntry.Message),
+			"SenderFault": aws.BoolValue(failedEntry.SenderFault),
+		}).Error("Error while publishing sqs message")
+		failed = append(failed, FailedMessage{
+			Message: message,
+			Reason:  fmt.Sprintf("%s: %s", aws.StringValue(failedEntry.Code), aws.StringValue(failedEntry.Message)),
+		})
+	}
+	p.Log.WithField("count", len(entries)-len(resp.Failed)).Debug("Published messages to sqs")
+	return failed
+}
+
+// prepareEntry - converts a message to a sqs batch entry
+func (p *Producer) prepareEntry(id string, message Message) (*sqs.SendMessageBatchRequestEntry, error) {
+	event := message.Event
+	event.SchemaVersion = schema.CurrentVersion
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	messageBody := string(body)
+	attributes := message.Attributes
+	if p.Signer.CanSign() {
+		// sign the event itself so the signature survives claim checks
+		signature, err := p.Signer.Sign(messageBody, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		attributes = make(map[string]string, len(message.Attributes)+len(signature))
+		for key, value := range message.Attributes {
+			attributes[key] = value
+		}
+		for key, value := range signature {
+			attributes[key] = value
+		}
+	}
+	if p.ClaimCheck != nil {
+		if messageBody, err = p.ClaimCheck.Offload(messageBody); err != nil {
+			return nil, err
+		}
+	}
+	entry := &sqs.SendMessageBatchRequestEntry{
+		Id:          aws.String(id),
+		MessageBody: aws.String(messageBody),
+	}
+	if message.DelaySeconds > 0 {
+		entry.DelaySeconds = aws.Int64(message.DelaySeconds)
+	}
+	if len(attributes) > 0 {
+		entry.MessageAttributes = make(map[string]*sqs.MessageAttributeValue, len(attributes))
+		for key, value := range attributes {
+			entry.MessageAttributes[key] = &sqs.MessageAttributeValue{
+				DataType:    aws.String(stringDataType),
+				StringValue: aws.String(value),
+			}
+		}
+	}
+	if p.IsFIFO() {
+		// keep the calls of a user ordered and let sqs drop republished calls by default
+		entry.MessageGroupId = aws.String(utils.GetValue(message.GroupID, strconv.Itoa(message.Event.UserID)).(string))
+		entry.MessageDeduplicationId = aws.String(utils.GetValue(message.DeduplicationID, message.Event.CallID).(string))
+	}
+	return entry, nil
+}
+
+// entryBytes - returns the size sqs counts for an entry, its body plus its attribute names, types and values
+func entryBytes(entry *sqs.SendMessageBatchRequestEntry) int {
+	size := len(aws.StringValue(entry.MessageBody))
+	for name, value := range entry.MessageAttributes {
+		size += len(name) + len(aws.StringValue(value.DataType)) + len(aws.StringValue(value.StringValue))
+	}
+	return size
+}
+
+// entryIndex - returns the batch index encoded in a sqs batch entry id
+func entryIndex(id *string) int {
+	index, _ := strconv.Atoi(aws.StringValue(id))
+	return index
+}
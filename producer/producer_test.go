@@ -0,0 +1,207 @@
+package producer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/claimcheck"
+	"go-worker/models"
+	"go-worker/signing"
+)
+
+var queueURL = "https://queue.amazonaws.com/88888EXAMPLE/MyQueue"
+
+// mockSQS - holds sqs mocking info
+type mockSQS struct {
+	sqsiface.SQSAPI
+	batches []*sqs.SendMessageBatchInput
+	failIDs map[string]bool
+}
+
+// TestPositivePublish - tests publishing events in batches
+func TestPositivePublish(t *testing.T) {
+	check := assert.New(t)
+	mocksqs, p := getMockProducer(queueURL)
+
+	var messages []Message
+	for i := 0; i < 12; i++ {
+		messages = append(messages, Message{Event: getBillingEvent(), Attributes: map[string]string{"source": "test"}})
+	}
+	messages[0].DelaySeconds = 30
+
+	failed, err := p.Publish(messages)
+	check.NoError(err)
+	check.Empty(failed)
+	check.Len(mocksqs.batches, 2)
+	check.Len(mocksqs.batches[0].Entries, MaxBatchSize)
+	check.Len(mocksqs.batches[1].Entries, 2)
+
+	entry := mocksqs.batches[0].Entries[0]
+	check.Equal(int64(30), aws.Int64Value(entry.DelaySeconds))
+	check.Equal("test", aws.StringValue(entry.MessageAttributes["source"].StringValue))
+	check.Nil(entry.MessageGroupId)
+	check.JSONEq(`{"schema_version":2,"user_id":1,"product_id":2,"call_id":"e21b0dda-6566-402a-8f8c-0657e5b87eeb",
+		"answer_time":"2021-07-01 00:30:00","hangup_time":"2021-07-01 01:00:00"}`, aws.StringValue(entry.MessageBody))
+}
+
+// TestPositivePublishFIFO - tests group and deduplication ids on fifo queues
+func TestPositivePublishFIFO(t *testing.T) {
+	check := assert.New(t)
+	mocksqs, p := getMockProducer(queueURL + ".fifo")
+
+	failed, err := p.Publish([]Message{
+		{Event: getBillingEvent()},
+		{Event: getBillingEvent(), GroupID: "group", DeduplicationID: "dedup"},
+	})
+	check.NoError(err)
+	check.Empty(failed)
+
+	entries := mocksqs.batches[0].Entries
+	check.Equal("1", aws.StringValue(entries[0].MessageGroupId))
+	check.Equal("e21b0dda-6566-402a-8f8c-0657e5b87eeb", aws.StringValue(entries[0].MessageDeduplicationId))
+	check.Equal("group", aws.StringValue(entries[1].MessageGroupId))
+	check.Equal("dedup", aws.StringValue(entries[1].MessageDeduplicationId))
+}
+
+// TestNegativePublish - tests invalid and rejected messages are reported
+func TestNegativePublish(t *testing.T) {
+	check := assert.New(t)
+	mocksqs, p := getMockProducer(queueURL)
+	mocksqs.failIDs = map[string]bool{"1": true}
+
+	invalid := getBillingEvent()
+	invalid.CallID = ""
+	failed, err := p.Publish([]Message{
+		{Event: getBillingEvent()},
+		{Event: getBillingEvent()},
+		{Event: invalid},
+		{Event: getBillingEvent(), DelaySeconds: MaxDelaySeconds + 1},
+		{Event: getBillingEvent(), GroupID: "group"},
+	})
+	check.Error(err)
+	check.Len(failed, 4)
+	check.Equal("call_id is required", failed[0].Reason)
+	check.Contains(failed[1].Reason, "delay seconds")
+	check.Contains(failed[2].Reason, "fifo")
+	check.Contains(failed[3].Reason, "InvalidParameterValue")
+	check.Len(mocksqs.batches[0].Entries, 2)
+}
+
+// TestPositivePublishClaimCheck - tests large events are offloaded and batches are split by size
+func TestPositivePublishClaimCheck(t *testing.T) {
+	check := assert.New(t)
+	mocksqs, p := getMockProducer(queueURL)
+
+	large := getBillingEvent()
+	large.CDR = json.RawMessage(`"` + strings.Repeat("x", 100*1024) + `"`)
+	var messages []Message
+	for i := 0; i < 3; i++ {
+		messages = append(messages, Message{Event: large})
+	}
+
+	// without a claim check store the large events are split across batches
+	failed, err := p.Publish(messages)
+	check.NoError(err)
+	check.Empty(failed)
+	check.Len(mocksqs.batches, 2)
+	check.Len(mocksqs.batches[0].Entries, 2)
+
+	// with one they are sent as pointers in a single batch
+	mocksqs.batches = nil
+	p.ClaimCheck, err = claimcheck.NewStoreChecker("file://"+t.TempDir(), 64*1024)
+	check.NoError(err)
+	failed, err = p.Publish(append(messages, Message{Event: getBillingEvent()}))
+	check.NoError(err)
+	check.Empty(failed)
+	check.Len(mocksqs.batches, 1)
+
+	entries := mocksqs.batches[0].Entries
+	body, pointer, err := p.ClaimCheck.Resolve(aws.StringValue(entries[0].MessageBody))
+	check.NoError(err)
+	check.NotNil(pointer)
+	check.Contains(body, large.CallID)
+	_, pointer, _ = p.ClaimCheck.Resolve(aws.StringValue(entries[3].MessageBody))
+	check.Nil(pointer)
+}
+
+// TestPositivePublishSigned - tests events are signed with the signing key and leave room for the signature attributes
+func TestPositivePublishSigned(t *testing.T) {
+	check := assert.New(t)
+	mocksqs, p := getMockProducer(queueURL)
+	p.Signer = &signing.Keyring{Keys: map[string][]byte{"k1": []byte("secret")}, SigningKeyID: "k1", MaxAge: time.Minute}
+
+	attributes := map[string]string{}
+	for i := 0; i < MaxMessageAttributes-signing.AttributeCount; i++ {
+		attributes[strings.Repeat("a", i+1)] = "value"
+	}
+	tooMany := map[string]string{"extra": "value"}
+	for key, value := range attributes {
+		tooMany[key] = value
+	}
+	failed, err := p.Publish([]Message{
+		{Event: getBillingEvent(), Attributes: attributes},
+		{Event: getBillingEvent(), Attributes: tooMany},
+	})
+	check.Error(err)
+	check.Len(failed, 1)
+	check.Contains(failed[0].Reason, "message attributes")
+
+	entry := mocksqs.batches[0].Entries[0]
+	check.Len(entry.MessageAttributes, MaxMessageAttributes)
+	signed := map[string]string{}
+	for key, value := range entry.MessageAttributes {
+		signed[key] = aws.StringValue(value.StringValue)
+	}
+	check.Equal("k1", signed[signing.KeyIDAttribute])
+	check.NoError(p.Signer.Verify(aws.StringValue(entry.MessageBody), signed, time.Now()))
+	check.Len(attributes, MaxMessageAttributes-signing.AttributeCount)
+}
+
+// getMockProducer - returns mocked sqs, producer
+func getMockProducer(url string) (*mockSQS, *Producer) {
+	mocksqs := &mockSQS{}
+	p := &Producer{
+		SQSClient: mocksqs,
+		SQSURL:    url,
+		BatchSize: MaxBatchSize,
+		Log:       logrus.New().WithField("test_producer", 1),
+	}
+	return mocksqs, p
+}
+
+// getBillingEvent - prepares a bill event
+func getBillingEvent() (billEvent models.BillingEvent) {
+	billEvent.CallID = "e21b0dda-6566-402a-8f8c-0657e5b87eeb"
+	billEvent.UserID = 1
+	billEvent.ProductID = 2
+	billEvent.AnswerTime = "2021-07-01 00:30:00"
+	billEvent.HangupTime = "2021-07-01 01:00:00"
+	return
+}
+
+// SendMessageBatch - mock function for publishing messages
+func (m *mockSQS) SendMessageBatch(in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	m.batches = append(m.batches, in)
+	output := &sqs.SendMessageBatchOutput{}
+	for _, entry := range in.Entries {
+		if m.failIDs[aws.StringValue(entry.Id)] {
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String("InvalidParameterValue"),
+				Message:     aws.String("rejected"),
+				SenderFault: aws.Bool(true),
+			})
+			continue
+		}
+		output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{Id: entry.Id})
+	}
+	return output, nil
+}
@@ -0,0 +1,639 @@
+package queue
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+	"go-worker/utils"
+)
+
+const (
+	// walFileName - name of the write-ahead log inside the queue directory
+	walFileName = "wal.log"
+	// lockFileName - name of the file locked by the process holding the queue directory
+	lockFileName = "lock"
+	// defaultVisibilityTimeout - visibility timeout in seconds when neither the request nor config sets one
+	defaultVisibilityTimeout = 30
+	// defaultCompactThreshold - number of obsolete log records which triggers a compaction
+	defaultCompactThreshold = 1000
+	// maxPollInterval - longest sleep of a long poll before the queue is checked again
+	maxPollInterval = 100 * time.Millisecond
+
+	// write-ahead log operations
+	opSend       = "send"
+	opReceive    = "receive"
+	opVisibility = "visibility"
+	opDelete     = "delete"
+
+	// maxBatchEntries - maximum number of entries in a batch request or messages in a receive
+	maxBatchEntries = 10
+	// errInvalidParameterValue - sqs error code for out of range request parameters
+	errInvalidParameterValue = "InvalidParameterValue"
+)
+
+// FileQueueOptions - holds customizable fields of a file backed queue
+type FileQueueOptions struct {
+	VisibilityTimeout int64
+	Sync              bool
+	CompactThreshold  int
+}
+
+// NewFileQueueOptions - returns file queue options from config
+func NewFileQueueOptions() FileQueueOptions {
+	cfg := config.GetConfig()
+	return FileQueueOptions{
+		VisibilityTimeout: cfg.GetInt64("file_queue.visibility_timeout"),
+		Sync:              cfg.GetBool("file_queue.sync"),
+		CompactThreshold:  cfg.GetInt("file_queue.compact_threshold"),
+	}
+}
+
+// fileRecord - holds a single write-ahead log entry
+type fileRecord struct {
+	Op            string                                `json:"op"`
+	ID            string                                `json:"id"`
+	Body          string                                `json:"body,omitempty"`
+	Attributes    map[string]*sqs.MessageAttributeValue `json:"attributes,omitempty"`
+	SentAt        int64                                 `json:"sent_at,omitempty"`
+	FirstReceived int64                                 `json:"first_received,omitempty"`
+	VisibleAt     int64                                 `json:"visible_at,omitempty"`
+	ReceiptHandle string                                `json:"receipt_handle,omitempty"`
+	ReceiveCount  int64                                 `json:"receive_count,omitempty"`
+}
+
+// FileQueue - queue which keeps messages in a local directory with a write-ahead log
+// it implements the subset of the sqs api used by the workers and the producer
+type FileQueue struct {
+	sqsiface.SQSAPI
+	dir      string
+	options  FileQueueOptions
+	dirLock  *os.File
+	wal      *os.File
+	messages map[string]*fileRecord
+	order    []string
+	obsolete int
+	notify   chan struct{}
+	lock     sync.Mutex
+}
+
+// NewMemoryQueue - returns a queue with the same semantics as a file queue which is never persisted
+func NewMemoryQueue(options FileQueueOptions) *FileQueue {
+	if options.VisibilityTimeout <= 0 {
+		options.VisibilityTimeout = defaultVisibilityTimeout
+	}
+	if options.CompactThreshold <= 0 {
+		options.CompactThreshold = defaultCompactThreshold
+	}
+	return &FileQueue{
+		options:  options,
+		messages: map[string]*fileRecord{},
+		notify:   make(chan struct{}),
+	}
+}
+
+// OpenFileQueue - opens the queue in dir, replaying its write-ahead log
+// only one process may open a queue directory, the directory stays locked until the queue is closed
+func OpenFileQueue(dir string, options FileQueueOptions) (*FileQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "unable to create queue directory")
+	}
+
+	dirLock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q := NewMemoryQueue(options)
+	q.dir = dir
+	q.dirLock = dirLock
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		dirLock.Close()
+		return nil, errors.Wrap(err, "unable to open write-ahead log")
+	}
+	if err = q.replay(wal); err != nil {
+		wal.Close()
+		dirLock.Close()
+		return nil, err
+	}
+	q.wal = wal
+	return q, nil
+}
+
+// Close - closes the write-ahead log and unlocks the queue directory
+func (q *FileQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.wal == nil {
+		return nil
+	}
+	err := q.wal.Close()
+	if lockErr := q.dirLock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+// SendMessage - appends a single message to the queue
+func (q *FileQueue) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	out, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: in.QueueUrl,
+		Entries: []*sqs.SendMessageBatchRequestEntry{{
+			Id:                aws.String("0"),
+			MessageBody:       in.MessageBody,
+			DelaySeconds:      in.DelaySeconds,
+			MessageAttributes: in.MessageAttributes,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sqs.SendMessageOutput{
+		MessageId:        out.Successful[0].MessageId,
+		MD5OfMessageBody: out.Successful[0].MD5OfMessageBody,
+	}, nil
+}
+
+// SendMessageBatch - appends messages to the queue
+func (q *FileQueue) SendMessageBatch(in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	ids := make([]*string, 0, len(in.Entries))
+	for _, entry := range in.Entries {
+		ids = append(ids, entry.Id)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	now := nowMillis()
+	out := &sqs.SendMessageBatchOutput{}
+	records := make([]*fileRecord, 0, len(in.Entries))
+	for _, entry := range in.Entries {
+		record := &fileRecord{
+			Op:         opSend,
+			ID:         utils.GetTransactionID(),
+			Body:       aws.StringValue(entry.MessageBody),
+			Attributes: entry.MessageAttributes,
+			SentAt:     now,
+			VisibleAt:  now + aws.Int64Value(entry.DelaySeconds)*1000,
+		}
+		records = append(records, record)
+		out.Successful = append(out.Successful, &sqs.SendMessageBatchResultEntry{
+			Id:               entry.Id,
+			MessageId:        aws.String(record.ID),
+			MD5OfMessageBody: aws.String(md5Hex(record.Body)),
+		})
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.append(records...); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		q.apply(record)
+	}
+	q.wake()
+	return out, nil
+}
+
+// ReceiveMessage - returns visible messages, waiting up to the wait time for them to arrive
+func (q *FileQueue) ReceiveMessage(in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	maxMessages := utils.GetValue(int(aws.Int64Value(in.MaxNumberOfMessages)), 1).(int)
+	if maxMessages < 1 || maxMessages > maxBatchEntries {
+		return nil, awserr.New(errInvalidParameterValue, "MaxNumberOfMessages must be between 1 and 10", nil)
+	}
+	visibility := q.options.VisibilityTimeout
+	if in.VisibilityTimeout != nil {
+		visibility = aws.Int64Value(in.VisibilityTimeout)
+	}
+	deadline := time.Now().Add(time.Duration(aws.Int64Value(in.WaitTimeSeconds)) * time.Second)
+
+	for {
+		q.lock.Lock()
+		messages, err := q.receive(maxMessages, visibility, in.MessageAttributeNames)
+		notify := q.notify
+		q.lock.Unlock()
+		if err != nil || len(messages) > 0 {
+			return &sqs.ReceiveMessageOutput{Messages: messages}, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return &sqs.ReceiveMessageOutput{}, nil
+		}
+		// delayed and in flight messages become visible without a notification, so poll
+		if remaining > maxPollInterval {
+			remaining = maxPollInterval
+		}
+		select {
+		case <-notify:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// DeleteMessage - acknowledges a single message
+func (q *FileQueue) DeleteMessage(in *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	out, err := q.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: in.QueueUrl,
+		Entries:  []*sqs.DeleteMessageBatchRequestEntry{{Id: aws.String("0"), ReceiptHandle: in.ReceiptHandle}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Failed) > 0 {
+		return nil, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, aws.StringValue(out.Failed[0].Message), nil)
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// DeleteMessageBatch - acknowledges messages by their receipt handles
+func (q *FileQueue) DeleteMessageBatch(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	ids := make([]*string, 0, len(in.Entries))
+	for _, entry := range in.Entries {
+		ids = append(ids, entry.Id)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	out := &sqs.DeleteMessageBatchOutput{}
+	var records []*fileRecord
+	for _, entry := range in.Entries {
+		message := q.findByReceipt(aws.StringValue(entry.ReceiptHandle))
+		if message == nil {
+			out.Failed = append(out.Failed, invalidReceiptEntry(entry.Id))
+			continue
+		}
+		records = append(records, &fileRecord{Op: opDelete, ID: message.ID})
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+	if err := q.append(records...); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		q.apply(record)
+	}
+	return out, q.compactIfNeeded()
+}
+
+// ChangeMessageVisibility - extends or shortens the visibility timeout of a received message
+// a timeout of zero makes the message visible again straight away (nack)
+func (q *FileQueue) ChangeMessageVisibility(in *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	message := q.findByReceipt(aws.StringValue(in.ReceiptHandle))
+	if message == nil {
+		return nil, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, "receipt handle is not valid", nil)
+	}
+	record := &fileRecord{
+		Op:            opVisibility,
+		ID:            message.ID,
+		ReceiptHandle: message.ReceiptHandle,
+		VisibleAt:     nowMillis() + aws.Int64Value(in.VisibilityTimeout)*1000,
+	}
+	if err := q.append(record); err != nil {
+		return nil, err
+	}
+	q.apply(record)
+	q.wake()
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// GetQueueAttributes - returns approximate message counts of the queue
+func (q *FileQueue) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := nowMillis()
+	var visible, inFlight, delayed int
+	for _, message := range q.messages {
+		switch {
+		case message.VisibleAt <= now:
+			visible++
+		case message.ReceiveCount > 0:
+			inFlight++
+		default:
+			delayed++
+		}
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]*string{
+		sqs.QueueAttributeNameApproximateNumberOfMessages:           aws.String(strconv.Itoa(visible)),
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: aws.String(strconv.Itoa(inFlight)),
+		sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed:    aws.String(strconv.Itoa(delayed)),
+		sqs.QueueAttributeNameVisibilityTimeout:                     aws.String(strconv.FormatInt(q.options.VisibilityTimeout, 10)),
+	}}, nil
+}
+
+// receive - marks up to maxMessages visible messages as in flight, callers must hold the lock
+func (q *FileQueue) receive(maxMessages int, visibility int64, attributeNames []*string) ([]*sqs.Message, error) {
+	now := nowMillis()
+	var records []*fileRecord
+	live := q.order[:0]
+	for _, id := range q.order {
+		message, ok := q.messages[id]
+		if !ok {
+			continue
+		}
+		live = append(live, id)
+		if len(records) == maxMessages || message.VisibleAt > now {
+			continue
+		}
+		firstReceived := message.FirstReceived
+		if firstReceived == 0 {
+			firstReceived = now
+		}
+		records = append(records, &fileRecord{
+			Op:            opReceive,
+			ID:            id,
+			ReceiptHandle: utils.GetTransactionID(),
+			FirstReceived: firstReceived,
+			VisibleAt:     now + visibility*1000,
+			ReceiveCount:  message.ReceiveCount + 1,
+		})
+	}
+	q.order = live
+	if len(records) == 0 {
+		return nil, nil
+	}
+	if err := q.append(records...); err != nil {
+		return nil, err
+	}
+
+	messages := make([]*sqs.Message, 0, len(records))
+	for _, record := range records {
+		q.apply(record)
+		messages = append(messages, q.messages[record.ID].toMessage(attributeNames))
+	}
+	return messages, nil
+}
+
+// findByReceipt - returns the message currently held with the receipt handle
+func (q *FileQueue) findByReceipt(receiptHandle string) *fileRecord {
+	if receiptHandle == "" {
+		return nil
+	}
+	for _, message := range q.messages {
+		if message.ReceiptHandle == receiptHandle {
+			return message
+		}
+	}
+	return nil
+}
+
+// apply - applies a log record to the in memory state
+func (q *FileQueue) apply(record *fileRecord) {
+	switch record.Op {
+	case opSend:
+		if _, ok := q.messages[record.ID]; !ok {
+			q.order = append(q.order, record.ID)
+		}
+		q.messages[record.ID] = record
+		return
+	case opReceive:
+		if message, ok := q.messages[record.ID]; ok {
+			message.ReceiptHandle = record.ReceiptHandle
+			message.VisibleAt = record.VisibleAt
+			message.ReceiveCount = record.ReceiveCount
+			message.FirstReceived = record.FirstReceived
+		}
+	case opVisibility:
+		if message, ok := q.messages[record.ID]; ok && message.ReceiptHandle == record.ReceiptHandle {
+			message.VisibleAt = record.VisibleAt
+		}
+	case opDelete:
+		if _, ok := q.messages[record.ID]; ok {
+			delete(q.messages, record.ID)
+			// the delete record and the send record are both obsolete now
+			q.obsolete++
+		}
+	}
+	q.obsolete++
+}
+
+// append - writes records to the write-ahead log, callers must hold the lock
+func (q *FileQueue) append(records ...*fileRecord) error {
+	if len(records) == 0 || q.wal == nil {
+		return nil
+	}
+	var buf []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := q.wal.Write(buf); err != nil {
+		return errors.Wrap(err, "unable to write to write-ahead log")
+	}
+	if q.options.Sync {
+		return q.wal.Sync()
+	}
+	return nil
+}
+
+// replay - rebuilds the queue state from the write-ahead log
+// a torn record at the end of the log, left by a crash mid write, is truncated
+func (q *FileQueue) replay(wal *os.File) error {
+	reader := bufio.NewReader(wal)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				if truncErr := wal.Truncate(offset); truncErr != nil {
+					return errors.Wrap(truncErr, "unable to truncate torn write-ahead log record")
+				}
+			}
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to read write-ahead log")
+		}
+		record := &fileRecord{}
+		if err = json.Unmarshal(line, record); err != nil {
+			return errors.Wrapf(err, "corrupt write-ahead log record at offset %d", offset)
+		}
+		q.apply(record)
+		offset += int64(len(line))
+	}
+	_, err := wal.Seek(offset, io.SeekStart)
+	return err
+}
+
+// compactIfNeeded - rewrites the log with only the live messages once enough records are obsolete
+func (q *FileQueue) compactIfNeeded() error {
+	if q.obsolete < q.options.CompactThreshold || q.wal == nil {
+		return nil
+	}
+	return q.compact()
+}
+
+// compact - atomically replaces the log with one send record per live message
+func (q *FileQueue) compact() error {
+	path := filepath.Join(q.dir, walFileName)
+	tmp, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "unable to create compacted log")
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, id := range q.order {
+		if message, ok := q.messages[id]; ok {
+			snapshot := *message
+			snapshot.Op = opSend
+			if err = encoder.Encode(&snapshot); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "unable to write compacted log")
+	}
+
+	q.wal.Close()
+	q.wal = tmp
+	q.obsolete = 0
+	return syncDir(q.dir)
+}
+
+// wake - wakes up receivers waiting for messages, callers must hold the lock
+func (q *FileQueue) wake() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// toMessage - converts a stored message to a sqs message
+func (r *fileRecord) toMessage(attributeNames []*string) *sqs.Message {
+	message := &sqs.Message{
+		MessageId:     aws.String(r.ID),
+		ReceiptHandle: aws.String(r.ReceiptHandle),
+		Body:          aws.String(r.Body),
+		MD5OfBody:     aws.String(md5Hex(r.Body)),
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameSentTimestamp:                    aws.String(strconv.FormatInt(r.SentAt, 10)),
+			sqs.MessageSystemAttributeNameApproximateReceiveCount:          aws.String(strconv.FormatInt(r.ReceiveCount, 10)),
+			sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp: aws.String(strconv.FormatInt(r.FirstReceived, 10)),
+		},
+	}
+	message.MessageAttributes = filterAttributes(r.Attributes, attributeNames)
+	return message
+}
+
+// filterAttributes - returns the message attributes requested by name, All or .* selects every attribute
+func filterAttributes(attributes map[string]*sqs.MessageAttributeValue, names []*string) map[string]*sqs.MessageAttributeValue {
+	if len(attributes) == 0 || len(names) == 0 {
+		return nil
+	}
+	filtered := map[string]*sqs.MessageAttributeValue{}
+	for _, name := range names {
+		switch aws.StringValue(name) {
+		case sqs.QueueAttributeNameAll, ".*":
+			return attributes
+		default:
+			if value, ok := attributes[aws.StringValue(name)]; ok {
+				filtered[aws.StringValue(name)] = value
+			}
+		}
+	}
+	return filtered
+}
+
+// validateBatch - checks a batch request has between 1 and 10 entries with distinct ids
+func validateBatch(ids []*string) error {
+	switch {
+	case len(ids) == 0:
+		return awserr.New(sqs.ErrCodeEmptyBatchRequest, "there should be at least one entry in the request", nil)
+	case len(ids) > maxBatchEntries:
+		return awserr.New(sqs.ErrCodeTooManyEntriesInBatchRequest, "maximum number of entries per request are 10", nil)
+	}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id == nil || aws.StringValue(id) == "" {
+			return awserr.New(sqs.ErrCodeInvalidBatchEntryId, "batch entry id is required", nil)
+		}
+		if seen[aws.StringValue(id)] {
+			return awserr.New(sqs.ErrCodeBatchEntryIdsNotDistinct, "id "+aws.StringValue(id)+" repeated", nil)
+		}
+		seen[aws.StringValue(id)] = true
+	}
+	return nil
+}
+
+// invalidReceiptEntry - returns a batch error entry for an invalid receipt handle
+func invalidReceiptEntry(id *string) *sqs.BatchResultErrorEntry {
+	return &sqs.BatchResultErrorEntry{
+		Id:          id,
+		Code:        aws.String(sqs.ErrCodeReceiptHandleIsInvalid),
+		Message:     aws.String("receipt handle is not valid"),
+		SenderFault: aws.Bool(true),
+	}
+}
+
+// lockDir - takes an exclusive lock on the queue directory, failing if another process holds it
+// the lock is on a file of its own, so compaction replacing the log does not release it
+func lockDir(dir string) (*os.File, error) {
+	lock, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open queue lock")
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.Errorf("queue directory %s is in use by another process", dir)
+		}
+		return nil, errors.Wrap(err, "unable to lock queue directory")
+	}
+	return lock, nil
+}
+
+// syncDir - flushes directory entries so a rename survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// md5Hex - returns the hex encoded md5 digest sqs reports for a body
+func md5Hex(body string) string {
+	sum := md5.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// nowMillis - returns the current unix time in milliseconds
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,202 @@
+package queue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+var fileQueueURL = "file:///tmp/billing-events"
+
+// TestPositiveFileQueue - tests send, receive and delete on a file queue
+func TestPositiveFileQueue(t *testing.T) {
+	check := assert.New(t)
+	q := getFileQueue(t, t.TempDir())
+	defer q.Close()
+
+	sendMessages(t, q, "first", "second")
+	out, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:              &fileQueueURL,
+		MaxNumberOfMessages:   aws.Int64(10),
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	})
+	check.NoError(err)
+	check.Len(out.Messages, 2)
+	check.Equal("first", aws.StringValue(out.Messages[0].Body))
+	check.Equal("test", aws.StringValue(out.Messages[0].MessageAttributes["source"].StringValue))
+	check.Equal("1", aws.StringValue(out.Messages[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+
+	// in flight messages are not received again
+	check.Empty(receiveMessages(t, q))
+
+	deleteOut, err := q.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: &fileQueueURL,
+		Entries: []*sqs.DeleteMessageBatchRequestEntry{
+			{Id: aws.String("0"), ReceiptHandle: out.Messages[0].ReceiptHandle},
+			{Id: aws.String("1"), ReceiptHandle: aws.String("stale")},
+		},
+	})
+	check.NoError(err)
+	check.Len(deleteOut.Successful, 1)
+	check.Len(deleteOut.Failed, 1)
+	check.Equal(sqs.ErrCodeReceiptHandleIsInvalid, aws.StringValue(deleteOut.Failed[0].Code))
+
+	attributes, _ := q.GetQueueAttributes(&sqs.GetQueueAttributesInput{QueueUrl: &fileQueueURL})
+	check.Equal("1", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible]))
+	check.Equal("0", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+}
+
+// TestPositiveFileQueueVisibility - tests nack and visibility expiry
+func TestPositiveFileQueueVisibility(t *testing.T) {
+	check := assert.New(t)
+	q := getFileQueue(t, t.TempDir())
+	defer q.Close()
+
+	sendMessages(t, q, "first")
+	messages := receiveMessages(t, q)
+	check.Len(messages, 1)
+
+	// nack makes the message visible straight away with a new receipt handle
+	_, err := q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &fileQueueURL,
+		ReceiptHandle:     messages[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	check.NoError(err)
+	redelivered := receiveMessages(t, q)
+	check.Len(redelivered, 1)
+	check.NotEqual(aws.StringValue(messages[0].ReceiptHandle), aws.StringValue(redelivered[0].ReceiptHandle))
+	check.Equal("2", aws.StringValue(redelivered[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+
+	// the old receipt handle can no longer change visibility
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &fileQueueURL,
+		ReceiptHandle:     messages[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	check.Error(err)
+
+	// long poll waits for the visibility timeout to expire
+	out, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:          &fileQueueURL,
+		VisibilityTimeout: aws.Int64(1),
+		WaitTimeSeconds:   aws.Int64(3),
+	})
+	check.NoError(err)
+	check.Len(out.Messages, 1)
+}
+
+// TestPositiveFileQueueRecovery - tests the queue survives a restart and a torn record
+func TestPositiveFileQueueRecovery(t *testing.T) {
+	check := assert.New(t)
+	dir := t.TempDir()
+	q := getFileQueue(t, dir)
+	sendMessages(t, q, "first", "second")
+	messages := receiveMessages(t, q)
+	_, err := q.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: &fileQueueURL, ReceiptHandle: messages[0].ReceiptHandle})
+	check.NoError(err)
+	check.NoError(q.Close())
+
+	// simulate a crash in the middle of writing a record
+	wal, _ := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY, 0o644)
+	_, _ = wal.WriteString(`{"op":"send","id":"torn"`)
+	wal.Close()
+
+	q = getFileQueue(t, dir)
+	defer q.Close()
+	// the second message is still in flight after the restart
+	check.Empty(receiveMessages(t, q))
+	out, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{QueueUrl: &fileQueueURL, WaitTimeSeconds: aws.Int64(3)})
+	check.NoError(err)
+	check.Len(out.Messages, 1)
+	check.Equal("second", aws.StringValue(out.Messages[0].Body))
+	check.Equal("2", aws.StringValue(out.Messages[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+}
+
+// TestPositiveFileQueueCompaction - tests acknowledged messages are dropped from the log
+func TestPositiveFileQueueCompaction(t *testing.T) {
+	check := assert.New(t)
+	dir := t.TempDir()
+	q, err := OpenFileQueue(dir, FileQueueOptions{CompactThreshold: 10})
+	check.NoError(err)
+
+	for i := 0; i < 6; i++ {
+		sendMessages(t, q, strconv.Itoa(i))
+		messages := receiveMessages(t, q)
+		_, err = q.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: &fileQueueURL, ReceiptHandle: messages[0].ReceiptHandle})
+		check.NoError(err)
+	}
+	sendMessages(t, q, "live")
+	check.NoError(q.Close())
+
+	// 19 records were written, the ones before the compaction are gone
+	wal, err := ioutil.ReadFile(filepath.Join(dir, walFileName))
+	check.NoError(err)
+	check.Less(bytes.Count(wal, []byte("\n")), 10)
+
+	q = getFileQueue(t, dir)
+	defer q.Close()
+	messages := receiveMessages(t, q)
+	check.Len(messages, 1)
+	check.Equal("live", aws.StringValue(messages[0].Body))
+}
+
+// TestNegativeFileQueueLocked - tests a queue directory can only be opened once at a time
+func TestNegativeFileQueueLocked(t *testing.T) {
+	check := assert.New(t)
+	dir := t.TempDir()
+	q := getFileQueue(t, dir)
+
+	_, err := OpenFileQueue(dir, FileQueueOptions{})
+	check.EqualError(err, "queue directory "+dir+" is in use by another process")
+
+	// the lock is kept across a compaction and released on close
+	check.NoError(q.compact())
+	_, err = OpenFileQueue(dir, FileQueueOptions{})
+	check.Error(err)
+	check.NoError(q.Close())
+	q = getFileQueue(t, dir)
+	check.NoError(q.Close())
+}
+
+// getFileQueue - opens a file queue with a short visibility timeout
+func getFileQueue(t *testing.T, dir string) *FileQueue {
+	q, err := OpenFileQueue(dir, FileQueueOptions{VisibilityTimeout: 1, Sync: true})
+	if err != nil {
+		t.Fatalf("unable to open file queue: %s", err)
+	}
+	return q
+}
+
+// sendMessages - sends messages with the given bodies
+func sendMessages(t *testing.T, q *FileQueue, bodies ...string) {
+	var entries []*sqs.SendMessageBatchRequestEntry
+	for i, body := range bodies {
+		entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.Itoa(i)),
+			MessageBody: aws.String(body),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"source": {DataType: aws.String("String"), StringValue: aws.String("test")},
+			},
+		})
+	}
+	if _, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{QueueUrl: &fileQueueURL, Entries: entries}); err != nil {
+		t.Fatalf("unable to send messages: %s", err)
+	}
+}
+
+// receiveMessages - receives visible messages without waiting
+func receiveMessages(t *testing.T, q *FileQueue) []*sqs.Message {
+	out, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{QueueUrl: &fileQueueURL, MaxNumberOfMessages: aws.Int64(10)})
+	if err != nil {
+		t.Fatalf("unable to receive messages: %s", err)
+	}
+	return out.Messages
+}
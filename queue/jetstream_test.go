@@ -0,0 +1,146 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPositiveNATSQueue - tests publish, fetch and ack on a jetstream consumer
+func TestPositiveNATSQueue(t *testing.T) {
+	check := assert.New(t)
+	ns, q := getNATSQueue(t)
+	defer ns.Shutdown()
+	defer q.Close()
+
+	out, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{Entries: []*sqs.SendMessageBatchRequestEntry{
+		{Id: aws.String("0"), MessageBody: aws.String("first"), MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"source": {DataType: aws.String("String"), StringValue: aws.String("test")},
+		}},
+		{Id: aws.String("1"), MessageBody: aws.String("second")},
+		{Id: aws.String("2"), MessageBody: aws.String("delayed"), DelaySeconds: aws.Int64(5)},
+	}})
+	check.NoError(err)
+	check.Len(out.Successful, 2)
+	check.Len(out.Failed, 1)
+
+	received, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{
+		MaxNumberOfMessages:   aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(1),
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	})
+	check.NoError(err)
+	check.Len(received.Messages, 2)
+	check.Equal("first", aws.StringValue(received.Messages[0].Body))
+	check.Equal("test", aws.StringValue(received.Messages[0].MessageAttributes["source"].StringValue))
+	check.Equal("1", aws.StringValue(received.Messages[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+
+	deleteOut, err := q.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{Entries: []*sqs.DeleteMessageBatchRequestEntry{
+		{Id: aws.String("0"), ReceiptHandle: received.Messages[0].ReceiptHandle},
+		{Id: aws.String("1"), ReceiptHandle: received.Messages[0].ReceiptHandle},
+	}})
+	check.NoError(err)
+	check.Len(deleteOut.Successful, 1)
+	check.Len(deleteOut.Failed, 1)
+
+	attributes, err := q.GetQueueAttributes(&sqs.GetQueueAttributesInput{})
+	check.NoError(err)
+	check.Equal("1", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible]))
+}
+
+// TestPositiveNATSQueueSendMessage - tests single messages are published like batch entries
+func TestPositiveNATSQueueSendMessage(t *testing.T) {
+	check := assert.New(t)
+	ns, q := getNATSQueue(t)
+	defer ns.Shutdown()
+	defer q.Close()
+
+	out, err := q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("single")})
+	check.NoError(err)
+	check.NotEmpty(aws.StringValue(out.MessageId))
+	_, err = q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("delayed"), DelaySeconds: aws.Int64(5)})
+	check.Error(err)
+
+	received := receiveNATS(t, q)
+	check.Len(received, 1)
+	check.Equal("single", aws.StringValue(received[0].Body))
+}
+
+// TestPositiveNATSQueueRedelivery - tests nak, in progress and terminate
+func TestPositiveNATSQueueRedelivery(t *testing.T) {
+	check := assert.New(t)
+	ns, q := getNATSQueue(t)
+	defer ns.Shutdown()
+	defer q.Close()
+
+	_, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{Entries: []*sqs.SendMessageBatchRequestEntry{
+		{Id: aws.String("0"), MessageBody: aws.String("first")},
+	}})
+	check.NoError(err)
+	received := receiveNATS(t, q)
+	check.Len(received, 1)
+
+	// in progress keeps the message from being redelivered
+	check.NoError(q.InProgress(aws.StringValue(received[0].ReceiptHandle)))
+	check.Empty(receiveNATS(t, q))
+
+	// nak redelivers straight away
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     received[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	check.NoError(err)
+	received = receiveNATS(t, q)
+	check.Len(received, 1)
+	check.Equal("2", aws.StringValue(received[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+
+	// a positive visibility timeout redelivers after the timeout
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     received[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(2),
+	})
+	check.NoError(err)
+	check.Empty(receiveNATS(t, q))
+	time.Sleep(1500 * time.Millisecond)
+	received = receiveNATS(t, q)
+	check.Len(received, 1)
+
+	// terminated messages are never redelivered
+	check.NoError(q.Terminate(aws.StringValue(received[0].ReceiptHandle)))
+	check.Error(q.Terminate(aws.StringValue(received[0].ReceiptHandle)))
+	check.Empty(receiveNATS(t, q))
+}
+
+// getNATSQueue - starts an embedded jetstream server and opens a queue on it
+func getNATSQueue(t *testing.T) (*server.Server, *NATSQueue) {
+	ns, err := server.NewServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("unable to create nats server: %s", err)
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	q, err := OpenNATSQueue(ns.ClientURL()+"/BILLING/go-worker", NATSQueueOptions{
+		Subject: "billing.events",
+		AckWait: 30 * time.Second,
+		Create:  true,
+	})
+	if err != nil {
+		t.Fatalf("unable to open nats queue: %s", err)
+	}
+	return ns, q
+}
+
+// receiveNATS - fetches messages waiting at most a second
+func receiveNATS(t *testing.T, q *NATSQueue) []*sqs.Message {
+	out, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10), WaitTimeSeconds: aws.Int64(1)})
+	if err != nil {
+		t.Fatalf("unable to receive messages: %s", err)
+	}
+	return out.Messages
+}
@@ -0,0 +1,426 @@
+package queue
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pubsub "cloud.google.com/go/pubsub/apiv1"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"go-worker/config"
+	"go-worker/utils"
+)
+
+const (
+	// PubSubScheme - url scheme of pub/sub subscriptions
+	PubSubScheme = "pubsub"
+	// maxAckDeadline - longest ack deadline in seconds pub/sub accepts
+	maxAckDeadline = 600
+	// pubSubEmulatorEnv - environment variable holding the address of a pub/sub emulator
+	pubSubEmulatorEnv = "PUBSUB_EMULATOR_HOST"
+)
+
+// PubSubQueueOptions - holds customizable fields of a pub/sub queue
+type PubSubQueueOptions struct {
+	Topic                  string
+	Endpoint               string
+	CredentialsFile        string
+	MaxOutstandingMessages int
+}
+
+// NewPubSubQueueOptions - returns pub/sub queue options from config
+// the outstanding message limit defaults to what the worker pool can hold at once
+func NewPubSubQueueOptions() PubSubQueueOptions {
+	cfg := config.GetConfig()
+	maxOutstanding := cfg.GetInt("worker.count") * utils.GetValue(cfg.GetInt("worker.max_events"), 1).(int)
+	return PubSubQueueOptions{
+		Topic:                  cfg.GetString("pubsub_queue.topic"),
+		Endpoint:               utils.GetValue(cfg.GetString("pubsub_queue.endpoint"), os.Getenv(pubSubEmulatorEnv)).(string),
+		CredentialsFile:        cfg.GetString("pubsub_queue.credentials_file"),
+		MaxOutstandingMessages: utils.GetValue(cfg.GetInt("pubsub_queue.max_outstanding_messages"), maxOutstanding).(int),
+	}
+}
+
+// PubSubQueue - queue which pulls from a pub/sub subscription
+// receipt handles are ack ids, deleting a message acks it and changing its
+// visibility modifies its ack deadline, a deadline of zero nacks it
+type PubSubQueue struct {
+	sqsiface.SQSAPI
+	subscriber   *pubsub.SubscriberClient
+	publisher    *pubsub.PublisherClient
+	subscription string
+	ackDeadline  time.Duration
+	options      PubSubQueueOptions
+	inFlight     map[string]time.Time
+	reserved     int
+	released     chan struct{}
+	lock         sync.Mutex
+}
+
+// OpenPubSubQueue - connects to the subscription in a pub/sub url, e.g. pubsub://my-project/billing-events
+func OpenPubSubQueue(queueURL string, options PubSubQueueOptions) (*PubSubQueue, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid pub/sub queue url")
+	}
+	name := strings.Trim(u.Path, "/")
+	if u.Host == "" || name == "" || strings.Contains(name, "/") {
+		return nil, errors.New("pub/sub queue url must name a project and a subscription")
+	}
+
+	subscriber, publisher, err := newPubSubClients(options)
+	if err != nil {
+		return nil, err
+	}
+	q, err := NewPubSubQueue(subscriber, publisher, "projects/"+u.Host+"/subscriptions/"+name, options)
+	if err != nil {
+		subscriber.Close()
+		publisher.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// newPubSubClients - returns subscriber and publisher clients for google cloud or the configured emulator
+func newPubSubClients(options PubSubQueueOptions) (*pubsub.SubscriberClient, *pubsub.PublisherClient, error) {
+	var opts []option.ClientOption
+	if options.Endpoint != "" {
+		opts = append(opts,
+			option.WithEndpoint(options.Endpoint),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	} else if options.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(options.CredentialsFile))
+	}
+	ctx := context.Background()
+	subscriber, err := pubsub.NewSubscriberClient(ctx, opts...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to create pub/sub subscriber")
+	}
+	publisher, err := pubsub.NewPublisherClient(ctx, opts...)
+	if err != nil {
+		subscriber.Close()
+		return nil, nil, errors.Wrap(err, "unable to create pub/sub publisher")
+	}
+	return subscriber, publisher, nil
+}
+
+// NewPubSubQueue - returns a queue for a subscription, publishing to its topic unless another is configured
+func NewPubSubQueue(subscriber *pubsub.SubscriberClient, publisher *pubsub.PublisherClient, subscription string, options PubSubQueueOptions) (*PubSubQueue, error) {
+	sub, err := subscriber.GetSubscription(context.Background(), &pubsubpb.GetSubscriptionRequest{Subscription: subscription})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read pub/sub subscription")
+	}
+	if options.Topic == "" {
+		options.Topic = sub.Topic
+	}
+	return &PubSubQueue{
+		subscriber:   subscriber,
+		publisher:    publisher,
+		subscription: subscription,
+		ackDeadline:  time.Duration(utils.GetValue(int(sub.AckDeadlineSeconds), defaultVisibilityTimeout).(int)) * time.Second,
+		options:      options,
+		inFlight:     map[string]time.Time{},
+		released:     make(chan struct{}, 1),
+	}, nil
+}
+
+// Close - closes the pub/sub clients
+func (q *PubSubQueue) Close() error {
+	err := q.subscriber.Close()
+	if publishErr := q.publisher.Close(); err == nil {
+		err = publishErr
+	}
+	return err
+}
+
+// SendMessageBatch - publishes messages to the topic in a single request
+// fifo message group ids become ordering keys
+func (q *PubSubQueue) SendMessageBatch(in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	out := &sqs.SendMessageBatchOutput{}
+	var entries []*sqs.SendMessageBatchRequestEntry
+	req := &pubsubpb.PublishRequest{Topic: q.options.Topic}
+	for _, entry := range in.Entries {
+		if aws.Int64Value(entry.DelaySeconds) > 0 {
+			out.Failed = append(out.Failed, unsupportedEntry(entry.Id, "pub/sub does not support delayed messages"))
+			continue
+		}
+		msg := &pubsubpb.PubsubMessage{
+			Data:        []byte(aws.StringValue(entry.MessageBody)),
+			Attributes:  map[string]string{},
+			OrderingKey: aws.StringValue(entry.MessageGroupId),
+		}
+		for name, value := range entry.MessageAttributes {
+			msg.Attributes[name] = aws.StringValue(value.StringValue)
+		}
+		entries = append(entries, entry)
+		req.Messages = append(req.Messages, msg)
+	}
+	if len(entries) == 0 {
+		return out, nil
+	}
+
+	resp, err := q.publisher.Publish(context.Background(), req)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to publish pub/sub messages")
+	}
+	for i, entry := range entries {
+		out.Successful = append(out.Successful, &sqs.SendMessageBatchResultEntry{
+			Id:               entry.Id,
+			MessageId:        aws.String(resp.MessageIds[i]),
+			MD5OfMessageBody: aws.String(md5Hex(aws.StringValue(entry.MessageBody))),
+		})
+	}
+	return out, nil
+}
+
+// SendMessage - publishes a single message to the topic
+func (q *PubSubQueue) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	out, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: in.QueueUrl,
+		Entries: []*sqs.SendMessageBatchRequestEntry{{
+			Id:                aws.String("0"),
+			MessageBody:       in.MessageBody,
+			DelaySeconds:      in.DelaySeconds,
+			MessageAttributes: in.MessageAttributes,
+			MessageGroupId:    in.MessageGroupId,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Failed) > 0 {
+		return nil, awserr.New(aws.StringValue(out.Failed[0].Code), aws.StringValue(out.Failed[0].Message), nil)
+	}
+	return &sqs.SendMessageOutput{
+		MessageId:        out.Successful[0].MessageId,
+		MD5OfMessageBody: out.Successful[0].MD5OfMessageBody,
+	}, nil
+}
+
+// ReceiveMessage - pulls a batch of messages without exceeding the outstanding message limit
+// when the limit is reached it waits for messages to be settled instead of pulling
+func (q *PubSubQueue) ReceiveMessage(in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	wait := time.Duration(aws.Int64Value(in.WaitTimeSeconds)) * time.Second
+	count := q.reserve(utils.GetValue(int(aws.Int64Value(in.MaxNumberOfMessages)), 1).(int), wait)
+	if count == 0 {
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+	defer q.unreserve(count)
+
+	ctx := context.Background()
+	if wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wait)
+		defer cancel()
+	}
+	resp, err := q.subscriber.Pull(ctx, &pubsubpb.PullRequest{
+		Subscription:      q.subscription,
+		MaxMessages:       int32(count),
+		ReturnImmediately: wait == 0,
+	})
+	if err != nil {
+		if status.Code(err) == codes.DeadlineExceeded || ctx.Err() != nil {
+			return &sqs.ReceiveMessageOutput{}, nil
+		}
+		return nil, errors.Wrap(err, "unable to pull pub/sub messages")
+	}
+
+	now := time.Now()
+	var messages []*sqs.Message
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, received := range resp.ReceivedMessages {
+		q.inFlight[received.AckId] = now.Add(q.ackDeadline)
+		messages = append(messages, toPubSubMessage(received, in.MessageAttributeNames))
+	}
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+// DeleteMessageBatch - acks in flight messages in a single request
+func (q *PubSubQueue) DeleteMessageBatch(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	out := &sqs.DeleteMessageBatchOutput{}
+	var entries []*sqs.DeleteMessageBatchRequestEntry
+	var ackIDs []string
+	for _, entry := range in.Entries {
+		if !q.isInFlight(aws.StringValue(entry.ReceiptHandle)) {
+			out.Failed = append(out.Failed, invalidReceiptEntry(entry.Id))
+			continue
+		}
+		entries = append(entries, entry)
+		ackIDs = append(ackIDs, aws.StringValue(entry.ReceiptHandle))
+	}
+	if len(ackIDs) == 0 {
+		return out, nil
+	}
+
+	err := q.subscriber.Acknowledge(context.Background(), &pubsubpb.AcknowledgeRequest{Subscription: q.subscription, AckIds: ackIDs})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to ack pub/sub messages")
+	}
+	q.release(ackIDs...)
+	for _, entry := range entries {
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+	return out, nil
+}
+
+// ChangeMessageVisibility - modifies the ack deadline of a message, a deadline of zero nacks it
+// so it is redelivered straight away
+func (q *PubSubQueue) ChangeMessageVisibility(in *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	ackID := aws.StringValue(in.ReceiptHandle)
+	timeout := aws.Int64Value(in.VisibilityTimeout)
+	if timeout < 0 || timeout > maxAckDeadline {
+		return nil, awserr.New(errInvalidParameterValue, "ack deadline must be between 0 and 600 seconds", nil)
+	}
+	if !q.isInFlight(ackID) {
+		return nil, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, "message is not in flight", nil)
+	}
+
+	err := q.subscriber.ModifyAckDeadline(context.Background(), &pubsubpb.ModifyAckDeadlineRequest{
+		Subscription:       q.subscription,
+		AckIds:             []string{ackID},
+		AckDeadlineSeconds: int32(timeout),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to modify pub/sub ack deadline")
+	}
+	if timeout == 0 {
+		q.release(ackID)
+	} else {
+		q.lock.Lock()
+		q.inFlight[ackID] = time.Now().Add(time.Duration(timeout) * time.Second)
+		q.lock.Unlock()
+	}
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// GetQueueAttributes - returns the in flight count and ack deadline of the subscription
+// pub/sub only reports its backlog through cloud monitoring
+func (q *PubSubQueue) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.pruneInFlight(time.Now())
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]*string{
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: aws.String(strconv.Itoa(len(q.inFlight))),
+		sqs.QueueAttributeNameVisibilityTimeout:                     aws.String(strconv.Itoa(int(q.ackDeadline.Seconds()))),
+	}}, nil
+}
+
+// reserve - reserves how many messages can be pulled without exceeding the outstanding
+// message limit, waiting up to wait for in flight messages to be settled
+func (q *PubSubQueue) reserve(count int, wait time.Duration) int {
+	deadline := time.Now().Add(wait)
+	for {
+		q.lock.Lock()
+		q.pruneInFlight(time.Now())
+		available := count
+		if limit := q.options.MaxOutstandingMessages; limit > 0 {
+			if free := limit - len(q.inFlight) - q.reserved; free < count {
+				available = free
+			}
+		}
+		if available > 0 {
+			q.reserved += available
+		}
+		q.lock.Unlock()
+
+		remaining := time.Until(deadline)
+		if available > 0 {
+			return available
+		}
+		if remaining <= 0 {
+			return 0
+		}
+		select {
+		case <-q.released:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// unreserve - returns a reservation once the pulled messages are tracked as in flight
+func (q *PubSubQueue) unreserve(count int) {
+	q.lock.Lock()
+	q.reserved -= count
+	q.lock.Unlock()
+	q.wake()
+}
+
+// release - forgets settled messages and wakes a receive waiting on the outstanding message limit
+func (q *PubSubQueue) release(ackIDs ...string) {
+	q.lock.Lock()
+	for _, ackID := range ackIDs {
+		delete(q.inFlight, ackID)
+	}
+	q.lock.Unlock()
+	q.wake()
+}
+
+// wake - signals a receive waiting on the outstanding message limit without blocking
+func (q *PubSubQueue) wake() {
+	select {
+	case q.released <- struct{}{}:
+	default:
+	}
+}
+
+// isInFlight - reports whether an ack id belongs to a message whose deadline has not passed
+func (q *PubSubQueue) isInFlight(ackID string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	deadline, ok := q.inFlight[ackID]
+	return ok && time.Now().Before(deadline)
+}
+
+// pruneInFlight - forgets messages whose ack deadline has passed, callers must hold the lock
+func (q *PubSubQueue) pruneInFlight(now time.Time) {
+	for ackID, deadline := range q.inFlight {
+		if !now.Before(deadline) {
+			delete(q.inFlight, ackID)
+		}
+	}
+}
+
+// toPubSubMessage - converts a pulled pub/sub message to a sqs message
+func toPubSubMessage(received *pubsubpb.ReceivedMessage, attributeNames []*string) *sqs.Message {
+	body := string(received.Message.Data)
+	message := &sqs.Message{
+		MessageId:     aws.String(received.Message.MessageId),
+		ReceiptHandle: aws.String(received.AckId),
+		Body:          aws.String(body),
+		MD5OfBody:     aws.String(md5Hex(body)),
+		Attributes:    map[string]*string{},
+	}
+	if publishTime := received.Message.PublishTime; publishTime != nil {
+		message.Attributes[sqs.MessageSystemAttributeNameSentTimestamp] = aws.String(strconv.FormatInt(publishTime.AsTime().UnixNano()/int64(time.Millisecond), 10))
+	}
+	// delivery attempts are only counted on subscriptions with a dead letter policy
+	if received.DeliveryAttempt > 0 {
+		message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount] = aws.String(strconv.Itoa(int(received.DeliveryAttempt)))
+	}
+	if orderingKey := received.Message.OrderingKey; orderingKey != "" {
+		message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId] = aws.String(orderingKey)
+	}
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	for name, value := range received.Message.Attributes {
+		attributes[name] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	message.MessageAttributes = filterAttributes(attributes, attributeNames)
+	return message
+}
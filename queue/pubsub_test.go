@@ -0,0 +1,178 @@
+package queue
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+var pubSubSubscription = "projects/billing/subscriptions/billing-events"
+
+// TestPositivePubSubQueue - tests publish, pull and ack on a pub/sub subscription
+func TestPositivePubSubQueue(t *testing.T) {
+	check := assert.New(t)
+	server, q := getPubSubQueue(t, 0)
+	defer server.Close()
+	defer q.Close()
+
+	out, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{Entries: []*sqs.SendMessageBatchRequestEntry{
+		{Id: aws.String("0"), MessageBody: aws.String("first"), MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"source": {DataType: aws.String("String"), StringValue: aws.String("test")},
+		}},
+		{Id: aws.String("1"), MessageBody: aws.String("second")},
+		{Id: aws.String("2"), MessageBody: aws.String("delayed"), DelaySeconds: aws.Int64(5)},
+	}})
+	check.NoError(err)
+	check.Len(out.Successful, 2)
+	check.Len(out.Failed, 1)
+
+	received, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{
+		MaxNumberOfMessages:   aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(1),
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	})
+	check.NoError(err)
+	check.Len(received.Messages, 2)
+	// the fake does not pull in publish order
+	sort.Slice(received.Messages, func(i, j int) bool {
+		return aws.StringValue(received.Messages[i].Body) < aws.StringValue(received.Messages[j].Body)
+	})
+	check.Equal("first", aws.StringValue(received.Messages[0].Body))
+	check.Equal("test", aws.StringValue(received.Messages[0].MessageAttributes["source"].StringValue))
+	check.NotEmpty(aws.StringValue(received.Messages[0].Attributes[sqs.MessageSystemAttributeNameSentTimestamp]))
+
+	deleteOut, err := q.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{Entries: []*sqs.DeleteMessageBatchRequestEntry{
+		{Id: aws.String("0"), ReceiptHandle: received.Messages[0].ReceiptHandle},
+		{Id: aws.String("1"), ReceiptHandle: aws.String("unknown")},
+	}})
+	check.NoError(err)
+	check.Len(deleteOut.Successful, 1)
+	check.Len(deleteOut.Failed, 1)
+	check.True(server.Message(aws.StringValue(received.Messages[0].MessageId)).Acks > 0)
+
+	attributes, err := q.GetQueueAttributes(&sqs.GetQueueAttributesInput{})
+	check.NoError(err)
+	check.Equal("1", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible]))
+	check.Equal("10", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameVisibilityTimeout]))
+}
+
+// TestPositivePubSubQueueSendMessage - tests single messages are published like batch entries
+func TestPositivePubSubQueueSendMessage(t *testing.T) {
+	check := assert.New(t)
+	server, q := getPubSubQueue(t, 10)
+	defer server.Close()
+	defer q.Close()
+
+	out, err := q.SendMessage(&sqs.SendMessageInput{
+		MessageBody: aws.String("single"),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"reason": {DataType: aws.String("String"), StringValue: aws.String("invalid")},
+		},
+	})
+	check.NoError(err)
+	check.NotEmpty(aws.StringValue(out.MessageId))
+	check.Equal(md5Hex("single"), aws.StringValue(out.MD5OfMessageBody))
+	_, err = q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("delayed"), DelaySeconds: aws.Int64(5)})
+	check.Error(err)
+
+	received, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{
+		MaxNumberOfMessages:   aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(1),
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	})
+	check.NoError(err)
+	check.Len(received.Messages, 1)
+	check.Equal("single", aws.StringValue(received.Messages[0].Body))
+	check.Equal("invalid", aws.StringValue(received.Messages[0].MessageAttributes["reason"].StringValue))
+}
+
+// TestPositivePubSubQueueFlowControl - tests nacks, deadline changes and the outstanding message limit
+func TestPositivePubSubQueueFlowControl(t *testing.T) {
+	check := assert.New(t)
+	server, q := getPubSubQueue(t, 1)
+	defer server.Close()
+	defer q.Close()
+
+	server.Publish("projects/billing/topics/billing-events", []byte("first"), nil)
+	server.Publish("projects/billing/topics/billing-events", []byte("second"), nil)
+
+	// only one message is pulled while one is outstanding
+	received := receivePubSub(t, q, 0)
+	check.Len(received, 1)
+	check.Empty(receivePubSub(t, q, 0))
+
+	// extending the deadline keeps the message outstanding
+	_, err := q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     received[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(60),
+	})
+	check.NoError(err)
+	check.Empty(receivePubSub(t, q, 0))
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     received[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(601),
+	})
+	check.Error(err)
+
+	// a receive waiting on the limit pulls as soon as the message is nacked
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			ReceiptHandle:     received[0].ReceiptHandle,
+			VisibilityTimeout: aws.Int64(0),
+		})
+	}()
+	received = receivePubSub(t, q, 2)
+	check.Len(received, 1)
+
+	deleteOut, err := q.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{Entries: []*sqs.DeleteMessageBatchRequestEntry{
+		{Id: aws.String("0"), ReceiptHandle: received[0].ReceiptHandle},
+	}})
+	check.NoError(err)
+	check.Len(deleteOut.Successful, 1)
+	check.Len(receivePubSub(t, q, 1), 1)
+}
+
+// getPubSubQueue - starts an in-process pub/sub fake with a topic and subscription and opens a queue on it
+func getPubSubQueue(t *testing.T, maxOutstanding int) (*pstest.Server, *PubSubQueue) {
+	server := pstest.NewServer()
+	options := PubSubQueueOptions{Endpoint: server.Addr, MaxOutstandingMessages: maxOutstanding}
+	if _, err := OpenPubSubQueue("pubsub://billing/billing-events", options); err == nil {
+		t.Fatal("opened a subscription which does not exist")
+	}
+
+	subscriber, publisher, err := newPubSubClients(options)
+	if err != nil {
+		t.Fatalf("unable to create pub/sub clients: %s", err)
+	}
+	ctx := context.Background()
+	topic, err := publisher.CreateTopic(ctx, &pubsubpb.Topic{Name: "projects/billing/topics/billing-events"})
+	if err != nil {
+		t.Fatalf("unable to create topic: %s", err)
+	}
+	_, err = subscriber.CreateSubscription(ctx, &pubsubpb.Subscription{Name: pubSubSubscription, Topic: topic.Name, AckDeadlineSeconds: 10})
+	if err != nil {
+		t.Fatalf("unable to create subscription: %s", err)
+	}
+	q, err := NewPubSubQueue(subscriber, publisher, pubSubSubscription, options)
+	if err != nil {
+		t.Fatalf("unable to open pub/sub queue: %s", err)
+	}
+	return server, q
+}
+
+// receivePubSub - pulls messages waiting at most wait seconds
+func receivePubSub(t *testing.T, q *PubSubQueue, wait int64) []*sqs.Message {
+	out, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10), WaitTimeSeconds: aws.Int64(wait)})
+	if err != nil {
+		t.Fatalf("unable to receive messages: %s", err)
+	}
+	return out.Messages
+}
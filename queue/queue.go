@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"io"
+	"net/url"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+)
+
+const (
+	// FileScheme - url scheme of local file backed queues
+	FileScheme = "file"
+)
+
+var (
+	// backends - queue backends opened by this process, shared by all workers
+	backends = map[string]sqsiface.SQSAPI{}
+	// backendsLock - guards backends
+	backendsLock sync.Mutex
+)
+
+// New - returns a queue client for the given queue url
+// file:// urls are served by a local file backed queue, redis:// and rediss://
+// urls by a redis stream consumer group, nats:// urls by a jetstream pull
+// consumer, pubsub:// urls by a pub/sub subscription, sql:// urls by a job
+// table, everything else by sqs
+func New(queueURL string) (sqsiface.SQSAPI, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid queue url")
+	}
+
+	switch u.Scheme {
+	case FileScheme:
+		return open(queueURL, func() (sqsiface.SQSAPI, error) {
+			return OpenFileQueue(u.Path, NewFileQueueOptions())
+		})
+	case RedisScheme, RedisTLSScheme:
+		return open(queueURL, func() (sqsiface.SQSAPI, error) {
+			return OpenRedisQueue(queueURL, NewRedisQueueOptions())
+		})
+	case NATSScheme:
+		return open(queueURL, func() (sqsiface.SQSAPI, error) {
+			return OpenNATSQueue(queueURL, NewNATSQueueOptions())
+		})
+	case PubSubScheme:
+		return open(queueURL, func() (sqsiface.SQSAPI, error) {
+			return OpenPubSubQueue(queueURL, NewPubSubQueueOptions())
+		})
+	case SQLScheme:
+		return open(queueURL, func() (sqsiface.SQSAPI, error) {
+			return OpenSQLQueue(queueURL, NewSQLQueueOptions())
+		})
+	default:
+		return newSQSClient()
+	}
+}
+
+// Close - closes all the queue backends opened by this process
+func Close() error {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	var closeErr error
+	for queueURL, backend := range backends {
+		if closer, ok := backend.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				closeErr = errors.Wrapf(err, "unable to close queue %s", queueURL)
+			}
+		}
+		delete(backends, queueURL)
+	}
+	return closeErr
+}
+
+// open - returns the backend opened for the queue url, opening it on first use
+func open(queueURL string, opener func() (sqsiface.SQSAPI, error)) (sqsiface.SQSAPI, error) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if backend, ok := backends[queueURL]; ok {
+		return backend, nil
+	}
+	backend, err := opener()
+	if err != nil {
+		return nil, err
+	}
+	backends[queueURL] = backend
+	return backend, nil
+}
+
+// newSQSClient - returns a sqs client for the configured region
+// sqs.endpoint overrides the aws endpoint, e.g. to point at a local or fake sqs server
+func newSQSClient() (sqsiface.SQSAPI, error) {
+	cfg := config.GetConfig()
+	awsConfig := &aws.Config{
+		Region: aws.String(cfg.GetString("sqs.region")),
+	}
+	if endpoint := cfg.GetString("sqs.endpoint"); endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return sqs.New(sess), nil
+}
@@ -0,0 +1,406 @@
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+
+	"go-worker/config"
+	"go-worker/utils"
+)
+
+const (
+	// RedisScheme - url scheme of redis stream queues
+	RedisScheme = "redis"
+	// RedisTLSScheme - url scheme of redis stream queues over tls
+	RedisTLSScheme = "rediss"
+	// defaultRedisGroup - consumer group used when none is configured
+	defaultRedisGroup = "go-worker"
+	// defaultRedisBodyField - stream entry field holding the message body
+	defaultRedisBodyField = "body"
+	// defaultRedisStartID - id the consumer group starts reading from when it is created
+	defaultRedisStartID = "0"
+	// errBusyGroup - prefix of the redis error returned when a consumer group exists
+	errBusyGroup = "BUSYGROUP"
+)
+
+// RedisQueueOptions - holds customizable fields of a redis stream queue
+type RedisQueueOptions struct {
+	Group         string
+	Consumer      string
+	ClaimIdleTime time.Duration
+	StartID       string
+	MaxLen        int64
+	DeleteOnAck   bool
+	BodyField     string
+}
+
+// NewRedisQueueOptions - returns redis queue options from config
+func NewRedisQueueOptions() RedisQueueOptions {
+	cfg := config.GetConfig()
+	hostname, _ := os.Hostname()
+	return RedisQueueOptions{
+		Group:         utils.GetValue(cfg.GetString("redis_queue.group"), defaultRedisGroup).(string),
+		Consumer:      utils.GetValue(cfg.GetString("redis_queue.consumer"), hostname).(string),
+		ClaimIdleTime: time.Duration(utils.GetValue(cfg.GetInt("redis_queue.claim_idle_time"), defaultVisibilityTimeout).(int)) * time.Second,
+		StartID:       utils.GetValue(cfg.GetString("redis_queue.start_id"), defaultRedisStartID).(string),
+		MaxLen:        cfg.GetInt64("redis_queue.max_len"),
+		DeleteOnAck:   cfg.GetBool("redis_queue.delete_on_ack"),
+		BodyField:     utils.GetValue(cfg.GetString("redis_queue.body_field"), defaultRedisBodyField).(string),
+	}
+}
+
+// RedisQueue - queue which reads a redis stream through a consumer group
+// receipt handles are stream entry ids, acks are XACK and messages left
+// pending longer than the claim idle time are taken over with XAUTOCLAIM.
+// messages delayed past the claim idle time keep their not before time in
+// a hash next to the stream and are only delivered once it has passed.
+// each claim resumes at the cursor XAUTOCLAIM returned for the last one, so
+// delayed entries at the head of the pending list do not hide those after them
+type RedisQueue struct {
+	sqsiface.SQSAPI
+	client      redis.UniversalClient
+	stream      string
+	options     RedisQueueOptions
+	claimCursor string
+	cursorLock  sync.Mutex
+}
+
+// OpenRedisQueue - connects to the stream in a redis url, e.g. redis://:password@host:6379/billing-events?db=0
+func OpenRedisQueue(queueURL string, options RedisQueueOptions) (*RedisQueue, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid redis queue url")
+	}
+	stream := strings.TrimPrefix(u.Path, "/")
+	if stream == "" {
+		return nil, errors.New("redis queue url must name a stream")
+	}
+	redisOptions := &redis.Options{Addr: u.Host}
+	if u.User != nil {
+		redisOptions.Username = u.User.Username()
+		redisOptions.Password, _ = u.User.Password()
+	}
+	if db := u.Query().Get("db"); db != "" {
+		if redisOptions.DB, err = strconv.Atoi(db); err != nil {
+			return nil, errors.Wrap(err, "invalid redis db")
+		}
+	}
+	if u.Scheme == RedisTLSScheme {
+		redisOptions.TLSConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	}
+	return NewRedisQueue(redis.NewClient(redisOptions), stream, options)
+}
+
+// NewRedisQueue - returns a queue for a stream, creating the consumer group if needed
+func NewRedisQueue(client redis.UniversalClient, stream string, options RedisQueueOptions) (*RedisQueue, error) {
+	options.Group = utils.GetValue(options.Group, defaultRedisGroup).(string)
+	options.BodyField = utils.GetValue(options.BodyField, defaultRedisBodyField).(string)
+	options.StartID = utils.GetValue(options.StartID, defaultRedisStartID).(string)
+	if options.ClaimIdleTime <= 0 {
+		options.ClaimIdleTime = defaultVisibilityTimeout * time.Second
+	}
+	if options.Consumer == "" {
+		options.Consumer, _ = os.Hostname()
+	}
+
+	err := client.XGroupCreateMkStream(context.Background(), stream, options.Group, options.StartID).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), errBusyGroup) {
+		return nil, errors.Wrap(err, "unable to create redis consumer group")
+	}
+	return &RedisQueue{client: client, stream: stream, options: options}, nil
+}
+
+// Close - closes the redis connection
+func (q *RedisQueue) Close() error {
+	return q.client.Close()
+}
+
+// SendMessageBatch - appends messages to the stream, attributes are stored as entry fields
+func (q *RedisQueue) SendMessageBatch(in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	ctx := context.Background()
+	out := &sqs.SendMessageBatchOutput{}
+	pipe := q.client.Pipeline()
+	cmds := map[string]*redis.StringCmd{}
+	for _, entry := range in.Entries {
+		if aws.Int64Value(entry.DelaySeconds) > 0 {
+			out.Failed = append(out.Failed, unsupportedEntry(entry.Id, "redis streams do not support delayed messages"))
+			continue
+		}
+		values := map[string]interface{}{q.options.BodyField: aws.StringValue(entry.MessageBody)}
+		for name, value := range entry.MessageAttributes {
+			values[name] = aws.StringValue(value.StringValue)
+		}
+		cmds[aws.StringValue(entry.Id)] = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: q.stream,
+			MaxLen: q.options.MaxLen,
+			Approx: q.options.MaxLen > 0,
+			Values: values,
+		})
+	}
+	if len(cmds) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, errors.Wrap(err, "unable to add messages to redis stream")
+		}
+	}
+	for _, entry := range in.Entries {
+		if cmd, ok := cmds[aws.StringValue(entry.Id)]; ok {
+			out.Successful = append(out.Successful, &sqs.SendMessageBatchResultEntry{
+				Id:               entry.Id,
+				MessageId:        aws.String(cmd.Val()),
+				MD5OfMessageBody: aws.String(md5Hex(aws.StringValue(entry.MessageBody))),
+			})
+		}
+	}
+	return out, nil
+}
+
+// SendMessage - appends a single message to the stream
+func (q *RedisQueue) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	out, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: in.QueueUrl,
+		Entries: []*sqs.SendMessageBatchRequestEntry{{
+			Id:                aws.String("0"),
+			MessageBody:       in.MessageBody,
+			DelaySeconds:      in.DelaySeconds,
+			MessageAttributes: in.MessageAttributes,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Failed) > 0 {
+		return nil, awserr.New(aws.StringValue(out.Failed[0].Code), aws.StringValue(out.Failed[0].Message), nil)
+	}
+	return &sqs.SendMessageOutput{
+		MessageId:        out.Successful[0].MessageId,
+		MD5OfMessageBody: out.Successful[0].MD5OfMessageBody,
+	}, nil
+}
+
+// ReceiveMessage - claims abandoned messages first, then reads new messages for the consumer
+func (q *RedisQueue) ReceiveMessage(in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	ctx := context.Background()
+	count := int64(utils.GetValue(int(aws.Int64Value(in.MaxNumberOfMessages)), 1).(int))
+
+	q.cursorLock.Lock()
+	start := utils.GetValue(q.claimCursor, "0-0").(string)
+	q.cursorLock.Unlock()
+	claimed, next, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   q.stream,
+		Group:    q.options.Group,
+		Consumer: q.options.Consumer,
+		MinIdle:  q.options.ClaimIdleTime,
+		Start:    start,
+		Count:    count,
+	}).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to claim idle redis messages")
+	}
+	// the cursor is 0-0 again once the scan has reached the end of the pending list
+	q.cursorLock.Lock()
+	q.claimCursor = next
+	q.cursorLock.Unlock()
+	if claimed, err = q.due(ctx, claimed); err != nil {
+		return nil, err
+	}
+	if len(claimed) > 0 {
+		return &sqs.ReceiveMessageOutput{Messages: q.toMessages(claimed, in.MessageAttributeNames)}, nil
+	}
+
+	// a zero block would wait forever, so wait at least a millisecond
+	block := time.Duration(aws.Int64Value(in.WaitTimeSeconds)) * time.Second
+	if block <= 0 {
+		block = time.Millisecond
+	}
+	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.options.Group,
+		Consumer: q.options.Consumer,
+		Streams:  []string{q.stream, ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read redis stream")
+	}
+	var messages []*sqs.Message
+	for _, stream := range streams {
+		messages = append(messages, q.toMessages(stream.Messages, in.MessageAttributeNames)...)
+	}
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+// DeleteMessageBatch - acknowledges messages with XACK, entries which are not pending fail
+func (q *RedisQueue) DeleteMessageBatch(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	ctx := context.Background()
+	pipe := q.client.Pipeline()
+	cmds := make([]*redis.IntCmd, 0, len(in.Entries))
+	for _, entry := range in.Entries {
+		cmds = append(cmds, pipe.XAck(ctx, q.stream, q.options.Group, aws.StringValue(entry.ReceiptHandle)))
+		pipe.HDel(ctx, q.notBeforeKey(), aws.StringValue(entry.ReceiptHandle))
+		if q.options.DeleteOnAck {
+			pipe.XDel(ctx, q.stream, aws.StringValue(entry.ReceiptHandle))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "unable to acknowledge redis messages")
+	}
+
+	out := &sqs.DeleteMessageBatchOutput{}
+	for i, entry := range in.Entries {
+		if cmds[i].Val() == 0 {
+			out.Failed = append(out.Failed, invalidReceiptEntry(entry.Id))
+			continue
+		}
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+	return out, nil
+}
+
+// ChangeMessageVisibility - sets the idle time of a pending message so it is claimed after the timeout
+// a timeout of zero makes the message claimable straight away (nack), a longer one extends processing.
+// timeouts longer than the claim idle time record a not before time, so the message is not delivered
+// when it is claimed earlier
+func (q *RedisQueue) ChangeMessageVisibility(in *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	ctx := context.Background()
+	receiptHandle := aws.StringValue(in.ReceiptHandle)
+	timeout := time.Duration(aws.Int64Value(in.VisibilityTimeout)) * time.Second
+	idle := q.options.ClaimIdleTime - timeout
+	if idle < 0 {
+		idle = 0
+	}
+	ids, err := q.client.Do(ctx, "XCLAIM", q.stream, q.options.Group, q.options.Consumer, 0,
+		receiptHandle, "IDLE", idle.Milliseconds(), "JUSTID").Slice()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to change redis message idle time")
+	}
+	if len(ids) == 0 {
+		return nil, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, "message is not pending", nil)
+	}
+
+	if timeout <= q.options.ClaimIdleTime {
+		err = q.client.HDel(ctx, q.notBeforeKey(), receiptHandle).Err()
+	} else {
+		var now time.Time
+		if now, err = q.client.Time(ctx).Result(); err == nil {
+			err = q.client.HSet(ctx, q.notBeforeKey(), receiptHandle, now.Add(timeout).UnixMilli()).Err()
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to delay redis message")
+	}
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// due - returns the claimed entries whose not before time has passed and forgets their delay,
+// entries which are still delayed stay pending and are claimed again after the claim idle time
+func (q *RedisQueue) due(ctx context.Context, claimed []redis.XMessage) ([]redis.XMessage, error) {
+	if len(claimed) == 0 {
+		return claimed, nil
+	}
+	ids := make([]string, 0, len(claimed))
+	for _, entry := range claimed {
+		ids = append(ids, entry.ID)
+	}
+	notBefore, err := q.client.HMGet(ctx, q.notBeforeKey(), ids...).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read redis message delays")
+	}
+	now, err := q.client.Time(ctx).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read redis time")
+	}
+	var due []redis.XMessage
+	var expired []string
+	for i, entry := range claimed {
+		if value, ok := notBefore[i].(string); ok {
+			millis, _ := strconv.ParseInt(value, 10, 64)
+			if now.UnixMilli() < millis {
+				continue
+			}
+			expired = append(expired, entry.ID)
+		}
+		due = append(due, entry)
+	}
+	if len(expired) > 0 {
+		if err = q.client.HDel(ctx, q.notBeforeKey(), expired...).Err(); err != nil {
+			return nil, errors.Wrap(err, "unable to clear redis message delays")
+		}
+	}
+	return due, nil
+}
+
+// notBeforeKey - returns the key of the hash holding the not before times of delayed messages
+func (q *RedisQueue) notBeforeKey() string {
+	return q.stream + ":" + q.options.Group + ":not-before"
+}
+
+// GetQueueAttributes - returns the stream length and the number of pending messages
+func (q *RedisQueue) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	ctx := context.Background()
+	length, err := q.client.XLen(ctx, q.stream).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read redis stream length")
+	}
+	pending, err := q.client.XPending(ctx, q.stream, q.options.Group).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read redis pending messages")
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]*string{
+		sqs.QueueAttributeNameApproximateNumberOfMessages:           aws.String(strconv.FormatInt(length, 10)),
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: aws.String(strconv.FormatInt(pending.Count, 10)),
+	}}, nil
+}
+
+// toMessages - converts stream entries to sqs messages
+func (q *RedisQueue) toMessages(entries []redis.XMessage, attributeNames []*string) []*sqs.Message {
+	messages := make([]*sqs.Message, 0, len(entries))
+	for _, entry := range entries {
+		body, _ := entry.Values[q.options.BodyField].(string)
+		attributes := map[string]*sqs.MessageAttributeValue{}
+		for name, value := range entry.Values {
+			if name == q.options.BodyField {
+				continue
+			}
+			if stringValue, ok := value.(string); ok {
+				attributes[name] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(stringValue)}
+			}
+		}
+		// stream ids start with the unix time in milliseconds the entry was added
+		sentTimestamp := strings.SplitN(entry.ID, "-", 2)[0]
+		messages = append(messages, &sqs.Message{
+			MessageId:         aws.String(entry.ID),
+			ReceiptHandle:     aws.String(entry.ID),
+			Body:              aws.String(body),
+			MD5OfBody:         aws.String(md5Hex(body)),
+			Attributes:        map[string]*string{sqs.MessageSystemAttributeNameSentTimestamp: aws.String(sentTimestamp)},
+			MessageAttributes: filterAttributes(attributes, attributeNames),
+		})
+	}
+	return messages
+}
+
+// unsupportedEntry - returns a batch error entry for an option the backend does not support
+func unsupportedEntry(id *string, message string) *sqs.BatchResultErrorEntry {
+	return &sqs.BatchResultErrorEntry{
+		Id:          id,
+		Code:        aws.String(sqs.ErrCodeUnsupportedOperation),
+		Message:     aws.String(message),
+		SenderFault: aws.Bool(true),
+	}
+}
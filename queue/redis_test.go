@@ -0,0 +1,196 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+var redisStream = "billing-events"
+
+// TestPositiveRedisQueue - tests send, receive and ack on a redis stream
+func TestPositiveRedisQueue(t *testing.T) {
+	check := assert.New(t)
+	server, q := getRedisQueue(t, "worker-1")
+	defer server.Close()
+	defer q.Close()
+
+	_, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{Entries: []*sqs.SendMessageBatchRequestEntry{
+		{Id: aws.String("0"), MessageBody: aws.String("first"), MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"source": {DataType: aws.String("String"), StringValue: aws.String("test")},
+		}},
+		{Id: aws.String("1"), MessageBody: aws.String("second")},
+		{Id: aws.String("2"), MessageBody: aws.String("delayed"), DelaySeconds: aws.Int64(5)},
+	}})
+	check.NoError(err)
+
+	out, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{
+		MaxNumberOfMessages:   aws.Int64(10),
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	})
+	check.NoError(err)
+	check.Len(out.Messages, 2)
+	check.Equal("first", aws.StringValue(out.Messages[0].Body))
+	check.Equal("test", aws.StringValue(out.Messages[0].MessageAttributes["source"].StringValue))
+
+	// pending messages are not read again
+	again, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.NoError(err)
+	check.Empty(again.Messages)
+
+	deleteOut, err := q.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{Entries: []*sqs.DeleteMessageBatchRequestEntry{
+		{Id: aws.String("0"), ReceiptHandle: out.Messages[0].ReceiptHandle},
+		{Id: aws.String("1"), ReceiptHandle: out.Messages[0].ReceiptHandle},
+	}})
+	check.NoError(err)
+	check.Len(deleteOut.Successful, 1)
+	check.Len(deleteOut.Failed, 1)
+
+	attributes, err := q.GetQueueAttributes(&sqs.GetQueueAttributesInput{})
+	check.NoError(err)
+	check.Equal("1", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible]))
+}
+
+// TestPositiveRedisQueueClaim - tests abandoned and nacked messages are claimed by another consumer
+func TestPositiveRedisQueueClaim(t *testing.T) {
+	check := assert.New(t)
+	server, q := getRedisQueue(t, "worker-1")
+	defer server.Close()
+	other, err := NewRedisQueue(q.client, redisStream, RedisQueueOptions{Consumer: "worker-2", ClaimIdleTime: time.Second})
+	check.NoError(err)
+
+	_, err = q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("first")})
+	check.NoError(err)
+	_, err = q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("second")})
+	check.NoError(err)
+	out, _ := q.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.Len(out.Messages, 2)
+
+	// nack makes the first message claimable straight away
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     out.Messages[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	check.NoError(err)
+	claimed, err := other.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.NoError(err)
+	check.Len(claimed.Messages, 1)
+	check.Equal("first", aws.StringValue(claimed.Messages[0].Body))
+	_, err = other.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{Entries: []*sqs.DeleteMessageBatchRequestEntry{
+		{Id: aws.String("0"), ReceiptHandle: claimed.Messages[0].ReceiptHandle},
+	}})
+	check.NoError(err)
+
+	// the second message is claimed once it has been idle for the claim idle time
+	server.SetTime(time.Now().Add(2 * time.Second))
+	claimed, err = other.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.NoError(err)
+	check.Len(claimed.Messages, 1)
+	check.Equal("second", aws.StringValue(claimed.Messages[0].Body))
+
+	// acknowledged messages cannot be nacked
+	_, err = other.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{Entries: []*sqs.DeleteMessageBatchRequestEntry{
+		{Id: aws.String("0"), ReceiptHandle: claimed.Messages[0].ReceiptHandle},
+	}})
+	check.NoError(err)
+	_, err = other.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     claimed.Messages[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	check.Error(err)
+}
+
+// TestPositiveRedisQueueDelay - tests messages delayed past the claim idle time are not claimed before their delay
+func TestPositiveRedisQueueDelay(t *testing.T) {
+	check := assert.New(t)
+	server, q := getRedisQueue(t, "worker-1")
+	defer server.Close()
+	other, err := NewRedisQueue(q.client, redisStream, RedisQueueOptions{Consumer: "worker-2", ClaimIdleTime: time.Second})
+	check.NoError(err)
+
+	_, err = q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("first")})
+	check.NoError(err)
+	out, _ := q.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.Len(out.Messages, 1)
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     out.Messages[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(60),
+	})
+	check.NoError(err)
+
+	// idle past the claim idle time, but still delayed
+	start := time.Now()
+	server.SetTime(start.Add(2 * time.Second))
+	claimed, err := other.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.NoError(err)
+	check.Empty(claimed.Messages)
+
+	server.SetTime(start.Add(62 * time.Second))
+	claimed, err = other.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.NoError(err)
+	check.Len(claimed.Messages, 1)
+	check.Equal("first", aws.StringValue(claimed.Messages[0].Body))
+	check.False(server.Exists(redisStream + ":go-worker:not-before"))
+}
+
+// TestPositiveRedisQueueClaimCursor - tests claims resume after the entries claimed last time
+func TestPositiveRedisQueueClaimCursor(t *testing.T) {
+	check := assert.New(t)
+	server, q := getRedisQueue(t, "worker-1")
+	defer server.Close()
+	defer q.Close()
+	other, err := NewRedisQueue(q.client, redisStream, RedisQueueOptions{Consumer: "worker-2", ClaimIdleTime: time.Second})
+	check.NoError(err)
+
+	var ids []string
+	for _, body := range []string{"first", "second", "third"} {
+		sent, err := q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String(body)})
+		check.NoError(err)
+		ids = append(ids, aws.StringValue(sent.MessageId))
+	}
+	out, _ := q.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.Len(out.Messages, 3)
+
+	// the first message is delayed, claiming it must not stop the scan at the head of the pending list
+	server.SetTime(time.Now())
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     out.Messages[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(60),
+	})
+	check.NoError(err)
+	server.SetTime(time.Now().Add(2 * time.Second))
+
+	claimed, err := other.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(1)})
+	check.NoError(err)
+	check.Empty(claimed.Messages)
+	check.Equal(ids[1], other.claimCursor)
+
+	// the next claim carries on from the cursor, the delayed message is not claimed again
+	claimed, err = other.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.NoError(err)
+	check.NotEmpty(claimed.Messages)
+	for _, message := range claimed.Messages {
+		check.NotEqual("first", aws.StringValue(message.Body))
+	}
+	check.Equal("0-0", other.claimCursor)
+}
+
+// getRedisQueue - starts an in-process redis and opens a queue on it
+func getRedisQueue(t *testing.T, consumer string) (*miniredis.Miniredis, *RedisQueue) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("unable to start redis: %s", err)
+	}
+	q, err := OpenRedisQueue("redis://"+server.Addr()+"/"+redisStream, RedisQueueOptions{
+		Consumer:      consumer,
+		ClaimIdleTime: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to open redis queue: %s", err)
+	}
+	return server, q
+}
@@ -0,0 +1,417 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+	dataadapters "go-worker/data_adapters"
+	"go-worker/logger"
+	"go-worker/utils"
+)
+
+const (
+	// SQLScheme - url scheme of sql table backed queues
+	SQLScheme = "sql"
+	// JobStatusReady - status of jobs which are waiting or leased
+	JobStatusReady = "ready"
+	// JobStatusDead - status of jobs which used up their attempts
+	JobStatusDead = "dead"
+	// DeadMessagesAttribute - queue attribute holding the number of dead jobs
+	DeadMessagesAttribute = "ApproximateNumberOfDeadMessages"
+	// defaultSQLPollInterval - time between claims of a long poll
+	defaultSQLPollInterval = time.Second
+	// maxDelaySeconds - longest delay sqs accepts for a message
+	maxDelaySeconds = 900
+)
+
+// tableNamePattern - table names which can be safely put in a query
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLQueueOptions - holds customizable fields of a sql table queue
+type SQLQueueOptions struct {
+	Dialect      string
+	DSN          string
+	LeaseTime    int64
+	MaxAttempts  int
+	PollInterval time.Duration
+	SkipLocked   bool
+}
+
+// NewSQLQueueOptions - returns sql queue options from config
+// the queue uses the database holding call_info unless another one is configured
+func NewSQLQueueOptions() SQLQueueOptions {
+	cfg := config.GetConfig()
+	options := SQLQueueOptions{
+		Dialect:      utils.GetValue(cfg.GetString("sql_queue.dialect"), dataadapters.Engine()).(string),
+		DSN:          cfg.GetString("sql_queue.dsn"),
+		LeaseTime:    cfg.GetInt64("sql_queue.lease_time"),
+		MaxAttempts:  cfg.GetInt("sql_queue.max_attempts"),
+		PollInterval: time.Duration(cfg.GetInt("sql_queue.poll_interval")) * time.Millisecond,
+		SkipLocked:   cfg.GetBool("sql_queue.skip_locked"),
+	}
+	if options.DSN == "" {
+		options.DSN, _ = dataadapters.ConnectionString()
+	}
+	return options
+}
+
+// sqlJob - holds a single row of the job table
+type sqlJob struct {
+	ID              int64  `gorm:"primary_key"`
+	Body            string `gorm:"type:text;not null"`
+	Attributes      string `gorm:"type:text"`
+	Status          string `gorm:"size:16;not null"`
+	Attempts        int    `gorm:"not null"`
+	LeaseToken      string `gorm:"size:36"`
+	VisibleAt       int64  `gorm:"not null"`
+	SentAt          int64  `gorm:"not null"`
+	FirstReceivedAt int64
+}
+
+// SQLQueue - queue which keeps jobs in a sql table
+// receiving a job leases it by writing a new lease token and pushing its visible time
+// past the lease, receipt handles carry the job id and lease token so a worker whose
+// lease expired cannot ack or extend a job another worker has claimed since. jobs
+// whose lease expires after max attempts are marked dead instead of being claimed again
+type SQLQueue struct {
+	sqsiface.SQSAPI
+	db      *gorm.DB
+	table   string
+	options SQLQueueOptions
+}
+
+// OpenSQLQueue - connects to the database and opens the table in a sql url, e.g. sql://billing_jobs
+func OpenSQLQueue(queueURL string, options SQLQueueOptions) (*SQLQueue, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sql queue url")
+	}
+	db, err := gorm.Open(options.Dialect, options.DSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to the queue database")
+	}
+	q, err := NewSQLQueue(db, u.Host, options)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// NewSQLQueue - returns a queue for a job table, the table is created by the migrations
+func NewSQLQueue(db *gorm.DB, table string, options SQLQueueOptions) (*SQLQueue, error) {
+	if !tableNamePattern.MatchString(table) {
+		return nil, errors.Errorf("invalid job table name %q", table)
+	}
+	if options.LeaseTime <= 0 {
+		options.LeaseTime = defaultVisibilityTimeout
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultSQLPollInterval
+	}
+	return &SQLQueue{db: db, table: table, options: options}, nil
+}
+
+// Close - closes the database connection
+func (q *SQLQueue) Close() error {
+	return q.db.Close()
+}
+
+// SendMessage - inserts a single job
+func (q *SQLQueue) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	out, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: in.QueueUrl,
+		Entries: []*sqs.SendMessageBatchRequestEntry{{
+			Id:                aws.String("0"),
+			MessageBody:       in.MessageBody,
+			DelaySeconds:      in.DelaySeconds,
+			MessageAttributes: in.MessageAttributes,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Failed) > 0 {
+		return nil, awserr.New(aws.StringValue(out.Failed[0].Code), aws.StringValue(out.Failed[0].Message), nil)
+	}
+	return &sqs.SendMessageOutput{
+		MessageId:        out.Successful[0].MessageId,
+		MD5OfMessageBody: out.Successful[0].MD5OfMessageBody,
+	}, nil
+}
+
+// SendMessageBatch - inserts jobs in a single transaction
+func (q *SQLQueue) SendMessageBatch(in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	ids := make([]*string, 0, len(in.Entries))
+	for _, entry := range in.Entries {
+		ids = append(ids, entry.Id)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	now := nowMillis()
+	out := &sqs.SendMessageBatchOutput{}
+	tx := q.db.Begin()
+	if tx.Error != nil {
+		return nil, errors.Wrap(tx.Error, "unable to begin transaction")
+	}
+	defer tx.RollbackUnlessCommitted()
+	for _, entry := range in.Entries {
+		delay := aws.Int64Value(entry.DelaySeconds)
+		if delay < 0 || delay > maxDelaySeconds {
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String(errInvalidParameterValue),
+				Message:     aws.String("delay seconds must be between 0 and 900"),
+				SenderFault: aws.Bool(true),
+			})
+			continue
+		}
+		var attributes []byte
+		if len(entry.MessageAttributes) > 0 {
+			attributes, _ = json.Marshal(entry.MessageAttributes)
+		}
+		job := &sqlJob{
+			Body:       aws.StringValue(entry.MessageBody),
+			Attributes: string(attributes),
+			Status:     JobStatusReady,
+			VisibleAt:  now + delay*1000,
+			SentAt:     now,
+		}
+		if err := tx.Table(q.table).Create(job).Error; err != nil {
+			return nil, errors.Wrap(err, "unable to insert job")
+		}
+		out.Successful = append(out.Successful, &sqs.SendMessageBatchResultEntry{
+			Id:               entry.Id,
+			MessageId:        aws.String(strconv.FormatInt(job.ID, 10)),
+			MD5OfMessageBody: aws.String(md5Hex(job.Body)),
+		})
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, errors.Wrap(err, "unable to commit jobs")
+	}
+	return out, nil
+}
+
+// ReceiveMessage - leases visible jobs, polling up to the wait time for them to arrive
+func (q *SQLQueue) ReceiveMessage(in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	maxMessages := utils.GetValue(int(aws.Int64Value(in.MaxNumberOfMessages)), 1).(int)
+	if maxMessages < 1 || maxMessages > maxBatchEntries {
+		return nil, awserr.New(errInvalidParameterValue, "MaxNumberOfMessages must be between 1 and 10", nil)
+	}
+	lease := q.options.LeaseTime
+	if in.VisibilityTimeout != nil {
+		lease = aws.Int64Value(in.VisibilityTimeout)
+	}
+	deadline := time.Now().Add(time.Duration(aws.Int64Value(in.WaitTimeSeconds)) * time.Second)
+
+	for {
+		messages, err := q.claim(maxMessages, lease, in.MessageAttributeNames)
+		if err != nil || len(messages) > 0 {
+			return &sqs.ReceiveMessageOutput{Messages: messages}, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return &sqs.ReceiveMessageOutput{}, nil
+		}
+		if remaining > q.options.PollInterval {
+			remaining = q.options.PollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// DeleteMessageBatch - deletes jobs whose lease is still held by the receipt handles
+func (q *SQLQueue) DeleteMessageBatch(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	ids := make([]*string, 0, len(in.Entries))
+	for _, entry := range in.Entries {
+		ids = append(ids, entry.Id)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, entry := range in.Entries {
+		id, token, ok := parseLeaseReceipt(aws.StringValue(entry.ReceiptHandle))
+		if !ok {
+			out.Failed = append(out.Failed, invalidReceiptEntry(entry.Id))
+			continue
+		}
+		result := q.db.Exec("DELETE FROM "+q.table+" WHERE id = ? AND lease_token = ? AND status = ?", id, token, JobStatusReady)
+		if result.Error != nil {
+			return nil, errors.Wrap(result.Error, "unable to delete job")
+		}
+		if result.RowsAffected == 0 {
+			out.Failed = append(out.Failed, invalidReceiptEntry(entry.Id))
+			continue
+		}
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+	return out, nil
+}
+
+// ChangeMessageVisibility - moves the end of a lease, a timeout of zero releases the job straight away
+func (q *SQLQueue) ChangeMessageVisibility(in *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	id, token, ok := parseLeaseReceipt(aws.StringValue(in.ReceiptHandle))
+	if !ok {
+		return nil, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, "receipt handle is not valid", nil)
+	}
+	visibleAt := nowMillis() + aws.Int64Value(in.VisibilityTimeout)*1000
+	result := q.db.Exec("UPDATE "+q.table+" SET visible_at = ? WHERE id = ? AND lease_token = ? AND status = ?", visibleAt, id, token, JobStatusReady)
+	if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "unable to change job lease")
+	}
+	if result.RowsAffected == 0 {
+		return nil, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, "receipt handle is not valid", nil)
+	}
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// GetQueueAttributes - returns job counts of the table
+func (q *SQLQueue) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	now := nowMillis()
+	counts := map[string]string{
+		sqs.QueueAttributeNameApproximateNumberOfMessages:           "status = ? AND visible_at <= ?",
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: "status = ? AND visible_at > ? AND attempts > 0",
+		sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed:    "status = ? AND visible_at > ? AND attempts = 0",
+	}
+	attributes := map[string]*string{
+		sqs.QueueAttributeNameVisibilityTimeout: aws.String(strconv.FormatInt(q.options.LeaseTime, 10)),
+	}
+	for name, condition := range counts {
+		var count int
+		if err := q.db.Table(q.table).Where(condition, JobStatusReady, now).Count(&count).Error; err != nil {
+			return nil, errors.Wrap(err, "unable to count jobs")
+		}
+		attributes[name] = aws.String(strconv.Itoa(count))
+	}
+	var dead int
+	if err := q.db.Table(q.table).Where("status = ?", JobStatusDead).Count(&dead).Error; err != nil {
+		return nil, errors.Wrap(err, "unable to count dead jobs")
+	}
+	attributes[DeadMessagesAttribute] = aws.String(strconv.Itoa(dead))
+	return &sqs.GetQueueAttributesOutput{Attributes: attributes}, nil
+}
+
+// claim - leases up to maxMessages visible jobs in a single transaction, marking jobs
+// which used up their attempts as dead first
+func (q *SQLQueue) claim(maxMessages int, lease int64, attributeNames []*string) ([]*sqs.Message, error) {
+	now := nowMillis()
+	tx := q.db.Begin()
+	if tx.Error != nil {
+		return nil, errors.Wrap(tx.Error, "unable to begin transaction")
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	if q.options.MaxAttempts > 0 {
+		err := tx.Exec("UPDATE "+q.table+" SET status = ?, lease_token = ? WHERE status = ? AND visible_at <= ? AND attempts >= ?",
+			JobStatusDead, "", JobStatusReady, now, q.options.MaxAttempts).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to mark dead jobs")
+		}
+	}
+
+	var jobs []sqlJob
+	query := "SELECT * FROM " + q.table + " WHERE status = ? AND visible_at <= ? ORDER BY id LIMIT ?" + q.lockClause()
+	if err := tx.Raw(query, JobStatusReady, now, maxMessages).Scan(&jobs).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, errors.Wrap(err, "unable to select jobs")
+	}
+
+	messages := make([]*sqs.Message, 0, len(jobs))
+	for _, job := range jobs {
+		attributes, err := job.messageAttributes()
+		if err != nil {
+			// a job whose attributes can not be read would fail every receive, so it is marked dead
+			logger.Log.WithError(err).WithField("job_id", job.ID).Error("Unable to read job attributes, marking the job dead")
+			err = tx.Exec("UPDATE "+q.table+" SET status = ?, lease_token = ? WHERE id = ?", JobStatusDead, "", job.ID).Error
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to mark dead job")
+			}
+			continue
+		}
+		job.LeaseToken = utils.GetTransactionID()
+		job.Attempts++
+		job.VisibleAt = now + lease*1000
+		if job.FirstReceivedAt == 0 {
+			job.FirstReceivedAt = now
+		}
+		err = tx.Exec("UPDATE "+q.table+" SET lease_token = ?, attempts = ?, visible_at = ?, first_received_at = ? WHERE id = ?",
+			job.LeaseToken, job.Attempts, job.VisibleAt, job.FirstReceivedAt, job.ID).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to lease job")
+		}
+		messages = append(messages, job.toMessage(attributes, attributeNames))
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, errors.Wrap(err, "unable to commit job leases")
+	}
+	return messages, nil
+}
+
+// lockClause - returns the row locking clause of the claim query for the dialect
+// sqlite locks the whole database for writes so it needs none
+func (q *SQLQueue) lockClause() string {
+	switch {
+	case q.db.Dialect().GetName() == "sqlite3":
+		return ""
+	case q.options.SkipLocked:
+		return " FOR UPDATE SKIP LOCKED"
+	default:
+		return " FOR UPDATE"
+	}
+}
+
+// messageAttributes - decodes the message attributes stored with a job
+func (job sqlJob) messageAttributes() (map[string]*sqs.MessageAttributeValue, error) {
+	var attributes map[string]*sqs.MessageAttributeValue
+	if job.Attributes == "" {
+		return attributes, nil
+	}
+	err := json.Unmarshal([]byte(job.Attributes), &attributes)
+	return attributes, errors.Wrap(err, "invalid job attributes")
+}
+
+// toMessage - converts a leased job and its decoded attributes to a sqs message
+func (job sqlJob) toMessage(attributes map[string]*sqs.MessageAttributeValue, attributeNames []*string) *sqs.Message {
+	return &sqs.Message{
+		MessageId:     aws.String(strconv.FormatInt(job.ID, 10)),
+		ReceiptHandle: aws.String(fmt.Sprintf("%d:%s", job.ID, job.LeaseToken)),
+		Body:          aws.String(job.Body),
+		MD5OfBody:     aws.String(md5Hex(job.Body)),
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameSentTimestamp:                    aws.String(strconv.FormatInt(job.SentAt, 10)),
+			sqs.MessageSystemAttributeNameApproximateReceiveCount:          aws.String(strconv.Itoa(job.Attempts)),
+			sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp: aws.String(strconv.FormatInt(job.FirstReceivedAt, 10)),
+		},
+		MessageAttributes: filterAttributes(attributes, attributeNames),
+	}
+}
+
+// parseLeaseReceipt - splits a receipt handle into the job id and lease token
+func parseLeaseReceipt(receiptHandle string) (int64, string, bool) {
+	idPart, token, ok := strings.Cut(receiptHandle, ":")
+	if !ok || token == "" {
+		return 0, "", false
+	}
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return id, token, true
+}
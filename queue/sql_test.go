@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	_ "modernc.org/sqlite" // Blank import for the pure go sqlite driver
+
+	"go-worker/logger"
+)
+
+// TestPositiveSQLQueue - tests insert, lease and delete of jobs in a sqlite table
+func TestPositiveSQLQueue(t *testing.T) {
+	check := assert.New(t)
+	q := getSQLQueue(t, 0)
+	defer q.Close()
+
+	out, err := q.SendMessageBatch(&sqs.SendMessageBatchInput{Entries: []*sqs.SendMessageBatchRequestEntry{
+		{Id: aws.String("0"), MessageBody: aws.String("first"), MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"source": {DataType: aws.String("String"), StringValue: aws.String("test")},
+		}},
+		{Id: aws.String("1"), MessageBody: aws.String("second")},
+		{Id: aws.String("2"), MessageBody: aws.String("delayed"), DelaySeconds: aws.Int64(60)},
+		{Id: aws.String("3"), MessageBody: aws.String("invalid"), DelaySeconds: aws.Int64(901)},
+	}})
+	check.NoError(err)
+	check.Len(out.Successful, 3)
+	check.Len(out.Failed, 1)
+
+	received, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{
+		MaxNumberOfMessages:   aws.Int64(10),
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	})
+	check.NoError(err)
+	check.Len(received.Messages, 2)
+	check.Equal("first", aws.StringValue(received.Messages[0].Body))
+	check.Equal("test", aws.StringValue(received.Messages[0].MessageAttributes["source"].StringValue))
+	check.Equal("1", aws.StringValue(received.Messages[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+
+	// leased jobs are not claimed again
+	again, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	check.NoError(err)
+	check.Empty(again.Messages)
+
+	deleteOut, err := q.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{Entries: []*sqs.DeleteMessageBatchRequestEntry{
+		{Id: aws.String("0"), ReceiptHandle: received.Messages[0].ReceiptHandle},
+		{Id: aws.String("1"), ReceiptHandle: received.Messages[0].ReceiptHandle},
+		{Id: aws.String("2"), ReceiptHandle: aws.String("invalid")},
+	}})
+	check.NoError(err)
+	check.Len(deleteOut.Successful, 1)
+	check.Len(deleteOut.Failed, 2)
+
+	attributes, err := q.GetQueueAttributes(&sqs.GetQueueAttributesInput{})
+	check.NoError(err)
+	check.Equal("0", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+	check.Equal("1", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible]))
+	check.Equal("1", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed]))
+}
+
+// TestPositiveSQLQueueLease - tests lease expiry, stale receipts and dead jobs
+func TestPositiveSQLQueueLease(t *testing.T) {
+	check := assert.New(t)
+	q := getSQLQueue(t, 2)
+	defer q.Close()
+
+	_, err := q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("first")})
+	check.NoError(err)
+	first := receiveSQL(t, q)
+	check.Len(first, 1)
+
+	// an expired lease lets another worker claim the job with a new receipt
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     first[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	check.NoError(err)
+	second := receiveSQL(t, q)
+	check.Len(second, 1)
+	check.Equal("2", aws.StringValue(second[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	check.NotEqual(aws.StringValue(first[0].ReceiptHandle), aws.StringValue(second[0].ReceiptHandle))
+
+	// the first worker can no longer ack or extend the job
+	deleteOut, err := q.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{Entries: []*sqs.DeleteMessageBatchRequestEntry{
+		{Id: aws.String("0"), ReceiptHandle: first[0].ReceiptHandle},
+	}})
+	check.NoError(err)
+	check.Len(deleteOut.Failed, 1)
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     first[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(30),
+	})
+	check.Error(err)
+
+	// the job is dead once its last lease expires
+	_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		ReceiptHandle:     second[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	check.NoError(err)
+	check.Empty(receiveSQL(t, q))
+
+	attributes, err := q.GetQueueAttributes(&sqs.GetQueueAttributesInput{})
+	check.NoError(err)
+	check.Equal("1", aws.StringValue(attributes.Attributes[DeadMessagesAttribute]))
+	check.Equal("0", aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+}
+
+// TestNegativeSQLQueueAttributes - tests jobs with unreadable attributes are marked dead instead of failing receives
+func TestNegativeSQLQueueAttributes(t *testing.T) {
+	check := assert.New(t)
+	logger.Init()
+	q := getSQLQueue(t, 0)
+	defer q.Close()
+
+	_, err := q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("first")})
+	check.NoError(err)
+	check.NoError(q.db.Exec("UPDATE billing_jobs SET attributes = ?", "{broken").Error)
+	_, err = q.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("second")})
+	check.NoError(err)
+
+	received := receiveSQL(t, q)
+	check.Len(received, 1)
+	check.Equal("second", aws.StringValue(received[0].Body))
+	attributes, err := q.GetQueueAttributes(&sqs.GetQueueAttributesInput{})
+	check.NoError(err)
+	check.Equal("1", aws.StringValue(attributes.Attributes[DeadMessagesAttribute]))
+}
+
+// getSQLQueue - opens a queue on a job table in a temporary sqlite database
+func getSQLQueue(t *testing.T, maxAttempts int) *SQLQueue {
+	sqlDB, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatalf("unable to open sqlite: %s", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	db, err := gorm.Open("sqlite3", sqlDB)
+	if err != nil {
+		t.Fatalf("unable to open sqlite: %s", err)
+	}
+	if _, err = NewSQLQueue(db, "billing-jobs", SQLQueueOptions{}); err == nil {
+		t.Fatal("opened a queue with an invalid table name")
+	}
+	err = db.Exec("CREATE TABLE billing_jobs (id INTEGER PRIMARY KEY AUTOINCREMENT, body TEXT NOT NULL, attributes TEXT, " +
+		"status VARCHAR(16) NOT NULL, attempts INTEGER NOT NULL, lease_token VARCHAR(36), visible_at BIGINT NOT NULL, " +
+		"sent_at BIGINT NOT NULL, first_received_at BIGINT)").Error
+	if err != nil {
+		t.Fatalf("unable to create job table: %s", err)
+	}
+	q, err := NewSQLQueue(db, "billing_jobs", SQLQueueOptions{MaxAttempts: maxAttempts})
+	if err != nil {
+		t.Fatalf("unable to open sql queue: %s", err)
+	}
+	return q
+}
+
+// receiveSQL - leases jobs without waiting
+func receiveSQL(t *testing.T, q *SQLQueue) []*sqs.Message {
+	out, err := q.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+	if err != nil {
+		t.Fatalf("unable to receive messages: %s", err)
+	}
+	return out.Messages
+}
@@ -0,0 +1,321 @@
+package sqsfake
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"go-worker/queue"
+	"go-worker/utils"
+)
+
+const (
+	// accountID - account id used in the queue urls of the fake server
+	accountID = "000000000000"
+	// errInvalidAction - sqs error code for unsupported actions
+	errInvalidAction = "InvalidAction"
+	// errMissingParameter - sqs error code for missing required parameters
+	errMissingParameter = "MissingParameter"
+	// maxParameterIndex - highest index scanned for numbered list parameters
+	maxParameterIndex = 10
+)
+
+// Server - in-process http server speaking the sqs query protocol
+// every queue is a memory queue, so receipt handles, visibility timeouts
+// and batch limits behave like they do on the file backed queue
+type Server struct {
+	*httptest.Server
+	options queue.FileQueueOptions
+	queues  map[string]*queue.FileQueue
+	lock    sync.Mutex
+}
+
+// NewServer - starts a fake sqs server, callers must Close it
+func NewServer(options queue.FileQueueOptions) *Server {
+	s := &Server{
+		options: options,
+		queues:  map[string]*queue.FileQueue{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// QueueURL - returns the url of a queue on the server, creating the queue if needed
+func (s *Server) QueueURL(name string) string {
+	s.Queue(name)
+	return fmt.Sprintf("%s/%s/%s", s.URL, accountID, name)
+}
+
+// Queue - returns the queue backing a queue name, creating it if needed
+func (s *Server) Queue(name string) *queue.FileQueue {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q, ok := s.queues[name]
+	if !ok {
+		q = queue.NewMemoryQueue(s.options)
+		s.queues[name] = q
+	}
+	return q
+}
+
+// handle - dispatches a query protocol request to the queue it targets
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, awserr.New(errMissingParameter, err.Error(), nil))
+		return
+	}
+	queueURL := r.Form.Get("QueueUrl")
+	if queueURL == "" {
+		writeError(w, awserr.New(errMissingParameter, "QueueUrl is required", nil))
+		return
+	}
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		writeError(w, awserr.New(sqs.ErrCodeQueueDoesNotExist, "invalid queue url", nil))
+		return
+	}
+	q := s.Queue(path.Base(u.Path))
+
+	action := r.Form.Get("Action")
+	var result interface{}
+	switch action {
+	case "SendMessage":
+		result, err = sendMessage(q, r.Form)
+	case "SendMessageBatch":
+		result, err = sendMessageBatch(q, r.Form)
+	case "ReceiveMessage":
+		result, err = receiveMessage(q, r.Form)
+	case "DeleteMessage":
+		_, err = q.DeleteMessage(&sqs.DeleteMessageInput{ReceiptHandle: aws.String(r.Form.Get("ReceiptHandle"))})
+	case "DeleteMessageBatch":
+		result, err = deleteMessageBatch(q, r.Form)
+	case "ChangeMessageVisibility":
+		_, err = q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			ReceiptHandle:     aws.String(r.Form.Get("ReceiptHandle")),
+			VisibilityTimeout: aws.Int64(formInt(r.Form, "VisibilityTimeout")),
+		})
+	case "GetQueueAttributes":
+		result, err = getQueueAttributes(q)
+	default:
+		err = awserr.New(errInvalidAction, "unsupported action "+action, nil)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, action, result)
+}
+
+// sendMessage - handles SendMessage
+func sendMessage(q *queue.FileQueue, form url.Values) (interface{}, error) {
+	out, err := q.SendMessage(&sqs.SendMessageInput{
+		MessageBody:       aws.String(form.Get("MessageBody")),
+		DelaySeconds:      aws.Int64(formInt(form, "DelaySeconds")),
+		MessageAttributes: formMessageAttributes(form, ""),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sendMessageResult{MessageID: aws.StringValue(out.MessageId), MD5OfMessageBody: aws.StringValue(out.MD5OfMessageBody)}, nil
+}
+
+// sendMessageBatch - handles SendMessageBatch
+func sendMessageBatch(q *queue.FileQueue, form url.Values) (interface{}, error) {
+	in := &sqs.SendMessageBatchInput{}
+	for i := 1; i <= maxParameterIndex+1; i++ {
+		prefix := fmt.Sprintf("SendMessageBatchRequestEntry.%d.", i)
+		if _, ok := form[prefix+"Id"]; !ok {
+			break
+		}
+		in.Entries = append(in.Entries, &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(form.Get(prefix + "Id")),
+			MessageBody:       aws.String(form.Get(prefix + "MessageBody")),
+			DelaySeconds:      aws.Int64(formInt(form, prefix+"DelaySeconds")),
+			MessageAttributes: formMessageAttributes(form, prefix),
+		})
+	}
+	out, err := q.SendMessageBatch(in)
+	if err != nil {
+		return nil, err
+	}
+	result := &sendMessageBatchResult{Failed: errorEntries(out.Failed)}
+	for _, entry := range out.Successful {
+		result.Successful = append(result.Successful, sendMessageResult{
+			ID:               aws.StringValue(entry.Id),
+			MessageID:        aws.StringValue(entry.MessageId),
+			MD5OfMessageBody: aws.StringValue(entry.MD5OfMessageBody),
+		})
+	}
+	return result, nil
+}
+
+// receiveMessage - handles ReceiveMessage
+func receiveMessage(q *queue.FileQueue, form url.Values) (interface{}, error) {
+	in := &sqs.ReceiveMessageInput{
+		MaxNumberOfMessages:   aws.Int64(formInt(form, "MaxNumberOfMessages")),
+		WaitTimeSeconds:       aws.Int64(formInt(form, "WaitTimeSeconds")),
+		MessageAttributeNames: aws.StringSlice(formList(form, "MessageAttributeName")),
+	}
+	if form.Get("VisibilityTimeout") != "" {
+		in.VisibilityTimeout = aws.Int64(formInt(form, "VisibilityTimeout"))
+	}
+	out, err := q.ReceiveMessage(in)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &receiveMessageResult{}
+	for _, message := range out.Messages {
+		m := messageXML{
+			MessageID:     aws.StringValue(message.MessageId),
+			ReceiptHandle: aws.StringValue(message.ReceiptHandle),
+			MD5OfBody:     aws.StringValue(message.MD5OfBody),
+			Body:          aws.StringValue(message.Body),
+		}
+		for name, value := range message.Attributes {
+			m.Attributes = append(m.Attributes, attributeXML{Name: name, Value: aws.StringValue(value)})
+		}
+		for name, value := range message.MessageAttributes {
+			attribute := messageAttributeXML{Name: name}
+			attribute.Value.DataType = aws.StringValue(value.DataType)
+			attribute.Value.StringValue = aws.StringValue(value.StringValue)
+			if value.BinaryValue != nil {
+				attribute.Value.BinaryValue = base64.StdEncoding.EncodeToString(value.BinaryValue)
+			}
+			m.MessageAttributes = append(m.MessageAttributes, attribute)
+		}
+		result.Messages = append(result.Messages, m)
+	}
+	return result, nil
+}
+
+// deleteMessageBatch - handles DeleteMessageBatch
+func deleteMessageBatch(q *queue.FileQueue, form url.Values) (interface{}, error) {
+	in := &sqs.DeleteMessageBatchInput{}
+	for i := 1; i <= maxParameterIndex+1; i++ {
+		prefix := fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.", i)
+		if _, ok := form[prefix+"Id"]; !ok {
+			break
+		}
+		in.Entries = append(in.Entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(form.Get(prefix + "Id")),
+			ReceiptHandle: aws.String(form.Get(prefix + "ReceiptHandle")),
+		})
+	}
+	out, err := q.DeleteMessageBatch(in)
+	if err != nil {
+		return nil, err
+	}
+	result := &deleteMessageBatchResult{Failed: errorEntries(out.Failed)}
+	for _, entry := range out.Successful {
+		result.Successful = append(result.Successful, idXML{ID: aws.StringValue(entry.Id)})
+	}
+	return result, nil
+}
+
+// getQueueAttributes - handles GetQueueAttributes
+func getQueueAttributes(q *queue.FileQueue) (interface{}, error) {
+	out, err := q.GetQueueAttributes(&sqs.GetQueueAttributesInput{})
+	if err != nil {
+		return nil, err
+	}
+	result := &getQueueAttributesResult{}
+	for name, value := range out.Attributes {
+		result.Attributes = append(result.Attributes, attributeXML{Name: name, Value: aws.StringValue(value)})
+	}
+	return result, nil
+}
+
+// formInt - returns an integer form value, zero when it is missing
+func formInt(form url.Values, key string) int64 {
+	value, _ := strconv.ParseInt(form.Get(key), 10, 64)
+	return value
+}
+
+// formList - returns the values of a flattened list parameter
+func formList(form url.Values, name string) []string {
+	var values []string
+	for i := 1; ; i++ {
+		value, ok := form[fmt.Sprintf("%s.%d", name, i)]
+		if !ok {
+			return values
+		}
+		values = append(values, value[0])
+	}
+}
+
+// formMessageAttributes - returns the message attributes of a request or a batch entry
+func formMessageAttributes(form url.Values, prefix string) map[string]*sqs.MessageAttributeValue {
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	for i := 1; ; i++ {
+		key := fmt.Sprintf("%sMessageAttribute.%d.", prefix, i)
+		name, ok := form[key+"Name"]
+		if !ok {
+			break
+		}
+		value := &sqs.MessageAttributeValue{DataType: aws.String(form.Get(key + "Value.DataType"))}
+		if stringValue, ok := form[key+"Value.StringValue"]; ok {
+			value.StringValue = aws.String(stringValue[0])
+		}
+		if binaryValue, ok := form[key+"Value.BinaryValue"]; ok {
+			value.BinaryValue, _ = base64.StdEncoding.DecodeString(binaryValue[0])
+		}
+		attributes[name[0]] = value
+	}
+	if len(attributes) == 0 {
+		return nil
+	}
+	return attributes
+}
+
+// errorEntries - converts failed batch entries to xml
+func errorEntries(entries []*sqs.BatchResultErrorEntry) []errorEntryXML {
+	var failed []errorEntryXML
+	for _, entry := range entries {
+		failed = append(failed, errorEntryXML{
+			ID:          aws.StringValue(entry.Id),
+			Code:        aws.StringValue(entry.Code),
+			Message:     aws.StringValue(entry.Message),
+			SenderFault: aws.BoolValue(entry.SenderFault),
+		})
+	}
+	return failed
+}
+
+// writeResult - writes a successful query protocol response
+func writeResult(w http.ResponseWriter, action string, result interface{}) {
+	response := responseXML{
+		XMLName:  xml.Name{Local: action + "Response"},
+		Metadata: metadataXML{RequestID: utils.GetTransactionID()},
+	}
+	if result != nil {
+		response.Result = &resultXML{XMLName: xml.Name{Local: action + "Result"}, Content: result}
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	_ = xml.NewEncoder(w).Encode(response)
+}
+
+// writeError - writes a query protocol error response
+func writeError(w http.ResponseWriter, err error) {
+	response := errorResponseXML{RequestID: utils.GetTransactionID()}
+	response.Error.Type = "Sender"
+	response.Error.Code = errInvalidAction
+	response.Error.Message = err.Error()
+	if awsErr, ok := err.(awserr.Error); ok {
+		response.Error.Code = awsErr.Code()
+		response.Error.Message = awsErr.Message()
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = xml.NewEncoder(w).Encode(response)
+}
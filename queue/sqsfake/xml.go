@@ -0,0 +1,106 @@
+package sqsfake
+
+import "encoding/xml"
+
+// responseXML - envelope of a successful query protocol response
+type responseXML struct {
+	XMLName  xml.Name
+	Result   *resultXML
+	Metadata metadataXML `xml:"ResponseMetadata"`
+}
+
+// resultXML - result element named after the action
+type resultXML struct {
+	XMLName xml.Name
+	Content interface{}
+}
+
+// MarshalXML - encodes the content inside an element named after the action
+func (r resultXML) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = r.XMLName
+	return e.EncodeElement(r.Content, start)
+}
+
+// metadataXML - response metadata element
+type metadataXML struct {
+	RequestID string `xml:"RequestId"`
+}
+
+// errorResponseXML - envelope of a query protocol error response
+type errorResponseXML struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	Error   struct {
+		Type    string
+		Code    string
+		Message string
+	}
+	RequestID string `xml:"RequestId"`
+}
+
+// attributeXML - name value pair of a flattened attribute map
+type attributeXML struct {
+	Name  string
+	Value string
+}
+
+// messageAttributeXML - message attribute of a received message
+type messageAttributeXML struct {
+	Name  string
+	Value struct {
+		StringValue string `xml:",omitempty"`
+		BinaryValue string `xml:",omitempty"`
+		DataType    string
+	}
+}
+
+// messageXML - received message
+type messageXML struct {
+	MessageID         string `xml:"MessageId"`
+	ReceiptHandle     string
+	MD5OfBody         string
+	Body              string
+	Attributes        []attributeXML        `xml:"Attribute"`
+	MessageAttributes []messageAttributeXML `xml:"MessageAttribute"`
+}
+
+// receiveMessageResult - result of ReceiveMessage
+type receiveMessageResult struct {
+	Messages []messageXML `xml:"Message"`
+}
+
+// sendMessageResult - result of SendMessage and entry of SendMessageBatch results
+type sendMessageResult struct {
+	ID               string `xml:"Id,omitempty"`
+	MessageID        string `xml:"MessageId"`
+	MD5OfMessageBody string
+}
+
+// idXML - successful batch entry which only carries its id
+type idXML struct {
+	ID string `xml:"Id"`
+}
+
+// errorEntryXML - failed batch entry
+type errorEntryXML struct {
+	ID          string `xml:"Id"`
+	Code        string
+	Message     string
+	SenderFault bool
+}
+
+// sendMessageBatchResult - result of SendMessageBatch
+type sendMessageBatchResult struct {
+	Successful []sendMessageResult `xml:"SendMessageBatchResultEntry"`
+	Failed     []errorEntryXML     `xml:"BatchResultErrorEntry"`
+}
+
+// deleteMessageBatchResult - result of DeleteMessageBatch
+type deleteMessageBatchResult struct {
+	Successful []idXML         `xml:"DeleteMessageBatchResultEntry"`
+	Failed     []errorEntryXML `xml:"BatchResultErrorEntry"`
+}
+
+// getQueueAttributesResult - result of GetQueueAttributes
+type getQueueAttributesResult struct {
+	Attributes []attributeXML `xml:"Attribute"`
+}
@@ -0,0 +1,165 @@
+package rating
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+	"go-worker/models"
+	"go-worker/money"
+	"go-worker/utils"
+	"go-worker/validation"
+)
+
+const (
+	// defaultDecimals - decimal places charge amounts are rounded to
+	defaultDecimals = 4
+	// secondsPerMinute - rates are given per minute
+	secondsPerMinute = 60
+)
+
+// Rate - holds how calls of a product are rated, amounts are decimal strings in Currency
+// the duration is rounded up to whole increments of Increment seconds and priced per minute,
+// then the connection fee is added and the total raised to the minimum charge
+type Rate struct {
+	ProductID     int    `json:"product_id" mapstructure:"product_id"`
+	PerMinute     string `json:"per_minute" mapstructure:"per_minute"`
+	Increment     int    `json:"increment" mapstructure:"increment"`
+	MinimumCharge string `json:"minimum_charge" mapstructure:"minimum_charge"`
+	ConnectionFee string `json:"connection_fee" mapstructure:"connection_fee"`
+	Currency      string `json:"currency" mapstructure:"currency"`
+}
+
+// rate - holds a rate with parsed amounts
+type rate struct {
+	perMinute     *big.Rat
+	increment     int64
+	minimumCharge *big.Rat
+	connectionFee *big.Rat
+	currency      string
+}
+
+// Engine - rates billing events locally with a rate table per product, used as a fallback
+// when the balance api fails, its responses are provisional until the api bills the event
+type Engine struct {
+	rates    map[int]rate
+	decimals int
+}
+
+// NewEngine - returns an engine with the rates in config and the rates file, or nil when it is disabled
+// rates in the file replace rates in config for the same product
+func NewEngine() (*Engine, error) {
+	cfg := config.GetConfig()
+	if !cfg.GetBool("rating.enabled") {
+		return nil, nil
+	}
+	var rates []Rate
+	if err := cfg.UnmarshalKey("rating.rates", &rates); err != nil {
+		return nil, errors.Wrap(err, "invalid rating.rates")
+	}
+	if ratesFile := cfg.GetString("rating.rates_file"); ratesFile != "" {
+		data, err := os.ReadFile(ratesFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read rates file")
+		}
+		var fileRates []Rate
+		if err = json.Unmarshal(data, &fileRates); err != nil {
+			return nil, errors.Wrap(err, "invalid rates file")
+		}
+		rates = append(rates, fileRates...)
+	}
+	decimals := defaultDecimals
+	if cfg.IsSet("rating.decimals") {
+		decimals = cfg.GetInt("rating.decimals")
+	}
+	return NewRateEngine(rates, decimals)
+}
+
+// NewRateEngine - returns an engine with the given rates, rounding charges to decimals places
+func NewRateEngine(rates []Rate, decimals int) (*Engine, error) {
+	if decimals < 0 || decimals > money.MaxScale {
+		return nil, errors.Errorf("rating decimals must be between 0 and %d", money.MaxScale)
+	}
+	engine := &Engine{rates: make(map[int]rate, len(rates)), decimals: decimals}
+	for _, r := range rates {
+		parsed, err := parseRate(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rate for product %d", r.ProductID)
+		}
+		engine.rates[r.ProductID] = parsed
+	}
+	return engine, nil
+}
+
+// Rate - returns the provisional balance response of a billing event
+func (e *Engine) Rate(event models.BillingEvent) (models.BalanceResponse, error) {
+	r, ok := e.rates[event.ProductID]
+	if !ok {
+		return models.BalanceResponse{}, errors.Errorf("no rate for product %d", event.ProductID)
+	}
+	answerTime, err := validation.ParseEventTime(event.AnswerTime)
+	if err != nil {
+		return models.BalanceResponse{}, errors.Wrap(err, "invalid answer_time")
+	}
+	hangupTime, err := validation.ParseEventTime(event.HangupTime)
+	if err != nil {
+		return models.BalanceResponse{}, errors.Wrap(err, "invalid hangup_time")
+	}
+	duration := int64(hangupTime.Sub(answerTime).Seconds())
+	if duration < 0 {
+		return models.BalanceResponse{}, errors.New("hangup_time is before answer_time")
+	}
+
+	// round the duration up to whole increments
+	billedSeconds := (duration + r.increment - 1) / r.increment * r.increment
+	charge := new(big.Rat).Mul(r.perMinute, big.NewRat(billedSeconds, secondsPerMinute))
+	charge.Add(charge, r.connectionFee)
+	if charge.Cmp(r.minimumCharge) < 0 {
+		charge.Set(r.minimumCharge)
+	}
+	return models.BalanceResponse{
+		CallID:             event.CallID,
+		TotalConsumedUnits: int(billedSeconds),
+		ChargeAmount:       money.FromRat(charge, int32(e.decimals)),
+		Currency:           r.currency,
+		Provisional:        true,
+	}, nil
+}
+
+// parseRate - parses the amounts of a rate, empty fees and charges are zero
+func parseRate(r Rate) (rate, error) {
+	parsed := rate{increment: int64(r.Increment), currency: utils.GetValue(r.Currency, money.DefaultCurrency).(string)}
+	if parsed.increment == 0 {
+		parsed.increment = 1
+	}
+	if parsed.increment < 0 {
+		return parsed, errors.New("increment must be positive")
+	}
+	if err := money.ValidateCurrency(parsed.currency); err != nil {
+		return parsed, err
+	}
+	var err error
+	if parsed.perMinute, err = parseAmount("per_minute", r.PerMinute); err != nil {
+		return parsed, err
+	}
+	if parsed.minimumCharge, err = parseAmount("minimum_charge", r.MinimumCharge); err != nil {
+		return parsed, err
+	}
+	parsed.connectionFee, err = parseAmount("connection_fee", r.ConnectionFee)
+	return parsed, err
+}
+
+// parseAmount - parses a non negative decimal amount, empty amounts are zero
+func parseAmount(name, amount string) (*big.Rat, error) {
+	if amount == "" {
+		return new(big.Rat), nil
+	}
+	value, err := money.Parse(amount)
+	if err != nil || value.Sign() < 0 {
+		return nil, errors.Errorf("%s must be a non negative decimal, got %q", name, amount)
+	}
+	return value.Rat(), nil
+}
@@ -0,0 +1,94 @@
+package rating
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/config"
+	"go-worker/models"
+)
+
+// TestPositiveRate - tests increment rounding, connection fees and minimum charges
+func TestPositiveRate(t *testing.T) {
+	check := assert.New(t)
+	engine := getEngine(t)
+
+	// 30 minutes 1 second in 60 second increments is 31 minutes, plus the connection fee
+	event := getBillingEvent(2, "2021-07-01 00:30:00", "2021-07-01 01:00:01")
+	response, err := engine.Rate(event)
+	check.NoError(err)
+	check.Equal(event.CallID, response.CallID)
+	check.Equal(1860, response.TotalConsumedUnits)
+	check.Equal("0.5150", response.ChargeAmount.String())
+	check.Equal("USD", response.Currency)
+	check.True(response.Provisional)
+
+	// a short call is raised to the minimum charge
+	response, err = engine.Rate(getBillingEvent(2, "2021-07-01 00:30:00", "2021-07-01 00:30:05"))
+	check.NoError(err)
+	check.Equal("0.1000", response.ChargeAmount.String())
+
+	// per second rates from the rates file replace config
+	response, err = engine.Rate(getBillingEvent(3, "2021-07-01 00:30:00", "2021-07-01 00:30:05"))
+	check.NoError(err)
+	check.Equal(5, response.TotalConsumedUnits)
+	check.Equal("0.0100", response.ChargeAmount.String())
+	check.Equal("EUR", response.Currency)
+}
+
+// TestNegativeRate - tests unknown products, invalid times and invalid rates are reported
+func TestNegativeRate(t *testing.T) {
+	check := assert.New(t)
+	engine := getEngine(t)
+
+	_, err := engine.Rate(getBillingEvent(9, "2021-07-01 00:30:00", "2021-07-01 01:00:00"))
+	check.Error(err)
+	_, err = engine.Rate(getBillingEvent(2, "2021-07-01 01:00:00", "2021-07-01 00:30:00"))
+	check.Error(err)
+	_, err = engine.Rate(getBillingEvent(2, "yesterday", "2021-07-01 00:30:00"))
+	check.Error(err)
+
+	_, err = NewRateEngine([]Rate{{ProductID: 1, PerMinute: "-1"}}, 4)
+	check.Error(err)
+	_, err = NewRateEngine([]Rate{{ProductID: 1, PerMinute: "0.01", Increment: -60}}, 4)
+	check.Error(err)
+	_, err = NewRateEngine([]Rate{{ProductID: 1, PerMinute: "0.01", Currency: "usd"}}, 4)
+	check.Error(err)
+}
+
+// getEngine - returns an engine with rates from config and a rates file
+func getEngine(t *testing.T) *Engine {
+	ratesFile := filepath.Join(t.TempDir(), "rates.json")
+	err := os.WriteFile(ratesFile, []byte(`[{"product_id": 3, "per_minute": "0.12", "increment": 1, "currency": "EUR"}]`), 0o644)
+	if err != nil {
+		t.Fatalf("unable to write rates file: %s", err)
+	}
+	v := viper.New()
+	v.Set("rating.enabled", true)
+	v.Set("rating.rates_file", ratesFile)
+	v.Set("rating.rates", []map[string]interface{}{
+		{"product_id": 2, "per_minute": "0.015", "increment": 60, "minimum_charge": "0.1", "connection_fee": "0.05"},
+		{"product_id": 3, "per_minute": "1"},
+	})
+	config.SetConfig(v)
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("unable to create rating engine: %s", err)
+	}
+	return engine
+}
+
+// getBillingEvent - prepares a bill event of a product between the given times
+func getBillingEvent(productID int, answerTime, hangupTime string) models.BillingEvent {
+	return models.BillingEvent{
+		UserID:     1,
+		ProductID:  productID,
+		CallID:     "e21b0dda-6566-402a-8f8c-0657e5b87eeb",
+		AnswerTime: answerTime,
+		HangupTime: hangupTime,
+	}
+}
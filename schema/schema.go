@@ -0,0 +1,134 @@
+package schema
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"go-worker/models"
+)
+
+const (
+	// VersionAttribute - message attribute naming the schema version of the event,
+	// it takes precedence over the schema_version field of the body
+	VersionAttribute = "schema_version"
+	// CurrentVersion - schema version of models.BillingEvent
+	CurrentVersion = 2
+	// DefaultVersion - schema version of events which do not name one, published before versioning
+	DefaultVersion = 1
+)
+
+var (
+	// DecodedEvents - number of events decoded per schema version, served on /debug/vars
+	DecodedEvents = expvar.NewMap("billing_events_decoded")
+	// UpcastEvents - number of events upcast per source schema version, served on /debug/vars
+	UpcastEvents = expvar.NewMap("billing_events_upcast")
+	// versions - registered schema versions by number
+	versions = map[int]Version{}
+	// versionsLock - guards versions
+	versionsLock sync.RWMutex
+)
+
+// Converter - upcasts an event of one schema version to the struct of the next version
+type Converter func(event interface{}) (interface{}, error)
+
+// Version - holds how events of a schema version are decoded and upcast
+type Version struct {
+	// New - returns a pointer to the struct events of the version decode into
+	New func() interface{}
+	// Upcast - converts a decoded event to the next version, nil for the current version
+	Upcast Converter
+}
+
+// versionField - json form of the version field of an event body
+type versionField struct {
+	SchemaVersion json.RawMessage `json:"schema_version"`
+}
+
+// Register - registers a schema version, replacing any version registered with the same number
+func Register(version int, definition Version) {
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
+	versions[version] = definition
+}
+
+// VersionOf - returns the schema version of an event from its attributes or body
+func VersionOf(body []byte, attributes map[string]string) (int, error) {
+	if value, ok := attributes[VersionAttribute]; ok {
+		version, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(value), "v"))
+		if err != nil || version <= 0 {
+			return 0, errors.Errorf("invalid schema version attribute %q", value)
+		}
+		return version, nil
+	}
+	field := versionField{}
+	if err := json.Unmarshal(body, &field); err != nil {
+		return 0, err
+	}
+	if len(field.SchemaVersion) == 0 || string(field.SchemaVersion) == "null" {
+		return DefaultVersion, nil
+	}
+	var version int
+	if err := json.Unmarshal(field.SchemaVersion, &version); err != nil || version <= 0 {
+		return 0, errors.Errorf("invalid schema version field %s", string(field.SchemaVersion))
+	}
+	return version, nil
+}
+
+// IsKnown - returns true if events of the version can be decoded
+func IsKnown(version int) bool {
+	versionsLock.RLock()
+	defer versionsLock.RUnlock()
+	_, ok := versions[version]
+	return ok
+}
+
+// Decode - decodes an event body of the given version into its own struct and upcasts it
+// through the registered converters to the current BillingEvent
+func Decode(body []byte, version int) (models.BillingEvent, error) {
+	versionsLock.RLock()
+	defer versionsLock.RUnlock()
+
+	definition, ok := versions[version]
+	if !ok {
+		return models.BillingEvent{}, errors.Errorf("unknown schema version %d", version)
+	}
+	event := definition.New()
+	if err := json.Unmarshal(body, event); err != nil {
+		return models.BillingEvent{}, err
+	}
+	DecodedEvents.Add(versionKey(version), 1)
+	if version < CurrentVersion {
+		UpcastEvents.Add(versionKey(version), 1)
+	}
+
+	for current := version; current < CurrentVersion; current++ {
+		if definition.Upcast == nil {
+			return models.BillingEvent{}, errors.Errorf("no converter from schema version %d", current)
+		}
+		var err error
+		if event, err = definition.Upcast(event); err != nil {
+			return models.BillingEvent{}, errors.Wrapf(err, "unable to upcast schema version %d", current)
+		}
+		if definition, ok = versions[current+1]; !ok {
+			return models.BillingEvent{}, errors.Errorf("unknown schema version %d", current+1)
+		}
+	}
+
+	billingEvent, ok := event.(*models.BillingEvent)
+	if !ok {
+		return models.BillingEvent{}, errors.Errorf("schema version %d does not decode into a billing event", CurrentVersion)
+	}
+	billingEvent.SchemaVersion = CurrentVersion
+	return *billingEvent, nil
+}
+
+// versionKey - returns the metric key of a schema version
+func versionKey(version int) string {
+	return fmt.Sprintf("v%d", version)
+}
@@ -0,0 +1,91 @@
+package schema
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/models"
+)
+
+// TestPositiveDecode - tests each version is detected, decoded and upcast to the current event
+func TestPositiveDecode(t *testing.T) {
+	check := assert.New(t)
+	upcast := counter("v1", UpcastEvents)
+
+	v1 := []byte(`{"user_id": 1, "product_id": 2, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "direction": "outbound"}`)
+	version, err := VersionOf(v1, nil)
+	check.NoError(err)
+	check.Equal(DefaultVersion, version)
+	event, err := Decode(v1, version)
+	check.NoError(err)
+	check.Equal(CurrentVersion, event.SchemaVersion)
+	check.Equal(1, event.UserID)
+	check.Empty(event.Direction)
+	check.Equal(upcast+1, counter("v1", UpcastEvents))
+
+	v2 := []byte(`{"schema_version": 2, "user_id": 1, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "currency": "EUR", "direction": "inbound"}`)
+	version, err = VersionOf(v2, nil)
+	check.NoError(err)
+	check.Equal(2, version)
+	event, err = Decode(v2, version)
+	check.NoError(err)
+	check.Equal("EUR", event.Currency)
+	check.Equal("inbound", event.Direction)
+
+	// the attribute wins over the body field
+	version, err = VersionOf(v2, map[string]string{VersionAttribute: "v1"})
+	check.NoError(err)
+	check.Equal(1, version)
+}
+
+// TestPositiveRegister - tests registered converters are chained to the current version
+func TestPositiveRegister(t *testing.T) {
+	check := assert.New(t)
+	type eventV0 struct {
+		User int `json:"user"`
+	}
+	Register(0, Version{
+		New: func() interface{} { return &eventV0{} },
+		Upcast: func(event interface{}) (interface{}, error) {
+			return &EventV1{UserID: event.(*eventV0).User}, nil
+		},
+	})
+	defer func() {
+		versionsLock.Lock()
+		delete(versions, 0)
+		versionsLock.Unlock()
+	}()
+
+	event, err := Decode([]byte(`{"user": 7}`), 0)
+	check.NoError(err)
+	check.Equal(models.BillingEvent{SchemaVersion: CurrentVersion, UserID: 7}, event)
+}
+
+// TestNegativeDecode - tests invalid and unknown versions are reported
+func TestNegativeDecode(t *testing.T) {
+	check := assert.New(t)
+	_, err := VersionOf([]byte(`{"schema_version": "two"}`), nil)
+	check.Error(err)
+	_, err = VersionOf([]byte(`{}`), map[string]string{VersionAttribute: "latest"})
+	check.Error(err)
+	_, err = VersionOf([]byte(`not json`), nil)
+	check.Error(err)
+
+	check.False(IsKnown(3))
+	_, err = Decode([]byte(`{}`), 3)
+	check.Error(err)
+
+	_, err = Decode([]byte(`{"user_id": "1"}`), 1)
+	check.Error(err)
+}
+
+// counter - returns the value of a per version counter
+func counter(key string, metric *expvar.Map) int64 {
+	value, ok := metric.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return value.Value()
+}
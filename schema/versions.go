@@ -0,0 +1,46 @@
+package schema
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"go-worker/models"
+)
+
+// EventV1 - holds a billing event in schema version 1, the shape published before versioning
+type EventV1 struct {
+	UserID     int             `json:"user_id"`
+	ProductID  int             `json:"product_id"`
+	CallID     string          `json:"call_id"`
+	AnswerTime string          `json:"answer_time"`
+	HangupTime string          `json:"hangup_time"`
+	CDR        json.RawMessage `json:"cdr,omitempty"`
+}
+
+func init() {
+	Register(1, Version{
+		New:    func() interface{} { return &EventV1{} },
+		Upcast: upcastV1,
+	})
+	Register(CurrentVersion, Version{
+		New: func() interface{} { return &models.BillingEvent{} },
+	})
+}
+
+// upcastV1 - converts a version 1 event to version 2, which adds currency, direction
+// and destination, left empty as version 1 producers do not know them
+func upcastV1(event interface{}) (interface{}, error) {
+	v1, ok := event.(*EventV1)
+	if !ok {
+		return nil, errors.Errorf("unexpected version 1 event %T", event)
+	}
+	return &models.BillingEvent{
+		UserID:     v1.UserID,
+		ProductID:  v1.ProductID,
+		CallID:     v1.CallID,
+		AnswerTime: v1.AnswerTime,
+		HangupTime: v1.HangupTime,
+		CDR:        v1.CDR,
+	}, nil
+}
@@ -0,0 +1,133 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go-worker/config"
+)
+
+const (
+	// SignatureAttribute - message attribute holding the hex encoded hmac-sha256 signature
+	SignatureAttribute = "signature"
+	// TimestampAttribute - message attribute holding the unix time the message was signed at
+	TimestampAttribute = "signature_timestamp"
+	// KeyIDAttribute - message attribute naming the key the message was signed with
+	KeyIDAttribute = "signature_key_id"
+	// AttributeCount - number of message attributes a signature takes up
+	AttributeCount = 3
+	// defaultMaxAge - age in seconds after which signed messages are stale
+	defaultMaxAge = 300
+)
+
+var (
+	// ErrUnsigned - the message carries no signature but one is required
+	ErrUnsigned = errors.New("message is not signed")
+	// ErrStale - the message was signed too long ago or too far in the future
+	ErrStale = errors.New("message signature is stale")
+	// ErrUnknownKey - the message was signed with a key which is not configured
+	ErrUnknownKey = errors.New("message is signed with an unknown key")
+	// ErrForged - the signature does not match the message
+	ErrForged = errors.New("message signature does not match")
+)
+
+// Keyring - holds the hmac keys messages are signed and verified with, by key id
+// messages are signed with SigningKeyID and verified with whichever key they name,
+// so keys can be rotated by adding the new key everywhere before switching producers to it
+type Keyring struct {
+	Keys         map[string][]byte
+	SigningKeyID string
+	Required     bool
+	MaxAge       time.Duration
+}
+
+// NewKeyring - returns a keyring from config, or nil when no keys are configured
+func NewKeyring() (*Keyring, error) {
+	cfg := config.GetConfig()
+	keys := cfg.GetStringMapString("signing.keys")
+	if len(keys) == 0 {
+		if cfg.GetBool("signing.required") {
+			return nil, errors.New("signing is required but no signing keys are configured")
+		}
+		return nil, nil
+	}
+	keyring := &Keyring{
+		Keys:         make(map[string][]byte, len(keys)),
+		SigningKeyID: cfg.GetString("signing.key_id"),
+		Required:     cfg.GetBool("signing.required"),
+		MaxAge:       time.Duration(cfg.GetInt("signing.max_age")) * time.Second,
+	}
+	for keyID, key := range keys {
+		keyring.Keys[keyID] = []byte(key)
+	}
+	if keyring.SigningKeyID != "" && keyring.Keys[keyring.SigningKeyID] == nil {
+		return nil, errors.Errorf("signing key %s is not configured", keyring.SigningKeyID)
+	}
+	if keyring.MaxAge <= 0 {
+		keyring.MaxAge = defaultMaxAge * time.Second
+	}
+	return keyring, nil
+}
+
+// CanSign - returns true if the keyring has a key to sign messages with
+func (k *Keyring) CanSign() bool {
+	return k != nil && k.SigningKeyID != ""
+}
+
+// Sign - returns the signature attributes of a message body signed at now
+func (k *Keyring) Sign(body string, now time.Time) (map[string]string, error) {
+	if !k.CanSign() {
+		return nil, errors.New("no signing key is configured")
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return map[string]string{
+		SignatureAttribute: Signature(k.Keys[k.SigningKeyID], timestamp, body),
+		TimestampAttribute: timestamp,
+		KeyIDAttribute:     k.SigningKeyID,
+	}, nil
+}
+
+// Verify - checks the signature attributes of a message body, unsigned messages
+// are only accepted when signatures are not required
+func (k *Keyring) Verify(body string, attributes map[string]string, now time.Time) error {
+	signature, signed := attributes[SignatureAttribute]
+	if !signed {
+		if k.Required {
+			return ErrUnsigned
+		}
+		return nil
+	}
+	key, ok := k.Keys[attributes[KeyIDAttribute]]
+	if !ok {
+		return errors.Wrap(ErrUnknownKey, attributes[KeyIDAttribute])
+	}
+	timestamp := attributes[TimestampAttribute]
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.Wrap(ErrStale, "invalid signature timestamp")
+	}
+	if age := now.Sub(time.Unix(signedAt, 0)); age > k.MaxAge || age < -k.MaxAge {
+		return ErrStale
+	}
+	expected, err := hex.DecodeString(Signature(key, timestamp, body))
+	if err != nil {
+		return err
+	}
+	actual, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, actual) {
+		return ErrForged
+	}
+	return nil
+}
+
+// Signature - returns the hex encoded hmac-sha256 of the timestamp and body
+func Signature(key []byte, timestamp, body string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "\n" + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
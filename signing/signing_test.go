@@ -0,0 +1,88 @@
+package signing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/config"
+)
+
+// billingBody - body of a signed billing event
+const billingBody = `{"user_id":1,"call_id":"e21b0dda-6566-402a-8f8c-0657e5b87eeb"}`
+
+// TestPositiveVerify - tests messages signed with current and rotated keys are accepted
+func TestPositiveVerify(t *testing.T) {
+	check := assert.New(t)
+	keyring := getKeyring(t, true)
+	now := time.Now()
+
+	attributes, err := keyring.Sign(billingBody, now)
+	check.NoError(err)
+	check.Equal("k2", attributes[KeyIDAttribute])
+	check.NoError(keyring.Verify(billingBody, attributes, now.Add(time.Minute)))
+
+	// messages signed with the previous key still verify during rotation
+	keyring.SigningKeyID = "k1"
+	attributes, _ = keyring.Sign(billingBody, now)
+	keyring.SigningKeyID = "k2"
+	check.NoError(keyring.Verify(billingBody, attributes, now))
+
+	// unsigned messages pass when signatures are optional
+	keyring.Required = false
+	check.NoError(keyring.Verify(billingBody, map[string]string{}, now))
+}
+
+// TestNegativeVerify - tests unsigned, stale, forged and unknown key messages are rejected
+func TestNegativeVerify(t *testing.T) {
+	check := assert.New(t)
+	keyring := getKeyring(t, true)
+	now := time.Now()
+	attributes, _ := keyring.Sign(billingBody, now)
+
+	check.Equal(ErrUnsigned, keyring.Verify(billingBody, map[string]string{}, now))
+	check.Equal(ErrStale, keyring.Verify(billingBody, attributes, now.Add(10*time.Minute)))
+	check.Equal(ErrStale, keyring.Verify(billingBody, attributes, now.Add(-10*time.Minute)))
+	check.Equal(ErrForged, keyring.Verify(`{"user_id":2,"call_id":"e21b0dda-6566-402a-8f8c-0657e5b87eeb"}`, attributes, now))
+
+	attributes[KeyIDAttribute] = "k3"
+	check.Equal(ErrUnknownKey, errors.Cause(keyring.Verify(billingBody, attributes, now)))
+
+	// a new timestamp does not carry over the old signature
+	attributes, _ = keyring.Sign(billingBody, now)
+	attributes[TimestampAttribute] = "1"
+	check.Equal(ErrForged, keyring.Verify(billingBody, attributes, time.Unix(1, 0)))
+}
+
+// TestNegativeNewKeyring - tests signing can not be required without keys
+func TestNegativeNewKeyring(t *testing.T) {
+	check := assert.New(t)
+	v := viper.New()
+	v.Set("signing.required", true)
+	config.SetConfig(v)
+	_, err := NewKeyring()
+	check.Error(err)
+
+	v.Set("signing.keys", map[string]string{"k1": "secret"})
+	v.Set("signing.key_id", "k2")
+	_, err = NewKeyring()
+	check.Error(err)
+}
+
+// getKeyring - returns a keyring from config signing with k2
+func getKeyring(t *testing.T, required bool) *Keyring {
+	v := viper.New()
+	v.Set("signing.keys", map[string]string{"k1": "old-secret", "k2": "new-secret"})
+	v.Set("signing.key_id", "k2")
+	v.Set("signing.required", required)
+	v.Set("signing.max_age", 300)
+	config.SetConfig(v)
+	keyring, err := NewKeyring()
+	if err != nil {
+		t.Fatalf("unable to create keyring: %s", err)
+	}
+	return keyring
+}
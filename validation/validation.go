@@ -0,0 +1,109 @@
+package validation
+
+import (
+	"strings"
+	"time"
+
+	"go-worker/models"
+)
+
+const (
+	// RuleRequired - the field must be present
+	RuleRequired = "required"
+	// RulePositive - the field must be greater than zero
+	RulePositive = "positive"
+	// RuleTimeFormat - the field must be a timestamp in one of the event time layouts
+	RuleTimeFormat = "time_format"
+	// RuleAfterAnswer - the field must not be before answer_time
+	RuleAfterAnswer = "after_answer_time"
+)
+
+// eventTimeLayouts - layouts accepted for answer and hangup times
+var eventTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999",
+	time.RFC3339Nano,
+}
+
+// FieldError - holds a validation rule a billing event field failed
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Error - returns the message of the failed rule
+func (e FieldError) Error() string {
+	return e.Message
+}
+
+// Errors - holds every rule a billing event failed, an event with validation errors
+// can never be billed however often it is retried
+type Errors []FieldError
+
+// Error - returns the messages of the failed rules
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldError := range e {
+		messages[i] = fieldError.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Fields - returns the names of the fields which failed validation
+func (e Errors) Fields() []string {
+	fields := make([]string, len(e))
+	for i, fieldError := range e {
+		fields[i] = fieldError.Field
+	}
+	return fields
+}
+
+// ValidateEvent - checks a billing event can be billed, returning Errors listing every failed rule
+func ValidateEvent(event models.BillingEvent) error {
+	var errs Errors
+	if strings.TrimSpace(event.CallID) == "" {
+		errs = append(errs, FieldError{Field: "call_id", Rule: RuleRequired, Message: "call_id is required"})
+	}
+	if event.UserID <= 0 {
+		errs = append(errs, FieldError{Field: "user_id", Rule: RulePositive, Message: "user_id must be positive"})
+	}
+	answerTime, answerErr := validateTime("answer_time", event.AnswerTime)
+	if answerErr != nil {
+		errs = append(errs, *answerErr)
+	}
+	hangupTime, hangupErr := validateTime("hangup_time", event.HangupTime)
+	if hangupErr != nil {
+		errs = append(errs, *hangupErr)
+	}
+	if answerErr == nil && hangupErr == nil && hangupTime.Before(answerTime) {
+		errs = append(errs, FieldError{Field: "hangup_time", Rule: RuleAfterAnswer, Message: "hangup_time must not be before answer_time"})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ParseEventTime - parses an answer or hangup time
+func ParseEventTime(value string) (time.Time, error) {
+	var parsed time.Time
+	var err error
+	for _, layout := range eventTimeLayouts {
+		if parsed, err = time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	return parsed, err
+}
+
+// validateTime - checks a required event time field parses
+func validateTime(field, value string) (time.Time, *FieldError) {
+	if strings.TrimSpace(value) == "" {
+		return time.Time{}, &FieldError{Field: field, Rule: RuleRequired, Message: field + " is required"}
+	}
+	parsed, err := ParseEventTime(value)
+	if err != nil {
+		return parsed, &FieldError{Field: field, Rule: RuleTimeFormat, Message: field + " must be a timestamp like 2006-01-02 15:04:05"}
+	}
+	return parsed, nil
+}
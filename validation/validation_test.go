@@ -0,0 +1,49 @@
+package validation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/models"
+)
+
+// TestPositiveValidateEvent - tests valid events in each time layout pass
+func TestPositiveValidateEvent(t *testing.T) {
+	check := assert.New(t)
+	event := getBillingEvent()
+	check.NoError(ValidateEvent(event))
+
+	event.AnswerTime = "2021-07-01T00:30:00.5Z"
+	event.HangupTime = "2021-07-01 00:30:00.500000"
+	check.NoError(ValidateEvent(event))
+}
+
+// TestNegativeValidateEvent - tests every failed field and cross field rule is reported
+func TestNegativeValidateEvent(t *testing.T) {
+	check := assert.New(t)
+
+	err := ValidateEvent(models.BillingEvent{CallID: " ", HangupTime: "yesterday"})
+	errs, ok := err.(Errors)
+	check.True(ok)
+	check.Equal([]string{"call_id", "user_id", "answer_time", "hangup_time"}, errs.Fields())
+	check.Equal(RuleRequired, errs[2].Rule)
+	check.Equal(RuleTimeFormat, errs[3].Rule)
+
+	event := getBillingEvent()
+	event.HangupTime = "2021-07-01 00:29:59"
+	err = ValidateEvent(event)
+	check.Equal(Errors{{Field: "hangup_time", Rule: RuleAfterAnswer, Message: "hangup_time must not be before answer_time"}}, err)
+	check.Equal("hangup_time must not be before answer_time", err.Error())
+}
+
+// getBillingEvent - prepares a valid bill event
+func getBillingEvent() models.BillingEvent {
+	return models.BillingEvent{
+		CallID:     "e21b0dda-6566-402a-8f8c-0657e5b87eeb",
+		UserID:     1,
+		ProductID:  2,
+		AnswerTime: "2021-07-01 00:30:00",
+		HangupTime: "2021-07-01 01:00:00",
+	}
+}
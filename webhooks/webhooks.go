@@ -0,0 +1,315 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"go-worker/config"
+	"go-worker/models"
+	"go-worker/signing"
+	"go-worker/utils"
+)
+
+const (
+	// StatusBilled - the call was billed by the balance api
+	StatusBilled = "billed"
+	// StatusFailed - the billing event was rejected and will never be billed
+	StatusFailed = "failed"
+	// StatusInsufficientBalance - the balance api refused the charge for lack of balance
+	StatusInsufficientBalance = "insufficient_balance"
+
+	// SignatureHeader - header holding the hex hmac-sha256 of the timestamp and body
+	SignatureHeader = "X-Billing-Signature"
+	// TimestampHeader - header holding the unix time the delivery was signed at
+	TimestampHeader = "X-Billing-Timestamp"
+	// DeliveryHeader - header holding the id shared by all attempts of a delivery
+	DeliveryHeader = "X-Billing-Delivery"
+	// StatusHeader - header holding the notification status
+	StatusHeader = "X-Billing-Status"
+
+	// defaultMaxAttempts - attempts made to deliver a notification
+	defaultMaxAttempts = 5
+	// defaultBackoff - delay before the first retry, doubled for each later one
+	defaultBackoff = time.Second
+	// defaultMaxBackoff - longest delay between attempts
+	defaultMaxBackoff = time.Minute
+	// defaultConcurrency - deliveries made at the same time
+	defaultConcurrency = 4
+	// defaultQueueSize - deliveries waiting for an attempt before new notifications are dropped
+	defaultQueueSize = 1000
+)
+
+// Endpoint - webhook receiving the notifications of the listed statuses, all of them when none are listed
+type Endpoint struct {
+	URL      string   `mapstructure:"url"`
+	Secret   string   `mapstructure:"secret"`
+	Statuses []string `mapstructure:"statuses"`
+}
+
+// DeliveryLog - records every delivery attempt
+type DeliveryLog interface {
+	Record(delivery models.WebhookDelivery) error
+}
+
+// delivery - holds a notification waiting for its next attempt to be delivered to an endpoint
+type delivery struct {
+	id           string
+	endpoint     Endpoint
+	notification models.Notification
+	params       map[string]interface{}
+	body         []byte
+	attempt      int
+}
+
+// Notifier - delivers billing notifications to webhooks in the background, Concurrency deliveries
+// at a time, retrying failed deliveries with exponential backoff, each request is signed with the
+// endpoint's secret
+// notifications never hold up billing, they are dropped when QueueSize deliveries are waiting
+type Notifier struct {
+	Endpoints   []Endpoint
+	DeliveryLog DeliveryLog
+	Timeout     int
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Concurrency int
+	QueueSize   int
+	Log         *logrus.Entry
+	queue       chan delivery
+	lock        sync.RWMutex
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// NewNotifier - returns a notifier for the configured endpoints, or nil when webhooks are disabled
+func NewNotifier(deliveryLog DeliveryLog, log *logrus.Entry) (*Notifier, error) {
+	cfg := config.GetConfig()
+	if !cfg.GetBool("webhooks.enabled") {
+		return nil, nil
+	}
+	var endpoints []Endpoint
+	if err := cfg.UnmarshalKey("webhooks.endpoints", &endpoints); err != nil {
+		return nil, errors.Wrap(err, "invalid webhooks.endpoints")
+	}
+	for i, endpoint := range endpoints {
+		if endpoint.URL == "" {
+			return nil, errors.Errorf("webhook endpoint %d has no url", i)
+		}
+		endpoints[i].Secret = utils.GetValue(endpoint.Secret, cfg.GetString("webhooks.secret")).(string)
+		if endpoints[i].Secret == "" {
+			return nil, errors.Errorf("webhook endpoint %s has no secret", endpoint.URL)
+		}
+	}
+	return &Notifier{
+		Endpoints:   endpoints,
+		DeliveryLog: deliveryLog,
+		Timeout:     cfg.GetInt("webhooks.timeout"),
+		MaxAttempts: cfg.GetInt("webhooks.max_attempts"),
+		Backoff:     time.Duration(cfg.GetInt("webhooks.backoff")) * time.Millisecond,
+		MaxBackoff:  time.Duration(cfg.GetInt("webhooks.max_backoff")) * time.Second,
+		Concurrency: cfg.GetInt("webhooks.concurrency"),
+		QueueSize:   cfg.GetInt("webhooks.queue_size"),
+		Log:         log,
+	}, nil
+}
+
+// Start - delivers notifications until the notifier is closed
+func (n *Notifier) Start() {
+	n.setDefaults()
+	n.queue = make(chan delivery, n.QueueSize)
+	for i := 0; i < n.Concurrency; i++ {
+		// request handlers keep the state of their request, so each delivery goroutine has its own
+		request := utils.NewRequestHandler("webhooks")
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			for d := range n.queue {
+				n.attempt(request, d)
+			}
+		}()
+	}
+}
+
+// Close - delivers the queued notifications and stops the notifier, retries which are
+// not due yet are dropped
+func (n *Notifier) Close() {
+	n.lock.Lock()
+	n.closed = true
+	close(n.queue)
+	n.lock.Unlock()
+	n.wg.Wait()
+}
+
+// Notify - queues a notification for the endpoints subscribed to its status without waiting,
+// the notification is dropped for endpoints whose deliveries cannot be queued
+func (n *Notifier) Notify(notification models.Notification) {
+	if notification.OccurredAt == "" {
+		notification.OccurredAt = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	params, body, err := encode(notification)
+	if err != nil {
+		n.Log.WithError(err).WithField("call_id", notification.CallID).Error("Unable to encode webhook notification")
+		return
+	}
+	for _, endpoint := range n.Endpoints {
+		if !endpoint.subscribed(notification.Status) {
+			continue
+		}
+		d := delivery{id: utils.GetTransactionID(), endpoint: endpoint, notification: notification,
+			params: params, body: body, attempt: 1}
+		if !n.enqueue(d) {
+			n.Log.WithFields(logrus.Fields{"call_id": notification.CallID, "url": endpoint.URL}).
+				Warn("Webhook delivery queue is full, dropped notification")
+		}
+	}
+}
+
+// enqueue - queues a delivery for its next attempt and returns false if the queue is full or closed
+func (n *Notifier) enqueue(d delivery) bool {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	if n.closed {
+		return false
+	}
+	select {
+	case n.queue <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+// attempt - posts a delivery to its endpoint once and schedules a retry after the backoff
+// when it failed and may succeed later, returns true if the delivery was accepted
+func (n *Notifier) attempt(request *utils.RequestHandler, d delivery) bool {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	statusCode, response, _ := request.Fetch(&utils.RequestSpecifications{
+		URL:        d.endpoint.URL,
+		HTTPMethod: http.MethodPost,
+		Params:     d.params,
+		Timeout:    n.Timeout,
+		Headers: map[string]string{
+			SignatureHeader: signing.Signature([]byte(d.endpoint.Secret), timestamp, string(d.body)),
+			TimestampHeader: timestamp,
+			DeliveryHeader:  d.id,
+			StatusHeader:    d.notification.Status,
+		},
+		Log: n.Log,
+	})
+	delivered := statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices
+	record := models.WebhookDelivery{
+		DeliveryID: d.id,
+		URL:        d.endpoint.URL,
+		CallID:     d.notification.CallID,
+		Status:     d.notification.Status,
+		Attempt:    d.attempt,
+		StatusCode: statusCode,
+		Delivered:  delivered,
+		AttemptAt:  time.Now().UTC(),
+	}
+	if !delivered {
+		record.Error = string(response)
+	}
+	n.record(record)
+	if delivered {
+		return true
+	}
+
+	log := n.Log.WithFields(logrus.Fields{"call_id": d.notification.CallID, "url": d.endpoint.URL})
+	if !retryable(statusCode) || d.attempt >= n.MaxAttempts {
+		log.Error("Unable to deliver webhook notification")
+		return false
+	}
+	retry := d
+	retry.attempt++
+	time.AfterFunc(n.backoff(d.attempt), func() {
+		if !n.enqueue(retry) {
+			log.Error("Unable to deliver webhook notification, retry was dropped")
+		}
+	})
+	return false
+}
+
+// record - writes a delivery attempt to the delivery log
+func (n *Notifier) record(delivery models.WebhookDelivery) {
+	if n.DeliveryLog == nil {
+		return
+	}
+	if err := n.DeliveryLog.Record(delivery); err != nil {
+		n.Log.WithError(err).WithField("call_id", delivery.CallID).Error("Unable to record webhook delivery")
+	}
+}
+
+// backoff - returns the delay after a failed attempt, doubling from backoff up to max backoff
+func (n *Notifier) backoff(attempt int) time.Duration {
+	delay := n.Backoff
+	for i := 1; i < attempt && delay < n.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > n.MaxBackoff {
+		return n.MaxBackoff
+	}
+	return delay
+}
+
+// setDefaults - fills in unset options
+func (n *Notifier) setDefaults() {
+	if n.MaxAttempts <= 0 {
+		n.MaxAttempts = defaultMaxAttempts
+	}
+	if n.Backoff <= 0 {
+		n.Backoff = defaultBackoff
+	}
+	if n.MaxBackoff <= 0 {
+		n.MaxBackoff = defaultMaxBackoff
+	}
+	if n.Concurrency <= 0 {
+		n.Concurrency = defaultConcurrency
+	}
+	if n.QueueSize <= 0 {
+		n.QueueSize = defaultQueueSize
+	}
+}
+
+// subscribed - returns true if the endpoint receives notifications of a status
+func (e Endpoint) subscribed(status string) bool {
+	if len(e.Statuses) == 0 {
+		return true
+	}
+	for _, s := range e.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable - returns true if a failed delivery may succeed later, other client errors are final
+func retryable(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusRequestTimeout ||
+		statusCode == http.StatusTooManyRequests
+}
+
+// encode - returns the request params of a notification and the body they are sent as,
+// the request handler encodes params with encoding/json so the signed body matches the sent one
+func encode(notification models.Notification) (map[string]interface{}, []byte, error) {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return nil, nil, err
+	}
+	var params map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&params); err != nil {
+		return nil, nil, err
+	}
+	body, err := json.Marshal(params)
+	return params, body, err
+}
@@ -0,0 +1,176 @@
+package webhooks
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"go-worker/models"
+	"go-worker/money"
+	"go-worker/signing"
+)
+
+// memoryLog - keeps delivery attempts in memory
+type memoryLog struct {
+	lock       sync.Mutex
+	deliveries []models.WebhookDelivery
+}
+
+// TestPositiveDeliver - tests notifications are signed and retried until they are accepted
+func TestPositiveDeliver(t *testing.T) {
+	check := assert.New(t)
+	var attempts int32
+	accepted := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature := signing.Signature([]byte("secret"), r.Header.Get(TimestampHeader), string(body))
+		check.Equal(signature, r.Header.Get(SignatureHeader))
+		check.Equal(StatusBilled, r.Header.Get(StatusHeader))
+		check.JSONEq(`{"call_id": "e21b0dda", "user_id": 1, "status": "billed", "charge_amount": "1.20",
+			"currency": "EUR", "occurred_at": "2021-07-01T01:00:00Z"}`, string(body))
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		accepted <- true
+	}))
+	defer server.Close()
+	notifier, deliveryLog := getNotifier(server.URL)
+
+	charge := money.MustParse("1.20")
+	notifier.Start()
+	notifier.Notify(models.Notification{CallID: "e21b0dda", UserID: 1, Status: StatusBilled,
+		ChargeAmount: &charge, Currency: "EUR", OccurredAt: "2021-07-01T01:00:00Z"})
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification was not retried")
+	}
+	notifier.Close()
+
+	deliveries := deliveryLog.list()
+	check.Equal(int32(3), atomic.LoadInt32(&attempts))
+	check.Len(deliveries, 3)
+	check.Equal(http.StatusServiceUnavailable, deliveries[0].StatusCode)
+	check.Equal(3, deliveries[2].Attempt)
+	check.True(deliveries[2].Delivered)
+	check.Equal(deliveries[0].DeliveryID, deliveries[2].DeliveryID)
+
+	check.Equal(time.Millisecond, notifier.backoff(1))
+	check.Equal(4*time.Millisecond, notifier.backoff(3))
+	check.Equal(5*time.Millisecond, notifier.backoff(10))
+}
+
+// TestPositiveNotifyConcurrently - tests a slow endpoint does not hold up other deliveries
+func TestPositiveNotifyConcurrently(t *testing.T) {
+	check := assert.New(t)
+	fast := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-fast
+			return
+		}
+		fast <- true
+	}))
+	defer server.Close()
+	notifier, deliveryLog := getNotifier(server.URL + "/slow")
+	notifier.Endpoints = append(notifier.Endpoints, Endpoint{URL: server.URL + "/fast", Secret: "secret"})
+	notifier.Concurrency = 2
+
+	notifier.Start()
+	notifier.Notify(models.Notification{CallID: "e21b0dda", Status: StatusFailed})
+	notifier.Close()
+	check.Len(deliveryLog.list(), 2)
+}
+
+// TestNegativeDeliver - tests refused notifications are not retried and unsubscribed statuses are not sent
+func TestNegativeDeliver(t *testing.T) {
+	check := assert.New(t)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+	notifier, deliveryLog := getNotifier(server.URL)
+
+	notifier.Start()
+	notifier.Notify(models.Notification{CallID: "e21b0dda", Status: StatusFailed})
+	// only failures are sent to the endpoint
+	notifier.Notify(models.Notification{CallID: "e21b0dda", Status: StatusInsufficientBalance})
+	notifier.Close()
+	check.Equal(int32(1), atomic.LoadInt32(&attempts))
+	check.Len(deliveryLog.list(), 1)
+	check.False(deliveryLog.list()[0].Delivered)
+}
+
+// TestNegativeNotifyQueueFull - tests notifications are dropped instead of blocking when the queue is full
+func TestNegativeNotifyQueueFull(t *testing.T) {
+	check := assert.New(t)
+	var attempts int32
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		<-release
+	}))
+	defer server.Close()
+	notifier, _ := getNotifier(server.URL)
+	notifier.Concurrency = 1
+	notifier.QueueSize = 1
+
+	notifier.Start()
+	notified := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			notifier.Notify(models.Notification{CallID: "e21b0dda", Status: StatusFailed})
+		}
+		notified <- true
+	}()
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notify blocked on a full queue")
+	}
+	close(release)
+	notifier.Close()
+	check.LessOrEqual(atomic.LoadInt32(&attempts), int32(2))
+
+	// notifications after close are dropped
+	notifier.Notify(models.Notification{CallID: "e21b0dda", Status: StatusFailed})
+}
+
+// getNotifier - returns a notifier with one endpoint and millisecond backoffs
+func getNotifier(url string) (*Notifier, *memoryLog) {
+	deliveryLog := &memoryLog{}
+	notifier := &Notifier{
+		Endpoints:   []Endpoint{{URL: url, Secret: "secret", Statuses: []string{StatusBilled, StatusFailed}}},
+		DeliveryLog: deliveryLog,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  5 * time.Millisecond,
+		Log:         logrus.NewEntry(logrus.New()),
+	}
+	notifier.setDefaults()
+	return notifier, deliveryLog
+}
+
+// Record - keeps a delivery attempt
+func (l *memoryLog) Record(delivery models.WebhookDelivery) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.deliveries = append(l.deliveries, delivery)
+	return nil
+}
+
+// list - returns the kept delivery attempts
+func (l *memoryLog) list() []models.WebhookDelivery {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]models.WebhookDelivery(nil), l.deliveries...)
+}
@@ -0,0 +1,82 @@
+package workerpool
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+
+	"go-worker/validation"
+)
+
+const (
+	// DeadLetterReasonAttribute - message attribute holding the reason a message was dead lettered
+	DeadLetterReasonAttribute = "dead_letter_reason"
+	// maxMessageAttributes - maximum number of message attributes sqs accepts for a message
+	maxMessageAttributes = 10
+)
+
+// terminator - queues which can stop the redelivery of a message for good, e.g. jetstream
+type terminator interface {
+	Terminate(receiptHandle string) error
+}
+
+// rejectedError - marks the error of a message which can never be billed, such messages
+// are moved to the dead letter queue instead of being redelivered
+type rejectedError struct {
+	error
+}
+
+// reject - marks an error as permanent for its message
+func reject(err error) error {
+	return rejectedError{err}
+}
+
+// isRejected - returns true if the error marks its message as permanently failed
+func isRejected(err error) bool {
+	_, ok := errors.Cause(err).(rejectedError)
+	return ok
+}
+
+// deadLetter - moves a rejected message to the dead letter queue and returns true if it can be
+// deleted, without a dead letter queue the message is left to the queue's own redrive policy.
+// queues which can terminate a message do so instead of deleting it
+func (worker *Worker) deadLetter(message *sqs.Message, reason error) bool {
+	log := worker.Log.WithError(reason).WithField("message_id", aws.StringValue(message.MessageId))
+	if rejected, ok := errors.Cause(reason).(rejectedError); ok {
+		if validationErrs, ok := rejected.error.(validation.Errors); ok {
+			log = log.WithField("validation_errors", validationErrs)
+		}
+	}
+	if worker.DLQClient == nil {
+		log.Error("Rejected message, no dead letter queue is configured")
+		return false
+	}
+
+	attributes := make(map[string]*sqs.MessageAttributeValue, len(message.MessageAttributes)+1)
+	for name, value := range message.MessageAttributes {
+		attributes[name] = value
+	}
+	if len(attributes) < maxMessageAttributes {
+		attributes[DeadLetterReasonAttribute] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(reason.Error()),
+		}
+	}
+	_, err := worker.DLQClient.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:          &worker.DLQURL,
+		MessageBody:       message.Body,
+		MessageAttributes: attributes,
+	})
+	if err != nil {
+		log.WithField("dlq_error", err.Error()).Error("Unable to move rejected message to the dead letter queue")
+		return false
+	}
+	log.Warn("Moved rejected message to the dead letter queue")
+	if queue, ok := worker.SQSClient.(terminator); ok {
+		if err = queue.Terminate(aws.StringValue(message.ReceiptHandle)); err == nil {
+			return false
+		}
+		log.WithField("terminate_error", err.Error()).Error("Unable to terminate rejected message, deleting it")
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package workerpool
+
+import (
+	"sync"
+	"time"
+
+	"go-worker/config"
+)
+
+const (
+	// defaultDedupWindow - seconds a billed cloudevent id is remembered for
+	defaultDedupWindow = 3600
+)
+
+var (
+	// billedEvents - cloudevents billed recently, shared by the workers of the pool
+	billedEvents *EventCache
+	// billedEventsOnce - creates billedEvents on first use
+	billedEventsOnce sync.Once
+	// notifiedCalls - billing outcomes sent to webhooks recently, shared by the workers of the pool
+	notifiedCalls *EventCache
+	// notifiedCallsOnce - creates notifiedCalls on first use
+	notifiedCallsOnce sync.Once
+)
+
+// EventCache - remembers the keys of events billed within a window, redelivered and
+// republished events are deduplicated while they are remembered
+// the cache is kept in memory, so duplicates are only caught within one process
+type EventCache struct {
+	lock   sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// NewEventCache - returns a cache remembering events for window
+func NewEventCache(window time.Duration) *EventCache {
+	return &EventCache{window: window, seen: map[string]time.Time{}}
+}
+
+// sharedEventCache - returns the cache shared by the workers of the pool
+func sharedEventCache() *EventCache {
+	billedEventsOnce.Do(func() {
+		window := config.GetConfig().GetInt("cloudevents.dedup_window")
+		if window <= 0 {
+			window = defaultDedupWindow
+		}
+		billedEvents = NewEventCache(time.Duration(window) * time.Second)
+	})
+	return billedEvents
+}
+
+// sharedNotificationCache - returns the cache of sent notifications shared by the workers of the pool
+func sharedNotificationCache() *EventCache {
+	notifiedCallsOnce.Do(func() {
+		window := config.GetConfig().GetInt("webhooks.dedup_window")
+		if window <= 0 {
+			window = defaultDedupWindow
+		}
+		notifiedCalls = NewEventCache(time.Duration(window) * time.Second)
+	})
+	return notifiedCalls
+}
+
+// Seen - returns true if the event was added within the window
+func (c *EventCache) Seen(key string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	addedAt, ok := c.seen[key]
+	return ok && now.Sub(addedAt) < c.window
+}
+
+// Add - remembers an event, dropping expired events at most once per window
+func (c *EventCache) Add(key string, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.add(key, now)
+}
+
+// SeenOrAdd - returns true if the event was added within the window, otherwise remembers it,
+// so of concurrent callers with the same key only one gets false
+func (c *EventCache) SeenOrAdd(key string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if addedAt, ok := c.seen[key]; ok && now.Sub(addedAt) < c.window {
+		return true
+	}
+	c.add(key, now)
+	return false
+}
+
+// add - remembers an event while the lock is held
+func (c *EventCache) add(key string, now time.Time) {
+	c.seen[key] = now
+	if now.Sub(c.pruned) < c.window {
+		return
+	}
+	for seenKey, addedAt := range c.seen {
+		if now.Sub(addedAt) >= c.window {
+			delete(c.seen, seenKey)
+		}
+	}
+	c.pruned = now
+}
+
+// Remove - forgets an event, e.g. one reserved for a charge which was not recorded
+func (c *EventCache) Remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.seen, key)
+}
+
+// eventKey - returns the dedup key of a cloudevent, ids are only unique within their source
+func eventKey(source, id string) string {
+	return source + "\x00" + id
+}
@@ -3,22 +3,45 @@ package workerpool
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	"go-worker/claimcheck"
+	"go-worker/codec"
 	"go-worker/config"
 	dataAdapters "go-worker/data_adapters"
+	"go-worker/envelope"
+	"go-worker/exchange"
 	"go-worker/externals"
 	"go-worker/logger"
 	"go-worker/models"
+	"go-worker/money"
+	"go-worker/queue"
+	"go-worker/rating"
+	"go-worker/schema"
+	"go-worker/signing"
 	"go-worker/utils"
+	"go-worker/validation"
+	"go-worker/webhooks"
 )
 
+const (
+	// BillingEventType - default cloudevent type routed to billing
+	BillingEventType = "gobilling.billing_event"
+)
+
+// Handler - processes a billing event and returns true once its message can be deleted
+type Handler func(billEvent models.BillingEvent, metadata models.MessageMetadata) bool
+
 // Worker - holds worker related information
+// cloudevents are routed to Handlers by their type, bare billing events are billed
 type Worker struct {
 	workerID              int
 	SQSClient             sqsiface.SQSAPI
@@ -27,38 +50,120 @@ type Worker struct {
 	MaxEvents             int64
 	WaitTime              int64
 	BalanceRequestHandler *externals.BalanceRequestHandler
+	SNSVerifier           *envelope.SNSVerifier
+	Signatures            *signing.Keyring
+	ClaimCheck            *claimcheck.Checker
+	Transcoder            *codec.Transcoder
+	RatingEngine          *rating.Engine
+	Converter             *exchange.Converter
+	DLQClient             sqsiface.SQSAPI
+	DLQURL                string
+	Handlers              map[string]Handler
+	BillingType           string
+	BilledEvents          *EventCache
+	Notifier              *webhooks.Notifier
+	NotifiedCalls         *EventCache
+	Writes                *dataAdapters.WriteBatcher
+	pending               []pendingRecord
 	Log                   *logrus.Entry
 }
 
+// pendingRecord - holds a charge waiting for its batched write, its message is acknowledged once the batch commits
+type pendingRecord struct {
+	billEvent models.BillingEvent
+	metadata  models.MessageMetadata
+	write     *dataAdapters.PendingWrite
+}
+
 // NewWorker - returns a new object for Worker
 func NewWorker(workerID int) *Worker {
 	cfg := config.GetConfig()
 
-	region := cfg.GetString("sqs.region")
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region)},
-	)
+	// new queue client
+	queueURL := cfg.GetString("sqs.url")
+	svc, err := queue.New(queueURL)
 	if err != nil {
-		logger.Log.Error("Unable to create aws session")
+		logger.Log.WithError(err).Error("Unable to create queue client")
 	}
-	// new sqs client
-	svc := sqs.New(sess)
 
 	prefix := fmt.Sprintf("WorkerID:%d", workerID)
 	transaction := fmt.Sprintf("%v", utils.GetTransactionID())
 	log := logger.Log.WithFields(logrus.Fields{"prefix": prefix, "transaction": transaction})
 	balanceRequesthandler := externals.NewBalanceRequestHandler(log)
 
+	// sns signatures are only verified when configured
+	var snsVerifier *envelope.SNSVerifier
+	if cfg.GetBool("sns.verify_signature") {
+		snsVerifier, err = envelope.NewSNSVerifier(cfg.GetString("sns.certificate_file"))
+		if err != nil {
+			logger.Log.WithError(err).Fatal("Unable to load sns certificate")
+		}
+	}
+
+	// message signatures are verified with the configured keys
+	signatures, err := signing.NewKeyring()
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Unable to load signing keys")
+	}
+
+	// offloaded bodies are only fetched from the configured claim check store
+	claimCheck, err := claimcheck.NewChecker()
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Unable to create claim check store")
+	}
+
+	// bodies are decoded by their content type attribute
+	transcoder, err := codec.NewTranscoder()
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Unable to load avro schema registry")
+	}
+
+	// calls are rated locally when the balance api fails and rating is enabled
+	ratingEngine, err := rating.NewEngine()
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Unable to load rating engine")
+	}
+
+	// charges are converted into the reporting currency when conversion is enabled
+	converter, err := exchange.NewConverter()
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Unable to load currency converter")
+	}
+
+	// rejected messages are moved to the dead letter queue when one is configured
+	var dlqClient sqsiface.SQSAPI
+	dlqURL := cfg.GetString("sqs.dlq_url")
+	if dlqURL != "" {
+		dlqClient, err = queue.New(dlqURL)
+		if err != nil {
+			logger.Log.WithError(err).Error("Unable to create dead letter queue client")
+		}
+	}
+
 	worker := &Worker{
 		workerID:              workerID,
 		SQSClient:             svc,
-		SQSURL:                cfg.GetString("sqs.url"),
+		SQSURL:                queueURL,
 		SQSRetry:              cfg.GetInt("sqs.retry_count"),
 		MaxEvents:             cfg.GetInt64("worker.max_events"),
 		WaitTime:              cfg.GetInt64("worker.wait_time"),
 		BalanceRequestHandler: balanceRequesthandler,
+		SNSVerifier:           snsVerifier,
+		Signatures:            signatures,
+		ClaimCheck:            claimCheck,
+		Transcoder:            transcoder,
+		RatingEngine:          ratingEngine,
+		Converter:             converter,
+		DLQClient:             dlqClient,
+		DLQURL:                dlqURL,
+		BilledEvents:          sharedEventCache(),
+		Notifier:              sharedNotifier(),
+		NotifiedCalls:         sharedNotificationCache(),
+		Writes:                dataAdapters.SharedWriteBatcher(),
 		Log:                   log,
 	}
+	worker.BillingType = utils.GetValue(cfg.GetString("cloudevents.billing_type"), BillingEventType).(string)
+	worker.Handlers = map[string]Handler{worker.BillingType: worker.processBillingEvent}
 	return worker
 }
 
@@ -117,7 +222,8 @@ func (worker *Worker) fetch() (*sqs.ReceiveMessageOutput, error) {
 	return result, err
 }
 
-// processSQSMessages - processes sqs messages sequentially
+// processSQSMessages - processes sqs messages sequentially, billing events are billed
+// in one batch call after the other messages when the balance api has a batch endpoint
 func (worker *Worker) processSQSMessages(sqsResponse *sqs.ReceiveMessageOutput) {
 
 	if len(sqsResponse.Messages) == 0 {
@@ -125,54 +231,401 @@ func (worker *Worker) processSQSMessages(sqsResponse *sqs.ReceiveMessageOutput)
 		return
 	}
 	var requestIDList []*sqs.DeleteMessageBatchRequestEntry
-	var isSuccess bool
+	var batch []externals.BatchEvent
+	claimChecks := map[string]string{}
+	batchedMetadata := map[string]models.MessageMetadata{}
+	batchedEvents := map[string]bool{}
+
+	// acknowledge - deletes a handled message along with its offloaded body
+	acknowledge := func(metadata models.MessageMetadata) {
+		requestIDList = append(requestIDList, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(metadata.MessageID),
+			ReceiptHandle: aws.String(metadata.ReceiptHandle),
+		})
+		if metadata.ClaimCheckURL != "" {
+			claimChecks[metadata.MessageID] = metadata.ClaimCheckURL
+		}
+	}
 
 	// process each billing event
 	for _, message := range sqsResponse.Messages {
-		billingEvent := models.BillingEvent{}
-		bytesStr := []byte(*message.Body)
-		err := json.Unmarshal(bytesStr, &billingEvent)
+		billingEvent, metadata, err := worker.decodeMessage(message)
+		if err == nil {
+			// invalid events can never be billed, so they are rejected before any external call
+			if validationErr := validation.ValidateEvent(billingEvent); validationErr != nil {
+				err = reject(validationErr)
+			}
+		}
 		if err != nil {
-			logger.Log.WithError(err).WithField("bytesStr", bytesStr).Info("Error while unmarshalling sqs message")
+			if !isRejected(err) {
+				logger.Log.WithError(err).WithField("bytesStr", aws.StringValue(message.Body)).Info("Error while unmarshalling sqs message")
+				continue
+			}
+			if billingEvent.CallID != "" {
+				worker.notify(models.Notification{CallID: billingEvent.CallID, UserID: billingEvent.UserID,
+					Status: webhooks.StatusFailed, Reason: err.Error()})
+			}
+			if worker.deadLetter(message, err) {
+				requestIDList = append(requestIDList, deleteEntry(message))
+			}
 			continue
 		}
-		isSuccess = worker.processBillingEvent(billingEvent)
-		if isSuccess {
-			deleteMessageRequestEntry := sqs.DeleteMessageBatchRequestEntry{}
-			deleteMessageRequestEntry.ReceiptHandle = message.ReceiptHandle
-			deleteMessageRequestEntry.Id = message.MessageId
-			requestIDList = append(requestIDList, &deleteMessageRequestEntry)
+
+		// republished and redelivered cloudevents are deleted without billing them again
+		if metadata.EventID != "" && worker.BilledEvents.Seen(eventKey(metadata.EventSource, metadata.EventID), time.Now()) {
+			worker.Log.WithField("event_id", metadata.EventID).Info("Skipping duplicate cloudevent")
+			acknowledge(metadata)
+			continue
+		}
+		if worker.BalanceRequestHandler.BatchPath != "" && worker.isBillingType(metadata.EventType) {
+			// a copy of an event already in the batch is left for redelivery, by then the batch
+			// outcome decides whether it is a duplicate
+			if metadata.EventID != "" {
+				key := eventKey(metadata.EventSource, metadata.EventID)
+				if batchedEvents[key] {
+					worker.Log.WithField("event_id", metadata.EventID).Info("Deferring duplicate cloudevent of the batch")
+					continue
+				}
+				batchedEvents[key] = true
+			}
+			id := aws.StringValue(message.MessageId)
+			batch = append(batch, externals.BatchEvent{ID: id, Event: billingEvent})
+			batchedMetadata[id] = metadata
+			continue
+		}
+		if worker.handler(metadata.EventType)(billingEvent, metadata) {
+			worker.markBilled(metadata)
+			acknowledge(metadata)
+		}
+	}
+
+	// bill the batched events, acknowledging each message billed
+	for _, id := range worker.billBatch(batch, batchedMetadata) {
+		worker.markBilled(batchedMetadata[id])
+		acknowledge(batchedMetadata[id])
+	}
+
+	// acknowledge the charges recorded by batched writes once their batches commit
+	for _, metadata := range worker.awaitWrites() {
+		worker.markBilled(metadata)
+		acknowledge(metadata)
+	}
+
+	// delete sqs messages, then the offloaded bodies of the deleted ones
+	deleted := worker.deleteSQSMessages(requestIDList)
+	worker.deleteClaimChecks(claimChecks, deleted)
+}
+
+// markBilled - remembers a billed cloudevent, so its duplicates are not billed again
+func (worker *Worker) markBilled(metadata models.MessageMetadata) {
+	if metadata.EventID != "" {
+		worker.BilledEvents.Add(eventKey(metadata.EventSource, metadata.EventID), time.Now())
+	}
+}
+
+// deleteEntry - returns the delete entry of a received message
+func deleteEntry(message *sqs.Message) *sqs.DeleteMessageBatchRequestEntry {
+	return &sqs.DeleteMessageBatchRequestEntry{
+		Id:            message.MessageId,
+		ReceiptHandle: message.ReceiptHandle,
+	}
+}
+
+// sentAt - returns when a message was sent, or now when the queue does not report it
+func sentAt(message *sqs.Message) time.Time {
+	millis, err := strconv.ParseInt(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64)
+	if err != nil || millis <= 0 {
+		return time.Now()
+	}
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// decodeMessage - unmarshals the billing event in a queue message, unwrapping sns notifications
+// and cloudevents, messages failing sns or producer signature checks are rejected
+func (worker *Worker) decodeMessage(message *sqs.Message) (models.BillingEvent, models.MessageMetadata, error) {
+	billingEvent := models.BillingEvent{}
+	body := []byte(aws.StringValue(message.Body))
+	metadata := models.MessageMetadata{
+		MessageID:     aws.StringValue(message.MessageId),
+		ReceiptHandle: aws.StringValue(message.ReceiptHandle),
+		Attributes:    map[string]string{},
+	}
+	for name, value := range message.MessageAttributes {
+		metadata.Attributes[name] = aws.StringValue(value.StringValue)
+	}
+
+	if notification, ok := envelope.ParseSNS(body); ok {
+		if notification.Type != envelope.SNSNotificationType {
+			return billingEvent, metadata, reject(errors.Errorf("unsupported sns message type %s", notification.Type))
+		}
+		if worker.SNSVerifier != nil {
+			if err := worker.SNSVerifier.Verify(notification); err != nil {
+				return billingEvent, metadata, reject(err)
+			}
+		}
+		body = []byte(notification.Message)
+		metadata.TopicARN = notification.TopicArn
+		metadata.Attributes = notification.Attributes()
+	}
+
+	// fetch bodies which were offloaded to object storage, pointers which can never
+	// be resolved are rejected while store outages are left for redelivery
+	resolved, pointer, err := worker.ClaimCheck.Resolve(string(body))
+	if claimcheck.IsPermanent(err) {
+		return billingEvent, metadata, reject(err)
+	}
+	if err != nil {
+		return billingEvent, metadata, err
+	}
+	if pointer != nil {
+		body = []byte(resolved)
+		metadata.ClaimCheckURL = pointer.URL
+	}
+
+	// producers sign the billing event itself, so the signature holds across sns and claim checks,
+	// its age is taken at send time so redelivered and delayed messages stay fresh
+	if worker.Signatures != nil {
+		if err = worker.Signatures.Verify(string(body), metadata.Attributes, sentAt(message)); err != nil {
+			return billingEvent, metadata, reject(err)
+		}
+	}
+
+	// cloudevents carry the billing event as their data, in binary mode the body is the data
+	contentType := metadata.Attributes[codec.ContentTypeAttribute]
+	cloudEvent, ok, err := envelope.ParseStructuredCloudEvent(body, contentType)
+	if ok && err == nil {
+		body, contentType = cloudEvent.Payload()
+	} else if !ok {
+		cloudEvent, ok, err = envelope.ParseBinaryCloudEvent(metadata.Attributes)
+	}
+	if err != nil {
+		return billingEvent, metadata, reject(err)
+	}
+	if ok {
+		setCloudEventMetadata(&metadata, cloudEvent)
+		if _, routed := worker.Handlers[cloudEvent.Type]; !routed {
+			return billingEvent, metadata, reject(errors.Errorf("no handler for cloudevent type %s", cloudEvent.Type))
 		}
 	}
 
-	// delete sqs messages
-	worker.deleteSQSMessages(requestIDList)
+	// binary encodings are converted to json, so they share schema versions with json bodies
+	if body, err = worker.Transcoder.ToJSON(contentType, body); err != nil {
+		return billingEvent, metadata, reject(err)
+	}
+
+	// older schema versions are upcast to the current billing event, versions newer than the
+	// worker knows are left for redelivery to an upgraded worker
+	version, err := schema.VersionOf(body, metadata.Attributes)
+	if err != nil {
+		return billingEvent, metadata, reject(err)
+	}
+	metadata.SchemaVersion = version
+	billingEvent, err = schema.Decode(body, version)
+	return billingEvent, metadata, err
+}
+
+// setCloudEventMetadata - exposes the context attributes of a cloudevent to handlers
+func setCloudEventMetadata(metadata *models.MessageMetadata, cloudEvent *envelope.CloudEvent) {
+	metadata.EventID = cloudEvent.ID
+	metadata.EventType = cloudEvent.Type
+	metadata.EventSource = cloudEvent.Source
+	metadata.EventSubject = cloudEvent.Subject
+	metadata.EventTime, _ = cloudEvent.ParsedTime()
+}
+
+// handler - returns the handler of a cloudevent type, bare billing events have no type and are billed
+func (worker *Worker) handler(eventType string) Handler {
+	if handler, ok := worker.Handlers[eventType]; ok {
+		return handler
+	}
+	return worker.processBillingEvent
+}
+
+// isBillingType - returns true if events of the type are billing events
+func (worker *Worker) isBillingType(eventType string) bool {
+	return eventType == "" || eventType == worker.BillingType
 }
 
 // processBillingEvent - processes bill event
-func (worker *Worker) processBillingEvent(billEvent models.BillingEvent) bool {
+func (worker *Worker) processBillingEvent(billEvent models.BillingEvent, metadata models.MessageMetadata) bool {
+	worker.Log.WithFields(logrus.Fields{
+		"call_id":        billEvent.CallID,
+		"message_id":     metadata.MessageID,
+		"topic_arn":      metadata.TopicARN,
+		"schema_version": metadata.SchemaVersion,
+		"event_id":       metadata.EventID,
+	}).Debug("Processing billing event")
 
 	// call balance api
-	response, isSuccessful := worker.BalanceRequestHandler.BillUser(billEvent)
-	if isSuccessful {
-		var balanceResponse models.BalanceResponse
-		err := json.Unmarshal(response, &balanceResponse)
-		if err != nil {
-			logger.Log.WithError(err).WithField("call_id: ", billEvent.CallID).Info("Unable to map json response to struct")
-			return false
+	statusCode, response := worker.BalanceRequestHandler.Bill(billEvent)
+	return worker.handleBalance(billEvent, metadata, statusCode, response)
+}
+
+// handleBalance - records the charge of a balance api response and returns true once it is recorded,
+// calls the api failed to bill with a transient error are rated locally
+func (worker *Worker) handleBalance(billEvent models.BillingEvent, metadata models.MessageMetadata, statusCode int, response []byte) bool {
+	if statusCode == http.StatusOK {
+		return worker.recordBalance(billEvent, metadata, response)
+	}
+	if statusCode == http.StatusPaymentRequired {
+		worker.notify(models.Notification{CallID: billEvent.CallID, UserID: billEvent.UserID,
+			Status: webhooks.StatusInsufficientBalance, Reason: string(response)})
+	}
+	if transientStatus(statusCode) {
+		worker.rateProvisionally(billEvent)
+	}
+	return false
+}
+
+// billBatch - bills events in one batch call and returns the ids of the billed events
+func (worker *Worker) billBatch(batch []externals.BatchEvent, metadata map[string]models.MessageMetadata) []string {
+	if len(batch) == 0 {
+		return nil
+	}
+	var billedIDs []string
+	results := worker.BalanceRequestHandler.BillBatch(batch)
+	for _, batchEvent := range batch {
+		// events without a result failed like a failed single call
+		result, ok := results[batchEvent.ID]
+		if !ok {
+			result.Status = http.StatusInternalServerError
 		}
-		// update call info in database
-		updateErr := dataAdapters.UpdateCallInfo(balanceResponse)
-		if updateErr != nil {
-			return false
+		// failed events carry their reason as an error instead of a response body
+		response := result.Response
+		if len(response) == 0 {
+			response = []byte(result.Error)
+		}
+		if worker.handleBalance(batchEvent.Event, metadata[batchEvent.ID], result.Status, response) {
+			billedIDs = append(billedIDs, batchEvent.ID)
 		}
-		return true
 	}
-	return false
+	return billedIDs
+}
+
+// recordBalance - updates call info with the charge in a balance api response, with batched writes
+// the charge is queued and false is returned, its message is acknowledged by awaitWrites
+func (worker *Worker) recordBalance(billEvent models.BillingEvent, metadata models.MessageMetadata, response []byte) bool {
+	var balanceResponse models.BalanceResponse
+	err := json.Unmarshal(response, &balanceResponse)
+	if err != nil {
+		logger.Log.WithError(err).WithField("call_id: ", billEvent.CallID).Info("Unable to map json response to struct")
+		return false
+	}
+	if err = worker.convertCharge(billEvent, &balanceResponse); err != nil {
+		logger.Log.WithError(err).WithField("call_id: ", billEvent.CallID).Info("Invalid charge in balance response")
+		return false
+	}
+	if worker.Writes != nil {
+		// the event is reserved while its write is pending, so its copies are not billed again
+		// before the batch commits, awaitWrites releases it when the charge is not recorded
+		worker.markBilled(metadata)
+		worker.pending = append(worker.pending, pendingRecord{billEvent: billEvent, metadata: metadata,
+			write: worker.Writes.Submit(balanceResponse)})
+		return false
+	}
+	// update call info in database
+	return worker.recorded(billEvent, metadata, balanceResponse, dataAdapters.UpdateCallInfo(balanceResponse))
+}
+
+// recorded - handles the outcome of a call info update and returns true once the message can be deleted
+func (worker *Worker) recorded(billEvent models.BillingEvent, metadata models.MessageMetadata,
+	balanceResponse models.BalanceResponse, updateErr error) bool {
+	if updateErr == dataAdapters.ErrCallNotFound {
+		return worker.handleMissingCall(metadata, balanceResponse)
+	}
+	if updateErr != nil {
+		return false
+	}
+	worker.notify(models.Notification{CallID: billEvent.CallID, UserID: billEvent.UserID, Status: webhooks.StatusBilled,
+		ChargeAmount: &balanceResponse.ChargeAmount, Currency: utils.GetValue(balanceResponse.Currency, money.DefaultCurrency).(string)})
+	return true
+}
+
+// transientStatus - returns true for balance api failures which may pass on a retry, server errors and timeouts
+func transientStatus(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusRequestTimeout
 }
 
-// deleteSQSMessages - deletes sqs messages once processed
-func (worker *Worker) deleteSQSMessages(requestIDList []*sqs.DeleteMessageBatchRequestEntry) {
+// awaitWrites - waits for the batched writes of the worker and returns the metadata of the messages
+// whose charges were recorded
+func (worker *Worker) awaitWrites() []models.MessageMetadata {
+	var recorded []models.MessageMetadata
+	for _, record := range worker.pending {
+		err := record.write.Wait()
+		if worker.recorded(record.billEvent, record.metadata, record.write.Response, err) {
+			recorded = append(recorded, record.metadata)
+		} else if record.metadata.EventID != "" {
+			worker.BilledEvents.Remove(eventKey(record.metadata.EventSource, record.metadata.EventID))
+		}
+	}
+	worker.pending = nil
+	return recorded
+}
+
+// handleMissingCall - parks a charge whose call info row does not exist yet, so the call is not billed again
+// on redelivery and the orphan retrier applies the charge once the row appears, returns true once parked
+func (worker *Worker) handleMissingCall(metadata models.MessageMetadata, balanceResponse models.BalanceResponse) bool {
+	log := worker.Log.WithFields(logrus.Fields{"call_id": balanceResponse.CallID, "message_id": metadata.MessageID})
+	if err := dataAdapters.ParkOrphan(balanceResponse); err != nil {
+		log.WithError(err).Error("Unable to park charge of missing call info")
+		return false
+	}
+	log.Info("Call info not found, parked the charge")
+	return true
+}
+
+// notify - sends a billing outcome to webhooks, once per call and status within the dedup window
+func (worker *Worker) notify(notification models.Notification) {
+	if worker.Notifier == nil {
+		return
+	}
+	key := eventKey(notification.Status, notification.CallID)
+	if worker.NotifiedCalls.SeenOrAdd(key, time.Now()) {
+		return
+	}
+	worker.Notifier.Notify(notification)
+}
+
+// rateProvisionally - records a locally rated charge for a call the balance api failed to bill,
+// the message stays queued so the api bills it on redelivery and replaces the provisional charge
+func (worker *Worker) rateProvisionally(billEvent models.BillingEvent) {
+	if worker.RatingEngine == nil {
+		return
+	}
+	log := worker.Log.WithField("call_id", billEvent.CallID)
+	balanceResponse, err := worker.RatingEngine.Rate(billEvent)
+	if err != nil {
+		log.WithError(err).Info("Unable to rate call locally")
+		return
+	}
+	if err = worker.convertCharge(billEvent, &balanceResponse); err != nil {
+		log.WithError(err).Info("Unable to convert local charge")
+		return
+	}
+	if err = dataAdapters.UpdateCallInfo(balanceResponse); err != nil {
+		return
+	}
+	log.WithField("charge_amount", balanceResponse.ChargeAmount).Info("Recorded provisional charge until the balance api bills the call")
+}
+
+// convertCharge - validates the charge of a balance response and converts it into the reporting currency
+// at the rate effective when the call was answered, when a converter is configured
+func (worker *Worker) convertCharge(billEvent models.BillingEvent, balanceResponse *models.BalanceResponse) error {
+	charge, err := balanceResponse.Charge()
+	if err != nil || worker.Converter == nil {
+		return err
+	}
+	answerTime, err := validation.ParseEventTime(billEvent.AnswerTime)
+	if err != nil {
+		return errors.Wrap(err, "invalid answer_time")
+	}
+	balanceResponse.Conversion, err = worker.Converter.Convert(charge, answerTime)
+	return err
+}
+
+// deleteSQSMessages - deletes sqs messages once processed and returns the ids of the deleted entries
+func (worker *Worker) deleteSQSMessages(requestIDList []*sqs.DeleteMessageBatchRequestEntry) []string {
+	var deleted []string
 	if len(requestIDList) > 0 {
 		for i := 0; i < worker.SQSRetry; i++ {
 			resp, err := worker.SQSClient.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
@@ -181,21 +634,38 @@ func (worker *Worker) deleteSQSMessages(requestIDList []*sqs.DeleteMessageBatchR
 			})
 			if err != nil {
 				logger.Log.WithError(err).Info("Unable to delete messages from sqs")
-				if len(resp.Failed) > 0 {
-					for _, failedDelete := range resp.Failed {
-						logger.Log.WithFields(logrus.Fields{
-							"Code":        failedDelete.Code,
-							"Id":          failedDelete.Id,
-							"Message":     failedDelete.Message,
-							"SenderFault": failedDelete.SenderFault,
-						}).Info("Error while deleting sqs message")
-					}
-				}
 				continue
 			}
+			// entries with stale or unknown receipt handles fail individually
+			for _, failedDelete := range resp.Failed {
+				logger.Log.WithFields(logrus.Fields{
+					"Code":        aws.StringValue(failedDelete.Code),
+					"Id":          aws.StringValue(failedDelete.Id),
+					"Message":     aws.StringValue(failedDelete.Message),
+					"SenderFault": aws.BoolValue(failedDelete.SenderFault),
+				}).Info("Error while deleting sqs message")
+			}
+			for _, successfulDelete := range resp.Successful {
+				deleted = append(deleted, aws.StringValue(successfulDelete.Id))
+			}
 			break
 		}
 	}
+	return deleted
+}
+
+// deleteClaimChecks - deletes the offloaded bodies of deleted messages, bodies of messages
+// which are still queued are kept for their redelivery
+func (worker *Worker) deleteClaimChecks(claimChecks map[string]string, deleted []string) {
+	for _, id := range deleted {
+		claimCheckURL, ok := claimChecks[id]
+		if !ok {
+			continue
+		}
+		if err := worker.ClaimCheck.Delete(claimCheckURL); err != nil {
+			worker.Log.WithError(err).WithField("claim_check_url", claimCheckURL).Error("Unable to delete offloaded message body")
+		}
+	}
 }
 
 //Close uninitializes a worker
@@ -1,84 +1,89 @@
 package workerpool
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
-	"github.com/sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
-)
 
-var queueURL = "https://queue.amazonaws.com/88888EXAMPLE/MyQueue"
+	"go-worker/claimcheck"
+	"go-worker/codec"
+	"go-worker/config"
+	dataAdapters "go-worker/data_adapters"
+	"go-worker/envelope"
+	"go-worker/logger"
+	"go-worker/models"
+	"go-worker/queue"
+	"go-worker/queue/sqsfake"
+	"go-worker/signing"
+	"go-worker/webhooks"
+)
 
 // SQSMessage - sqs test message
 const SQSMessage = "Test SQS!"
 
-// mockSQS - holds sqs mocking info
-type mockSQS struct {
-	sqsiface.SQSAPI
-	messages map[string][]*sqs.Message
-}
-
 // TestPositiveFetch - tests a successful sqs fetch
 func TestPositiveFetch(t *testing.T) {
-	q, worker := getMockClient()
-	_, _ = q.SendMessage(&sqs.SendMessageInput{
-		MessageBody: aws.String(SQSMessage),
-		QueueUrl:    &queueURL,
-	})
+	server, worker := getFakeWorker()
+	defer server.Close()
+	sendMessages(t, worker, SQSMessage)
 
 	// call worker fetch
-	message, _ := worker.fetch()
+	message, err := worker.fetch()
+	assert.NoError(t, err)
 	assert.Equal(t, *message.Messages[0].Body, SQSMessage)
 }
 
 // TestNegativeFetch - tests a failure sqs fetch
 func TestNegativeFetch(t *testing.T) {
-	q, worker := getMockClient()
-	_, _ = q.SendMessage(&sqs.SendMessageInput{
-		MessageBody: aws.String("Test SQSiface!"),
-		QueueUrl:    &queueURL,
-	})
+	server, worker := getFakeWorker()
+	defer server.Close()
+	sendMessages(t, worker, "Test SQSiface!")
 
 	// call worker fetch
-	message, _ := worker.fetch()
+	message, err := worker.fetch()
+	assert.NoError(t, err)
 	assert.NotEqual(t, *message.Messages[0].Body, SQSMessage)
 }
 
 // TestPositiveDeleteSQSMessages - tests a successful sqs delete
 func TestPositiveDeleteSQSMessages(t *testing.T) {
-	var requestIDList []*sqs.DeleteMessageBatchRequestEntry
-	q, worker := getMockClient()
-
-	// send sqs message
-	_, _ = q.SendMessage(&sqs.SendMessageInput{
-		MessageBody: aws.String(SQSMessage),
-		QueueUrl:    &queueURL,
-	})
+	server, worker := getFakeWorker()
+	defer server.Close()
+	sendMessages(t, worker, SQSMessage)
 
-	// delete sqs message
-	deleteMessageRequestEntry := sqs.DeleteMessageBatchRequestEntry{}
-	deleteMessageRequestEntry.ReceiptHandle = nil
-	deleteMessageRequestEntry.Id = nil
-	requestIDList = append(requestIDList, &deleteMessageRequestEntry)
-	worker.deleteSQSMessages(requestIDList)
-
-	// fetch sqs message
+	// delete the received sqs message
 	message, _ := worker.fetch()
+	worker.deleteSQSMessages(deleteEntries(message.Messages...))
+
+	// the message is gone even after its visibility timeout
+	assert.Error(t, expireVisibility(worker, message.Messages[0]))
+	message, _ = worker.fetch()
 	assert.Equal(t, len(message.Messages), 0)
 }
 
 // TestNegativeDeleteSQSMessages - tests a failure sqs delete
 func TestNegativeDeleteSQSMessages(t *testing.T) {
-	q, worker := getMockClient()
-
-	// send sqs message
-	_, _ = q.SendMessage(&sqs.SendMessageInput{
-		MessageBody: aws.String(SQSMessage),
-		QueueUrl:    &queueURL,
-	})
+	server, worker := getFakeWorker()
+	defer server.Close()
+	sendMessages(t, worker, SQSMessage)
 
 	// delete sqs message
 	worker.deleteSQSMessages(nil)
@@ -88,49 +93,578 @@ func TestNegativeDeleteSQSMessages(t *testing.T) {
 	assert.NotEqual(t, len(message.Messages), 0)
 }
 
-// getMockClient - returns mocked sqs, worker
-func getMockClient() (sqsiface.SQSAPI, *Worker) {
-	mocksqs := &mockSQS{
-		messages: map[string][]*sqs.Message{},
+// TestPositiveDeleteSQSMessagesByReceipt - tests only the acknowledged messages are deleted
+func TestPositiveDeleteSQSMessagesByReceipt(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+	sendMessages(t, worker, "first", "second", "third")
+
+	message, _ := worker.fetch()
+	check.Len(message.Messages, 3)
+	worker.deleteSQSMessages(deleteEntries(message.Messages[1]))
+
+	// in flight messages are not redelivered before their visibility timeout
+	inFlight, _ := worker.fetch()
+	check.Empty(inFlight.Messages)
+
+	check.NoError(expireVisibility(worker, message.Messages[0]))
+	check.NoError(expireVisibility(worker, message.Messages[2]))
+	redelivered, _ := worker.fetch()
+	check.Len(redelivered.Messages, 2)
+	check.Equal("first", *redelivered.Messages[0].Body)
+	check.Equal("third", *redelivered.Messages[1].Body)
+
+	attributes, err := worker.SQSClient.GetQueueAttributes(&sqs.GetQueueAttributesInput{QueueUrl: &worker.SQSURL})
+	check.NoError(err)
+	check.Equal("2", *attributes.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible])
+}
+
+// TestPositiveDecodeSNSMessage - tests billing events are unwrapped from sns notifications
+func TestPositiveDecodeSNSMessage(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	body := `{"Type": "Notification", "MessageId": "22b80b92", "TopicArn": "arn:aws:sns:us-east-1:8888888888:billing-events",
+		"Message": "{\"user_id\": 1, \"call_id\": \"e21b0dda-6566-402a-8f8c-0657e5b87eeb\"}",
+		"MessageAttributes": {"source": {"Type": "String", "Value": "pbx"}}}`
+	billingEvent, metadata, err := worker.decodeMessage(&sqs.Message{MessageId: aws.String("1"), Body: aws.String(body)})
+	check.NoError(err)
+	check.Equal(1, billingEvent.UserID)
+	check.Equal("e21b0dda-6566-402a-8f8c-0657e5b87eeb", billingEvent.CallID)
+	check.Equal("arn:aws:sns:us-east-1:8888888888:billing-events", metadata.TopicARN)
+	check.Equal("pbx", metadata.Attributes["source"])
+
+	// plain billing events keep the queue message attributes
+	billingEvent, metadata, err = worker.decodeMessage(&sqs.Message{
+		MessageId: aws.String("2"),
+		Body:      aws.String(`{"user_id": 2}`),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"source": {DataType: aws.String("String"), StringValue: aws.String("backfill")},
+		},
+	})
+	check.NoError(err)
+	check.Equal(2, billingEvent.UserID)
+	check.Empty(metadata.TopicARN)
+	check.Equal("backfill", metadata.Attributes["source"])
+}
+
+// TestNegativeDecodeSNSMessage - tests unsigned and non notification sns messages are rejected
+func TestNegativeDecodeSNSMessage(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	body := `{"Type": "SubscriptionConfirmation", "MessageId": "22b80b92", "TopicArn": "arn:aws:sns:us-east-1:8888888888:billing-events"}`
+	_, _, err := worker.decodeMessage(&sqs.Message{Body: aws.String(body)})
+	check.True(isRejected(err))
+
+	worker.SNSVerifier = &envelope.SNSVerifier{}
+	body = `{"Type": "Notification", "MessageId": "22b80b92", "TopicArn": "arn:aws:sns:us-east-1:8888888888:billing-events", "Message": "{}"}`
+	_, _, err = worker.decodeMessage(&sqs.Message{Body: aws.String(body)})
+	check.Error(err)
+}
+
+// TestPositiveDecodeProtobufMessage - tests bodies are decoded by their content type attribute
+func TestPositiveDecodeProtobufMessage(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	body := base64.StdEncoding.EncodeToString(codec.MarshalProto(models.BillingEvent{
+		SchemaVersion: 2,
+		UserID:        1,
+		CallID:        "e21b0dda-6566-402a-8f8c-0657e5b87eeb",
+		Currency:      "EUR",
+	}))
+	contentType := map[string]*sqs.MessageAttributeValue{
+		codec.ContentTypeAttribute: {DataType: aws.String("String"), StringValue: aws.String(codec.ContentTypeProtobuf)},
+	}
+	billingEvent, metadata, err := worker.decodeMessage(&sqs.Message{Body: aws.String(body), MessageAttributes: contentType})
+	check.NoError(err)
+	check.Equal("EUR", billingEvent.Currency)
+	check.Equal(2, metadata.SchemaVersion)
+
+	// a json body under a binary content type can never be decoded
+	_, _, err = worker.decodeMessage(&sqs.Message{Body: aws.String(`{"user_id": 1}`), MessageAttributes: contentType})
+	check.True(isRejected(err))
+}
+
+// TestPositiveCloudEventMessage - tests structured and binary cloudevents are routed by type and deduplicated by id
+func TestPositiveCloudEventMessage(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	var handled []models.MessageMetadata
+	worker.BilledEvents = NewEventCache(time.Minute)
+	worker.Handlers[BillingEventType] = func(billEvent models.BillingEvent, metadata models.MessageMetadata) bool {
+		handled = append(handled, metadata)
+		return true
+	}
+
+	structured := `{"specversion": "1.0", "id": "A234-1234-1234", "source": "/pbx/eu-1", "type": "gobilling.billing_event",
+		"subject": "call/e21b0dda", "time": "2021-07-01T01:00:00Z", "data": {"user_id": 1, "product_id": 2,
+		"call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "answer_time": "2021-07-01 00:30:00", "hangup_time": "2021-07-01 01:00:00"}}`
+	sendMessages(t, worker, structured, structured)
+	_, err := worker.SQSClient.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    &worker.SQSURL,
+		MessageBody: aws.String(`{"user_id": 1, "product_id": 2, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "answer_time": "2021-07-01 00:30:00", "hangup_time": "2021-07-01 01:00:00"}`),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"ce_specversion": {DataType: aws.String("String"), StringValue: aws.String("1.0")},
+			"ce_id":          {DataType: aws.String("String"), StringValue: aws.String("A234-1234-1234")},
+			"ce_source":      {DataType: aws.String("String"), StringValue: aws.String("/pbx/eu-2")},
+			"ce_type":        {DataType: aws.String("String"), StringValue: aws.String("gobilling.billing_event")},
+		},
+	})
+	check.NoError(err)
+
+	// the repeated structured event is deleted without being handled again
+	message, _ := worker.fetch()
+	check.Len(message.Messages, 3)
+	worker.processSQSMessages(message)
+	check.Len(handled, 2)
+	check.Equal("/pbx/eu-1", handled[0].EventSource)
+	check.Equal("call/e21b0dda", handled[0].EventSubject)
+	check.Equal(2021, handled[0].EventTime.Year())
+	check.Equal("/pbx/eu-2", handled[1].EventSource)
+	for _, received := range message.Messages {
+		check.Error(expireVisibility(worker, received))
+	}
+}
+
+// TestNegativeCloudEventMessage - tests cloudevents of unknown types or without required attributes are rejected
+func TestNegativeCloudEventMessage(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	_, _, err := worker.decodeMessage(&sqs.Message{Body: aws.String(`{"specversion": "1.0", "id": "1", "source": "/pbx", "type": "gobilling.refund", "data": {}}`)})
+	check.True(isRejected(err))
+	_, _, err = worker.decodeMessage(&sqs.Message{Body: aws.String(`{"specversion": "1.0", "source": "/pbx", "type": "gobilling.billing_event", "data": {}}`)})
+	check.True(isRejected(err))
+}
+
+// TestNegativeBatchBilling - tests billing events of a receive are sent in one batch call and kept when not billed
+func TestNegativeBatchBilling(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	var requests [][]map[string]interface{}
+	balance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Events []map[string]interface{} `json:"events"`
+		}{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body.Events)
+		var results []string
+		for _, event := range body.Events {
+			results = append(results, fmt.Sprintf(`{"id": %q, "status": 402, "error": "insufficient balance"}`, event["id"]))
+		}
+		_, _ = fmt.Fprintf(w, `{"results": [%s]}`, strings.Join(results, ","))
+	}))
+	defer balance.Close()
+	worker.BalanceRequestHandler.URL = balance.URL
+	worker.BalanceRequestHandler.BatchPath = "Billing/batch"
+
+	// insufficient balance is sent to webhooks once per call
+	var notifications []map[string]interface{}
+	hooks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notification := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&notification)
+		notification["signature"] = r.Header.Get(webhooks.SignatureHeader)
+		notifications = append(notifications, notification)
+	}))
+	defer hooks.Close()
+	worker.Notifier = &webhooks.Notifier{
+		Endpoints: []webhooks.Endpoint{{URL: hooks.URL, Secret: "secret"}},
+		Log:       worker.Log,
 	}
-	log := logrus.New().WithFields(logrus.Fields{"test_worker": 1})
-	worker := &Worker{
-		SQSClient: mocksqs,
-		SQSURL:    queueURL,
-		SQSRetry:  1,
-		Log:       log,
+	worker.Notifier.Start()
+	worker.NotifiedCalls = NewEventCache(time.Minute)
+
+	body := `{"user_id": 1, "product_id": 2, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "answer_time": "2021-07-01 00:30:00", "hangup_time": "2021-07-01 01:00:00"}`
+	sendMessages(t, worker, body, body, body)
+	message, _ := worker.fetch()
+	worker.processSQSMessages(message)
+	worker.Notifier.Close()
+
+	check.Len(requests, 1)
+	check.Len(requests[0], 3)
+	check.Equal(aws.StringValue(message.Messages[0].MessageId), requests[0][0]["id"])
+	for _, received := range message.Messages {
+		check.NoError(expireVisibility(worker, received))
 	}
+	check.Len(notifications, 1)
+	check.Equal(webhooks.StatusInsufficientBalance, notifications[0]["status"])
+	check.Equal("e21b0dda-6566-402a-8f8c-0657e5b87eeb", notifications[0]["call_id"])
+	check.Equal("insufficient balance", notifications[0]["reason"])
+	check.NotEmpty(notifications[0]["signature"])
+}
+
+// TestPositiveSeenOrAdd - tests only one of concurrent notifications of a call and status is sent
+func TestPositiveSeenOrAdd(t *testing.T) {
+	check := assert.New(t)
+	cache := NewEventCache(time.Minute)
+	now := time.Now()
 
-	return mocksqs, worker
+	var wg sync.WaitGroup
+	var sent int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !cache.SeenOrAdd(eventKey(webhooks.StatusBilled, "e21b0dda-6566-402a-8f8c-0657e5b87eeb"), now) {
+				atomic.AddInt32(&sent, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	check.Equal(int32(1), sent)
+	check.False(cache.SeenOrAdd(eventKey(webhooks.StatusBilled, "e21b0dda-6566-402a-8f8c-0657e5b87eeb"), now.Add(time.Minute)))
 }
 
-// SendMessage - mock function for sending message
-func (m *mockSQS) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
-	m.messages[*in.QueueUrl] = append(m.messages[*in.QueueUrl], &sqs.Message{
-		Body: in.MessageBody,
+// TestPositiveBatchBillingDuplicateCloudEvent - tests copies of a cloudevent in one receive are batched once
+func TestPositiveBatchBillingDuplicateCloudEvent(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	var requests [][]map[string]interface{}
+	balance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Events []map[string]interface{} `json:"events"`
+		}{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body.Events)
+		_, _ = fmt.Fprint(w, `{"results": []}`)
+	}))
+	defer balance.Close()
+	worker.BalanceRequestHandler.URL = balance.URL
+	worker.BalanceRequestHandler.BatchPath = "Billing/batch"
+	worker.BilledEvents = NewEventCache(time.Minute)
+
+	structured := `{"specversion": "1.0", "id": "A234-1234-1234", "source": "/pbx/eu-1", "type": "gobilling.billing_event",
+		"data": {"user_id": 1, "product_id": 2, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb",
+		"answer_time": "2021-07-01 00:30:00", "hangup_time": "2021-07-01 01:00:00"}}`
+	sendMessages(t, worker, structured, structured)
+	message, _ := worker.fetch()
+	check.Len(message.Messages, 2)
+	worker.processSQSMessages(message)
+
+	check.Len(requests, 1)
+	check.Len(requests[0], 1)
+	check.Equal(aws.StringValue(message.Messages[0].MessageId), requests[0][0]["id"])
+}
+
+// TestPositiveBatchedWriteReservesEvent - tests a cloudevent is reserved once its charge is submitted to the write batcher
+func TestPositiveBatchedWriteReservesEvent(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	worker.BilledEvents = NewEventCache(time.Minute)
+	worker.Writes = dataAdapters.NewWriteBatcher(10, time.Minute)
+	metadata := models.MessageMetadata{MessageID: "1", EventID: "A234-1234-1234", EventSource: "/pbx/eu-1"}
+	billEvent := models.BillingEvent{UserID: 1, CallID: "e21b0dda-6566-402a-8f8c-0657e5b87eeb", AnswerTime: "2021-07-01 00:30:00"}
+
+	check.False(worker.recordBalance(billEvent, metadata, []byte(`{"call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "charge_amount": "1.50"}`)))
+	check.Len(worker.pending, 1)
+	check.True(worker.BilledEvents.Seen(eventKey(metadata.EventSource, metadata.EventID), time.Now()))
+}
+
+// TestPositiveMissingCallParked - tests charges of missing call info rows are parked and applied without billing the call again
+func TestPositiveMissingCallParked(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	calls := 0
+	balance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = fmt.Fprint(w, `{"call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "charge_amount": "1.50"}`)
+	}))
+	defer balance.Close()
+	worker.BalanceRequestHandler.URL = balance.URL
+
+	db, mock, err := sqlmock.New()
+	check.NoError(err)
+	defer db.Close()
+	gormDB, err := gorm.Open("mysql", db)
+	check.NoError(err)
+	dataAdapters.SetDB(gormDB)
+
+	// the call info row is missing, so the charge is parked and the message deleted
+	mock.ExpectExec("UPDATE call_info SET billing_cost = \\?").
+		WithArgs("1.50", "USD", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO call_info_orphans").
+		WithArgs("e21b0dda-6566-402a-8f8c-0657e5b87eeb", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	sendMessages(t, worker, `{"user_id": 1, "product_id": 2, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "answer_time": "2021-07-01 00:30:00", "hangup_time": "2021-07-01 01:00:00"}`)
+	message, _ := worker.fetch()
+	worker.processSQSMessages(message)
+	check.Error(expireVisibility(worker, message.Messages[0]))
+
+	// the retry applies the parked charge once the row exists
+	mock.ExpectQuery("SELECT \\* FROM `call_info_orphans`").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "call_id", "balance_response", "parked_at"}).
+			AddRow(1, "e21b0dda-6566-402a-8f8c-0657e5b87eeb", `{"call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "charge_amount": "1.50"}`, 1))
+	mock.ExpectExec("UPDATE call_info SET billing_cost = \\?").
+		WithArgs("1.50", "USD", "e21b0dda-6566-402a-8f8c-0657e5b87eeb").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM call_info_orphans").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	applied, remaining, err := dataAdapters.NewOrphanRetrier(time.Minute, time.Minute).RetryOnce(time.Now())
+	check.NoError(err)
+	check.Equal(1, applied)
+	check.Equal(0, remaining)
+	check.NoError(mock.ExpectationsWereMet())
+	check.Equal(1, calls)
+}
+
+// TestPositiveClaimCheckMessage - tests offloaded bodies are resolved and deleted once the message is acknowledged
+func TestPositiveClaimCheckMessage(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	checker, err := claimcheck.NewStoreChecker("file://"+t.TempDir(), 10)
+	check.NoError(err)
+	body, err := checker.Offload(`{"user_id": 1, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb"}`)
+	check.NoError(err)
+	sendMessages(t, worker, body)
+
+	// pointers are only resolved from the configured store
+	message, _ := worker.fetch()
+	_, _, err = worker.decodeMessage(message.Messages[0])
+	check.True(isRejected(err))
+	worker.ClaimCheck = checker
+
+	billingEvent, metadata, err := worker.decodeMessage(message.Messages[0])
+	check.NoError(err)
+	check.Equal("e21b0dda-6566-402a-8f8c-0657e5b87eeb", billingEvent.CallID)
+	check.NotEmpty(metadata.ClaimCheckURL)
+
+	deleted := worker.deleteSQSMessages(deleteEntries(message.Messages...))
+	check.Equal([]string{*message.Messages[0].MessageId}, deleted)
+	worker.deleteClaimChecks(map[string]string{deleted[0]: metadata.ClaimCheckURL}, deleted)
+	_, _, err = worker.decodeMessage(message.Messages[0])
+	check.True(isRejected(err))
+}
+
+// TestNegativeSignedMessage - tests unsigned and forged messages are moved to the dead letter queue before billing
+func TestNegativeSignedMessage(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+
+	worker.Signatures = &signing.Keyring{Keys: map[string][]byte{"k1": []byte("secret")}, SigningKeyID: "k1", Required: true, MaxAge: time.Minute}
+	worker.DLQClient = worker.SQSClient
+	worker.DLQURL = server.QueueURL("billing-events-dlq")
+
+	body := `{"user_id": 1, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb"}`
+	signature, err := worker.Signatures.Sign(body, time.Now())
+	check.NoError(err)
+	messageAttributes := map[string]*sqs.MessageAttributeValue{}
+	for name, value := range signature {
+		messageAttributes[name] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	_, _, err = worker.decodeMessage(&sqs.Message{Body: aws.String(body), MessageAttributes: messageAttributes})
+	check.NoError(err)
+
+	// freshness is measured at send time, so a redelivery long after the signature is accepted
+	signature, err = worker.Signatures.Sign(body, time.Now().Add(-time.Hour))
+	check.NoError(err)
+	oldAttributes := map[string]*sqs.MessageAttributeValue{}
+	for name, value := range signature {
+		oldAttributes[name] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	sent := func(at time.Time) map[string]*string {
+		return map[string]*string{
+			sqs.MessageSystemAttributeNameSentTimestamp: aws.String(strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)),
+		}
+	}
+	_, _, err = worker.decodeMessage(&sqs.Message{Body: aws.String(body), MessageAttributes: oldAttributes, Attributes: sent(time.Now().Add(-time.Hour))})
+	check.NoError(err)
+	_, _, err = worker.decodeMessage(&sqs.Message{Body: aws.String(body), MessageAttributes: oldAttributes, Attributes: sent(time.Now())})
+	check.Equal(signing.ErrStale, errors.Cause(err).(rejectedError).error)
+
+	// a forged user id fails the signature check
+	forged := `{"user_id": 2, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb"}`
+	_, _, err = worker.decodeMessage(&sqs.Message{Body: aws.String(forged), MessageAttributes: messageAttributes})
+	check.True(isRejected(err))
+	check.Equal(signing.ErrForged, errors.Cause(err).(rejectedError).error)
+
+	// rejected messages are moved without calling the balance service
+	sendMessages(t, worker, body)
+	message, _ := worker.fetch()
+	worker.processSQSMessages(message)
+	check.Error(expireVisibility(worker, message.Messages[0]))
+
+	dead, err := worker.SQSClient.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:              &worker.DLQURL,
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
 	})
-	return &sqs.SendMessageOutput{}, nil
+	check.NoError(err)
+	check.Len(dead.Messages, 1)
+	check.Equal(body, aws.StringValue(dead.Messages[0].Body))
+	check.Equal(signing.ErrUnsigned.Error(), aws.StringValue(dead.Messages[0].MessageAttributes[DeadLetterReasonAttribute].StringValue))
+}
+
+// TestNegativeSignedMessageNATS - tests rejected messages of a jetstream queue are terminated once dead lettered
+func TestNegativeSignedMessageNATS(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+	ns, err := natsserver.NewServer(&natsserver.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	check.NoError(err)
+	ns.Start()
+	defer ns.Shutdown()
+	check.True(ns.ReadyForConnections(5 * time.Second))
+	events, err := queue.OpenNATSQueue(ns.ClientURL()+"/EVENTS/go-worker", queue.NATSQueueOptions{Subject: "billing.events", Create: true})
+	check.NoError(err)
+	defer events.Close()
+
+	worker.Signatures = &signing.Keyring{Keys: map[string][]byte{"k1": []byte("secret")}, SigningKeyID: "k1", Required: true, MaxAge: time.Minute}
+	worker.DLQClient = worker.SQSClient
+	worker.DLQURL = server.QueueURL("billing-events-dlq")
+	worker.SQSClient = events
+
+	sendMessages(t, worker, `{"user_id": 1, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb"}`)
+	message, err := worker.fetch()
+	check.NoError(err)
+	check.Len(message.Messages, 1)
+	worker.processSQSMessages(message)
+
+	// the terminated message is settled and never redelivered
+	check.Error(expireVisibility(worker, message.Messages[0]))
+	redelivered, err := worker.fetch()
+	check.NoError(err)
+	check.Empty(redelivered.Messages)
+	dead, err := worker.DLQClient.ReceiveMessage(&sqs.ReceiveMessageInput{QueueUrl: &worker.DLQURL})
+	check.NoError(err)
+	check.Len(dead.Messages, 1)
 }
 
-// ReceiveMessage - mock function for receiving messages
-func (m *mockSQS) ReceiveMessage(in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
-	if len(m.messages[*in.QueueUrl]) == 0 {
-		return &sqs.ReceiveMessageOutput{}, nil
+// TestNegativeInvalidMessage - tests events failing validation are moved to the dead letter queue before billing
+func TestNegativeInvalidMessage(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+	worker.DLQClient = worker.SQSClient
+	worker.DLQURL = server.QueueURL("billing-events-dlq")
+
+	body := `{"user_id": 1, "product_id": 2, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb",
+		"answer_time": "2021-07-01 01:00:00", "hangup_time": "2021-07-01 00:30:00"}`
+	sendMessages(t, worker, body)
+	message, _ := worker.fetch()
+	worker.processSQSMessages(message)
+	check.Error(expireVisibility(worker, message.Messages[0]))
+
+	dead, err := worker.SQSClient.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:              &worker.DLQURL,
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	})
+	check.NoError(err)
+	check.Len(dead.Messages, 1)
+	check.Equal("hangup_time must not be before answer_time", aws.StringValue(dead.Messages[0].MessageAttributes[DeadLetterReasonAttribute].StringValue))
+}
+
+// TestNegativeInvalidMessageNATS - tests rejected messages are dead lettered to a jetstream queue
+func TestNegativeInvalidMessageNATS(t *testing.T) {
+	check := assert.New(t)
+	server, worker := getFakeWorker()
+	defer server.Close()
+	ns, err := natsserver.NewServer(&natsserver.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	check.NoError(err)
+	ns.Start()
+	defer ns.Shutdown()
+	check.True(ns.ReadyForConnections(5 * time.Second))
+	dlq, err := queue.OpenNATSQueue(ns.ClientURL()+"/DLQ/go-worker", queue.NATSQueueOptions{Subject: "billing.dead", Create: true})
+	check.NoError(err)
+	defer dlq.Close()
+	worker.DLQClient = dlq
+
+	sendMessages(t, worker, `{"user_id": 1, "call_id": "e21b0dda-6566-402a-8f8c-0657e5b87eeb", "answer_time": "soon"}`)
+	message, _ := worker.fetch()
+	worker.processSQSMessages(message)
+	check.Error(expireVisibility(worker, message.Messages[0]))
+
+	dead, err := dlq.ReceiveMessage(&sqs.ReceiveMessageInput{
+		MaxNumberOfMessages:   aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(1),
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	})
+	check.NoError(err)
+	check.Len(dead.Messages, 1)
+	check.Equal(aws.StringValue(message.Messages[0].Body), aws.StringValue(dead.Messages[0].Body))
+	check.NotEmpty(aws.StringValue(dead.Messages[0].MessageAttributes[DeadLetterReasonAttribute].StringValue))
+}
+
+// getFakeWorker - returns a fake sqs server and a worker pointed at it through the endpoint override
+func getFakeWorker() (*sqsfake.Server, *Worker) {
+	server := sqsfake.NewServer(queue.FileQueueOptions{VisibilityTimeout: 30})
+
+	v := viper.New()
+	v.Set("sqs.region", "us-east-1")
+	v.Set("sqs.endpoint", server.URL)
+	v.Set("sqs.url", server.QueueURL("billing-events"))
+	v.Set("sqs.retry_count", 1)
+	v.Set("worker.max_events", 10)
+	v.Set("worker.wait_time", 0)
+	config.SetConfig(v)
+	logger.Init()
+	_ = os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	_ = os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	return server, NewWorker(1)
+}
+
+// sendMessages - sends messages with the given bodies
+func sendMessages(t *testing.T, worker *Worker, bodies ...string) {
+	for _, body := range bodies {
+		_, err := worker.SQSClient.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String(body),
+			QueueUrl:    &worker.SQSURL,
+		})
+		if err != nil {
+			t.Fatalf("unable to send message: %s", err)
+		}
 	}
-	response := m.messages[*in.QueueUrl][0:1]
-	m.messages[*in.QueueUrl] = m.messages[*in.QueueUrl][1:]
-	return &sqs.ReceiveMessageOutput{
-		Messages: response,
-	}, nil
 }
 
-// DeleteMessageBatch - mock function for deleting messages
-func (m *mockSQS) DeleteMessageBatch(de *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
-	if len(m.messages[*de.QueueUrl]) == 0 {
-		return &sqs.DeleteMessageBatchOutput{}, nil
+// TestPositiveTransientStatus - test only server errors and timeouts are rated locally
+func TestPositiveTransientStatus(t *testing.T) {
+	check := assert.New(t)
+	check.True(transientStatus(http.StatusInternalServerError))
+	check.True(transientStatus(http.StatusServiceUnavailable))
+	check.True(transientStatus(http.StatusRequestTimeout))
+	check.False(transientStatus(http.StatusPaymentRequired))
+	check.False(transientStatus(http.StatusBadRequest))
+}
+
+// deleteEntries - returns delete entries for received messages
+func deleteEntries(messages ...*sqs.Message) []*sqs.DeleteMessageBatchRequestEntry {
+	var requestIDList []*sqs.DeleteMessageBatchRequestEntry
+	for _, message := range messages {
+		requestIDList = append(requestIDList, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            message.MessageId,
+			ReceiptHandle: message.ReceiptHandle,
+		})
 	}
-	m.messages[*de.QueueUrl] = m.messages[*de.QueueUrl][1:]
-	return &sqs.DeleteMessageBatchOutput{
-		Failed: nil,
-	}, nil
+	return requestIDList
+}
+
+// expireVisibility - makes a received message visible again
+func expireVisibility(worker *Worker, message *sqs.Message) error {
+	_, err := worker.SQSClient.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &worker.SQSURL,
+		ReceiptHandle:     message.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	return err
 }
@@ -1,8 +1,12 @@
 package workerpool
 
 import (
-	"go-worker/logger"
 	"sync"
+
+	"go-worker/config"
+	dataAdapters "go-worker/data_adapters"
+	"go-worker/logger"
+	"go-worker/webhooks"
 )
 
 // closeChan - close channel for worker pool
@@ -11,6 +15,13 @@ var closeChan chan bool
 // wg - wait group for worker pool
 var wg sync.WaitGroup
 
+var (
+	// notifier - sends billing outcomes to webhooks, shared by the workers of the pool
+	notifier *webhooks.Notifier
+	// notifierOnce - creates and starts notifier on first use
+	notifierOnce sync.Once
+)
+
 // WorkerPool - holds worker list
 type WorkerPool struct {
 	workerList []Worker
@@ -41,9 +52,33 @@ func spawnWorkers(numWorkers int) []Worker {
 	return workerList
 }
 
+// sharedNotifier - returns the webhook notifier shared by the workers of the pool, nil when webhooks are disabled
+func sharedNotifier() *webhooks.Notifier {
+	notifierOnce.Do(func() {
+		cfg := config.GetConfig()
+		var deliveryLog webhooks.DeliveryLog
+		if cfg.GetBool("webhooks.log_deliveries") {
+			deliveryLog = dataAdapters.NewWebhookDeliveryLog()
+		}
+		var err error
+		notifier, err = webhooks.NewNotifier(deliveryLog, logger.Log.WithField("module", "webhooks"))
+		if err != nil {
+			logger.Log.WithError(err).Fatal("Unable to load webhooks")
+		}
+		if notifier != nil {
+			notifier.Start()
+		}
+	})
+	return notifier
+}
+
 // Close - stop all the workers
 func (wp *WorkerPool) Close() {
 	close(closeChan)
 	wg.Wait()
+	// the notifier is shared, so it is closed once all workers are done with it
+	if notifier != nil {
+		notifier.Close()
+	}
 	logger.Log.Info("Successfully closed all workers")
 }